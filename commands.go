@@ -1,17 +1,70 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
+	servicebus "github.com/Azure/azure-service-bus-go"
 	cc "github.com/aagoldingay/sb-shovel/config"
 	sbio "github.com/aagoldingay/sb-shovel/io"
 	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
+const (
+	ERR_COUNTMISMATCH   string = "queue has %d message(s) remaining, expected %d"
+	ERR_INTERRUPTED     string = "interrupted before completion"
+	ERR_JOURNALEXISTS   string = "send journal %s shows lines up to %d already sent. Provide -resume to continue, or delete the journal to send from the beginning"
+	ERR_JOURNALMISMATCH string = "send journal %s was written for a different file or queue, or the file has changed. Delete the journal to send from the beginning"
+	ERR_NOQUEUESMATCH   string = "no queues match '%s'"
+	ERR_QUEUESFAILED    string = "%d of %d queue(s) failed"
+	ERR_UNSETTLED       string = "%d message(s) could not be settled"
+	FORMAT_CSV          string = "csv"
+	FORMAT_ENVELOPE     string = "envelope"
+	FORMAT_JSON         string = "json"
+	FORMAT_TABLE        string = "table"
+	FORMAT_TEXT         string = "text"
+	SORT_DLQ            string = "dlq"
+	SORT_NAME           string = "name"
+	STATUS_FOUND        string = "[status] identified %s in message\n"
+	STATUS_PROGRESS     string = "\r[status] completed %d of %d messages (%.0f/s)"
+	STATUS_RETRIED      string = "[status] retried %d call(s) after transient errors, %d throttled by Service Bus\n"
+	STATUS_SANDBOX      string = "[sandbox] running against an in-memory namespace, no changes are made to Service Bus\n"
+)
+
+// sandboxMessages is the number of active and dead-lettered sample messages placed on each queue or subscription of a sandbox.
+const sandboxMessages = 10
+
+// recountAttempts is the number of times a queue is counted when verifying an operation, as Service Bus counts can lag behind settled messages.
+const recountAttempts = 3
+
+// recountDelay is the time waited between each recount.
+var recountDelay = time.Second
+
+// outcomeError reports that an operation on many messages did not do everything it reported, e.g. a message could not be settled,
+// or the queue count does not match the messages completed. main exits with EXIT_OUTCOME.
+type outcomeError struct {
+	msg string
+}
+
+func (e *outcomeError) Error() string {
+	return e.msg
+}
+
 func config(config cc.ConfigManager, args []string) {
 	err := config.LoadConfig()
 	if err != nil && err.Error() != cc.ERR_NOCONFIG {
@@ -58,14 +111,30 @@ func config(config cc.ConfigManager, args []string) {
 	}
 }
 
-func pull(sb sbc.Controller, q string, dlq bool, maxWrite int) error {
-	err := sb.SetupSourceQueue(q, dlq, false)
+// pull writes every message on a queue or subscription to output files, in the output directory, or its subDir.
+func pull(ctx context.Context, sb sbc.Controller, e sbc.Entity, maxWrite int, format, tmpl, subDir string) error {
+	var r sbio.Renderer
+	switch format {
+	case "", FORMAT_TEXT:
+		t, err := template.New("pull").Parse(tmpl)
+		if err != nil {
+			fmt.Println("Problem parsing template. Refer to the approved syntax: https://pkg.go.dev/text/template")
+			return err
+		}
+		r = t
+	case FORMAT_ENVELOPE:
+		r = sbio.EnvelopeRenderer{}
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+
+	err := sb.SetupSource(e, false)
 	if err != nil {
 		return err
 	}
 	defer sb.DisconnectSource()
 
-	total, err := sb.GetSourceQueueCount()
+	total, err := sb.GetSourceQueueCount(ctx)
 	if err != nil {
 		return err
 	}
@@ -73,23 +142,23 @@ func pull(sb sbc.Controller, q string, dlq bool, maxWrite int) error {
 		return fmt.Errorf("no messages on queue")
 	}
 
-	fmt.Printf("%d messages to process on %s queue...\n", total, q)
+	fmt.Printf("%d messages to process on %s...\n", total, e)
 
-	err = sbio.CreateDir()
+	err = sbio.CreateOutputDir(subDir)
 	if err != nil {
 		return err
 	}
 
-	returnedMsgs := make(chan []string)
+	returnedMsgs := make(chan []*sbc.Message)
 	eChan := make(chan error)
 
 	start := time.Now()
-	go sb.ReadSourceQueue(returnedMsgs, eChan, maxWrite)
+	go sb.ReadSourceQueue(ctx, returnedMsgs, eChan, maxWrite)
 
 	var wg sync.WaitGroup
 
 	done := false
-	fileCount := 1
+	fileCount, written := 1, 0
 
 	for !done {
 		select {
@@ -99,15 +168,20 @@ func pull(sb sbc.Controller, q string, dlq bool, maxWrite int) error {
 				continue
 			}
 			wg.Add(1)
-			go sbio.WriteFile(eChan, fileCount, msgs, &wg)
+			go sbio.WriteFileIn(subDir, eChan, fileCount, msgs, r, &wg)
 			fileCount++
+			written += len(msgs)
 		case e := <-eChan:
-			if e.Error() == sbc.ERR_QUEUEEMPTY {
+			if errors.Is(e, sbc.ErrQueueEmpty) {
 				close(returnedMsgs)
 				wg.Wait()
 				break
 			}
 			wg.Wait()
+			if ctx.Err() != nil {
+				fmt.Printf("%d message(s) written to %d file(s)\n", written, fileCount-1)
+				return errors.New(ERR_INTERRUPTED)
+			}
 			return e
 		}
 	}
@@ -115,31 +189,246 @@ func pull(sb sbc.Controller, q string, dlq bool, maxWrite int) error {
 	wg.Wait()
 	close(eChan)
 
+	fmt.Printf("%d message(s) written to %d file(s)\n", written, fileCount-1)
 	fmt.Printf("Finished in %dms\n", time.Since(start).Milliseconds())
 
 	return nil
 }
 
-func requeue(sb sbc.Controller, q string, all, dlq bool) error {
-	if !dlq {
-		return fmt.Errorf("cannot requeue messages directly to a dead letter queue")
+// parseAge parses a duration, additionally accepting a whole number of days, e.g. '7d'. An empty string is a zero duration.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
 	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age '%s'", s)
+	}
+	return d, nil
+}
 
-	err := sb.SetupSourceQueue(q, dlq, true)
+// buildFilter creates a filter from command line criteria. Properties are provided as comma separated key=value pairs.
+// Ages select messages enqueued before (older than) or after (newer than) the current time minus the age.
+//
+// nil is returned when no criteria are provided.
+func buildFilter(pattern, properties, reason, description, olderThan, newerThan string) (*sbc.Filter, error) {
+	if pattern == "" && properties == "" && reason == "" && description == "" && olderThan == "" && newerThan == "" {
+		return nil, nil
+	}
+
+	var err error
+	f := &sbc.Filter{}
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return nil, err
+		}
+		f.EnqueuedBefore = time.Now().Add(-age)
+	}
+	if newerThan != "" {
+		age, err := parseAge(newerThan)
+		if err != nil {
+			return nil, err
+		}
+		f.EnqueuedAfter = time.Now().Add(-age)
+	}
+	if pattern != "" {
+		if f.Pattern, err = regexp.Compile(pattern); err != nil {
+			fmt.Println("Problem compiling regex. Refer to the approved syntax: https://github.com/google/re2/wiki/Syntax")
+			return nil, err
+		}
+	}
+	if reason != "" {
+		if f.DeadLetterReason, err = regexp.Compile(reason); err != nil {
+			fmt.Println("Problem compiling regex. Refer to the approved syntax: https://github.com/google/re2/wiki/Syntax")
+			return nil, err
+		}
+	}
+	if description != "" {
+		if f.DeadLetterDescription, err = regexp.Compile(description); err != nil {
+			fmt.Println("Problem compiling regex. Refer to the approved syntax: https://github.com/google/re2/wiki/Syntax")
+			return nil, err
+		}
+	}
+	if properties != "" {
+		f.Properties = make(map[string]string)
+		for _, p := range strings.Split(properties, ",") {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid property filter '%s', expected key=value", p)
+			}
+			f.Properties[kv[0]] = kv[1]
+		}
+	}
+	return f, nil
+}
+
+// buildTransform creates a body transform from command line options. Only one kind of transform may be provided.
+//
+// nil is returned when no transform is provided.
+func buildTransform(tmpl, patch, find, replace string) (sbc.Transform, error) {
+	provided := 0
+	for _, v := range []string{tmpl, patch, find} {
+		if v != "" {
+			provided++
+		}
+	}
+	if provided > 1 {
+		return nil, fmt.Errorf("only one of -transform-template, -transform-patch or -transform-find can be provided")
+	}
+	if replace != "" && find == "" {
+		return nil, fmt.Errorf("-transform-replace requires -transform-find")
+	}
+
+	switch {
+	case tmpl != "":
+		t, err := template.New("transform").Parse(tmpl)
+		if err != nil {
+			fmt.Println("Problem parsing template. Refer to the approved syntax: https://pkg.go.dev/text/template")
+			return nil, err
+		}
+		return &sbc.TemplateTransform{Template: t}, nil
+	case patch != "":
+		if !json.Valid([]byte(patch)) {
+			return nil, fmt.Errorf("merge patch is not valid JSON")
+		}
+		return &sbc.MergePatchTransform{Patch: []byte(patch)}, nil
+	case find != "":
+		rex, err := regexp.Compile(find)
+		if err != nil {
+			fmt.Println("Problem compiling regex. Refer to the approved syntax: https://github.com/google/re2/wiki/Syntax")
+			return nil, err
+		}
+		return &sbc.RegexTransform{Pattern: rex, Replacement: replace}, nil
+	}
+	return nil, nil
+}
+
+// settingFlags are the command line flags, and profile config key suffixes, that tune a Controller.
+var settingFlags = []string{"concurrency", "page-size", "prefetch", "settle-timeout", "rate", "burst", "max-attempts", "max-message-size", "batch-size"}
+
+// buildSettings creates Controller settings from a config profile and command line flags. Flags take precedence over the profile.
+//
+// The profile is the config key of the connection string, e.g. PROD for '-conn cfg|PROD', and its settings are stored in config as
+// 'PROD.concurrency', for example. flags contains the values of setting flags provided on the command line.
+func buildSettings(cfg cc.ConfigManager, profile string, flags map[string]string) (sbc.Settings, error) {
+	values := make(map[string]string)
+	if profile != "" && cfg != nil {
+		err := cfg.LoadConfig()
+		if err != nil && err.Error() != cc.ERR_NOCONFIG && !os.IsNotExist(err) {
+			return sbc.Settings{}, err
+		}
+		for _, name := range settingFlags {
+			if v, err := cfg.GetConfigValue(fmt.Sprintf("%s.%s", profile, name)); err == nil && v != "" {
+				values[name] = v
+			}
+		}
+	}
+	for name, v := range flags {
+		values[name] = v
+	}
+
+	s := sbc.Settings{}
+	for name, v := range values {
+		var err error
+		switch name {
+		case "concurrency":
+			s.Concurrency, err = strconv.Atoi(v)
+		case "page-size":
+			s.PageSize, err = strconv.Atoi(v)
+		case "prefetch":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			s.Prefetch = uint32(n)
+		case "settle-timeout":
+			s.SettleTimeout, err = time.ParseDuration(v)
+		case "rate":
+			// ParseRate describes the expected format
+			if s.Rate, err = sbc.ParseRate(v); err != nil {
+				return sbc.Settings{}, err
+			}
+		case "burst":
+			s.Burst, err = strconv.Atoi(v)
+		case "max-attempts":
+			s.MaxAttempts, err = strconv.Atoi(v)
+		case "max-message-size":
+			// ParseSize describes the expected format
+			if s.MaxMessageSize, err = sbc.ParseSize(v); err != nil {
+				return sbc.Settings{}, err
+			}
+		case "batch-size":
+			s.BatchSize, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return sbc.Settings{}, fmt.Errorf("invalid %s '%s'", name, v)
+		}
+	}
+	return s, nil
+}
+
+// requeue moves messages from a source queue or subscription to a target queue or topic. A zero target is the source queue.
+func requeue(ctx context.Context, sb sbc.Controller, source, target sbc.Entity, targetConn string, filter *sbc.Filter, transform sbc.Transform, all, audit, newIDs bool) error {
+	if filter != nil && !all {
+		return fmt.Errorf("filters can only be applied when requeueing with -all")
+	}
+	if filter != nil && !source.DeadLetter {
+		// each non-matching message is abandoned, incrementing its DeliveryCount, which dead-letters it once MaxDeliveryCount is reached
+		return fmt.Errorf("filters can only be applied when requeueing from a dead letter queue, as non-matching messages on an active queue would be dead-lettered after repeated runs. Provide -dlq")
+	}
+	if target == (sbc.Entity{}) {
+		if source.Queue == "" {
+			return fmt.Errorf("messages cannot be sent to a subscription. Provide -target-q or -target-topic")
+		}
+		target = sbc.QueueEntity(source.Queue, false)
+	}
+	if err := target.Validate(); err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+	if targetConn == "" {
+		if !source.DeadLetter && source.Queue != "" && target.Queue == source.Queue {
+			return fmt.Errorf("cannot requeue messages directly to a dead letter queue")
+		}
+		if source.Subscription != "" && target.Topic == source.Topic {
+			if source.DeadLetter {
+				// a message published to the topic is copied to every subscription, not only the one it was dead-lettered from
+				return fmt.Errorf("cannot requeue a subscription's dead letter queue to its own topic, as messages would be delivered to every subscription. Provide -target-q")
+			}
+			return fmt.Errorf("cannot requeue messages from a subscription to its own topic, as they would be received again")
+		}
+	}
+
+	err := sb.SetupSource(source, true)
 
 	if err != nil {
 		return err
 	}
 
-	err = sb.SetupTargetQueue(q, !dlq, true)
+	if targetConn != "" {
+		err = sb.SetupTargetNamespace(targetConn)
+		if err != nil {
+			return fmt.Errorf("problem connecting to target namespace: %v", err)
+		}
+	}
+
+	err = sb.SetupTarget(target, true)
 	if err != nil {
-		return fmt.Errorf("problem setting up target queue: %v", err)
+		return fmt.Errorf("problem setting up target %s: %v", target, err)
 	}
 	defer sb.DisconnectQueues()
 
 	if all {
-		c, err := sb.GetSourceQueueCount()
+		c, err := sb.GetSourceQueueCount(ctx)
 
+		if ctx.Err() != nil {
+			return errors.New(ERR_INTERRUPTED)
+		}
 		if err != nil {
 			return err
 		}
@@ -149,13 +438,25 @@ func requeue(sb sbc.Controller, q string, all, dlq bool) error {
 		}
 
 		fmt.Printf("%d messages to requeue\n", c)
-		err = sb.RequeueManyMessages(c)
+		progress, stop := printProgress(nil)
+		p, err := sb.RequeueManyMessages(ctx, progress, c, filter, transform, audit, newIDs)
+		stop()
+		printOutcome("requeued", p)
+		if p.Unsettled() > 0 {
+			fmt.Println("WARNING: messages that could not be settled were sent to the target queue, and remain on the source queue")
+		}
+		if ctx.Err() != nil {
+			return errors.New(ERR_INTERRUPTED)
+		}
 		if err != nil {
 			return err
 		}
-		fmt.Println("messages requeued")
+		return verifyOutcome(sb, c, p)
 	} else {
-		err = sb.RequeueOneMessage()
+		err = sb.RequeueOneMessage(ctx, transform, audit, newIDs)
+		if ctx.Err() != nil {
+			return errors.New(ERR_INTERRUPTED)
+		}
 		if err != nil {
 			return err
 		}
@@ -165,16 +466,24 @@ func requeue(sb sbc.Controller, q string, all, dlq bool) error {
 	return nil
 }
 
-func delete(sb sbc.Controller, q string, dlq, all, delay bool) error {
-	err := sb.SetupSourceQueue(q, dlq, true)
+// delete deletes one message, or with all, every message matching the filter, archiving them first to the output directory, or its subDir.
+func delete(ctx context.Context, sb sbc.Controller, e sbc.Entity, filter *sbc.Filter, all bool, subDir string) error {
+	if filter != nil && !all {
+		return fmt.Errorf("filters can only be applied when deleting with -all")
+	}
+
+	err := sb.SetupSource(e, true)
 
 	if err != nil {
 		return err
 	}
 	defer sb.DisconnectSource()
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(ctx)
 
+	if ctx.Err() != nil {
+		return errors.New(ERR_INTERRUPTED)
+	}
 	if err != nil {
 		return err
 	}
@@ -183,65 +492,458 @@ func delete(sb sbc.Controller, q string, dlq, all, delay bool) error {
 	}
 
 	if all {
+		archive, err := sbio.NewFileArchiverIn(subDir, e.FileName())
+		if err != nil {
+			return fmt.Errorf("could not create archive, no messages deleted: %v", err)
+		}
+		defer archive.Close()
+
 		fmt.Printf("%d messages to delete\n", c)
-		eChan := make(chan error)
-		go sb.DeleteManyMessages(eChan, c, delay)
-
-		done := false
-		for !done {
-			e := <-eChan
-			if strings.Contains(e.Error(), "[status]") {
-				fmt.Print(e.Error())
-				continue
-			}
-			if e.Error() != "context canceled" {
-				return e
-			}
-			fmt.Println("") // blank line to separate status overwrites from completion messages
-			done = true
+		fmt.Printf("archiving deleted messages to %s\n", archive.Name())
+		progress, stop := printProgress(nil)
+		p, err := sb.DeleteManyMessages(ctx, progress, c, filter, archive)
+		stop()
+		printOutcome("deleted", p)
+		if ctx.Err() != nil {
+			return errors.New(ERR_INTERRUPTED)
 		}
-		close(eChan)
+		if err != nil {
+			return err
+		}
+		return verifyOutcome(sb, c, p)
 	} else {
-		err = sb.DeleteOneMessage()
+		err = sb.DeleteOneMessage(ctx)
+		if ctx.Err() != nil {
+			return errors.New(ERR_INTERRUPTED)
+		}
 		if err != nil {
 			return err
 		}
 		fmt.Println("1 message deleted")
 		return nil
 	}
+}
+
+// printOutcome prints the outcome of every message received by an operation, where action describes completed messages, e.g. 'deleted'.
+func printOutcome(action string, p sbc.Progress) {
+	fmt.Printf("\n%d message(s) %s\n", p.Completed, action)
+	if p.Abandoned > 0 {
+		fmt.Printf("%d message(s) not matched, and abandoned\n", p.Abandoned)
+	}
+	if p.Unreached > 0 {
+		fmt.Printf("%d matching message(s) were behind a redelivered message, and were not reached\n", p.Unreached)
+	}
+	if p.Failed > 0 {
+		fmt.Printf("%d message(s) failed\n", p.Failed)
+	}
+	if p.LockLost > 0 {
+		fmt.Printf("%d message(s) lost their lock before being settled, and remain on the queue\n", p.LockLost)
+	}
+	if p.Retried > 0 {
+		fmt.Printf("%d attempt(s) to settle a message were retried\n", p.Retried)
+	}
+}
+
+// printRetryStats prints the number of calls to Service Bus retried after transient errors, if any.
+func printRetryStats(sb sbc.Controller) {
+	r := sb.RetryStats()
+	if r.Retried == 0 {
+		return
+	}
+	fmt.Printf(STATUS_RETRIED, r.Retried, r.Throttled)
+}
 
-	fmt.Printf("%d message(s) deleted\n", c)
+// verifyOutcome recounts the source queue after an operation that completed messages from it.
+//
+// An outcomeError is returned if any message could not be settled, or the queue count does not match the number of messages completed.
+func verifyOutcome(sb sbc.Controller, before int, p sbc.Progress) error {
+	expected := before - p.Completed
+	// the operation's context may be cancelled, but the recount is still reported
+	after, err := sb.GetSourceQueueCount(context.Background())
+	for attempt := 1; err == nil && after != expected && attempt < recountAttempts; attempt++ {
+		time.Sleep(recountDelay)
+		after, err = sb.GetSourceQueueCount(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("could not recount queue: %v", err)
+	}
+	fmt.Printf("%d message(s) remain on the queue\n", after)
 
+	if p.Unsettled() > 0 {
+		return &outcomeError{fmt.Sprintf(ERR_UNSETTLED, p.Unsettled())}
+	}
+	if after != expected {
+		return &outcomeError{fmt.Sprintf(ERR_COUNTMISMATCH, after, expected)}
+	}
 	return nil
 }
 
-func sendFromFile(sb sbc.Controller, q, dir string) error {
-	err := sb.SetupSourceQueue(q, false, true)
+// printProgress prints progress events from an operation on many messages. Events reporting a matched message are passed to found, if provided.
+//
+// stop closes the progress channel, and returns once every event has been printed.
+func printProgress(found func(m *sbc.Message)) (progress chan sbc.Progress, stop func()) {
+	progress = make(chan sbc.Progress)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range progress {
+			if p.Message != nil {
+				if found != nil {
+					found(p.Message)
+				}
+				continue
+			}
+			fmt.Printf(STATUS_PROGRESS, p.Processed, p.Total, p.Rate())
+		}
+	}()
+	return progress, func() {
+		close(progress)
+		<-done
+	}
+}
+
+// restoreBatchSize is the number of messages sent between each restore checkpoint.
+const restoreBatchSize = 100
+
+// restore replays pull output or delete archive files onto a queue, in file order.
+//
+// Archives are always read as envelopes, and other files in the format provided. Each file is streamed by restoreFile. Progress is checkpointed
+// after every batch, so a failed or interrupted restore run again with the same arguments resumes where it stopped.
+func restore(ctx context.Context, sb sbc.Controller, e sbc.Entity, dir, format string) error {
+	if format != "" && format != FORMAT_TEXT && format != FORMAT_ENVELOPE {
+		return fmt.Errorf("unsupported input format: %s", format)
+	}
+
+	files, err := sbio.ListRestoreFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no pull output or archive files found in %s", dir)
+	}
+
+	checkpointPath := sbio.CheckpointPath(dir, e.FileName())
+	checkpoint, err := sbio.ReadCheckpoint(checkpointPath)
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		fmt.Printf("resuming from %s after %d message(s)\n", checkpoint.File, checkpoint.Sent)
+	}
+
+	err = sb.SetupSource(e, true)
 	if err != nil {
 		return err
 	}
 	defer sb.DisconnectSource()
 
-	data := sbio.ReadFile(dir)
+	sent := 0
+	for i, f := range files {
+		name := filepath.Base(f)
+		start := 0
+		if checkpoint != nil {
+			if name < checkpoint.File {
+				continue
+			}
+			if name == checkpoint.File {
+				start = checkpoint.Sent
+			}
+		}
+
+		// archives always hold envelopes, whichever format pull output was written in
+		fileFormat := format
+		if sbio.IsArchive(f) {
+			fileFormat = FORMAT_ENVELOPE
+		}
+		err := restoreFile(ctx, sb, f, fileFormat, start, func(fileSent, n int) error {
+			sent += n
+			if n > 0 {
+				if err := sbio.WriteCheckpoint(checkpointPath, &sbio.Checkpoint{File: name, Sent: fileSent}); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("\r[status] file %d of %d, %d message(s) restored", i+1, len(files), sent)
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("\n%d message(s) restored, run the same command again to resume\n", sent)
+			if ctx.Err() != nil {
+				return errors.New(ERR_INTERRUPTED)
+			}
+			return fmt.Errorf("restore stopped in %s: %v", name, err)
+		}
+	}
+
+	err = os.Remove(checkpointPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Printf("\n%d message(s) restored from %d file(s)\n", sent, len(files))
+	return nil
+}
+
+// restoreFile streams a file onto the source, after its first start messages, in batches of restoreBatchSize, so the file is never held in memory.
+// Envelopes are sent in sequence number order within each batch.
+//
+// sentBatch is called after each batch, with the number of messages of the file sent so far, in file order, and the number sent by the batch.
+// A batch sent in part counts only the messages up to the first not sent, in file order, so a resumed restore may send the rest again.
+func restoreFile(ctx context.Context, sb sbc.Controller, path, format string, start int, sentBatch func(fileSent, n int) error) error {
+	// reading stops if sending fails
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	lines := make(chan sbio.Line, restoreBatchSize)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- sbio.StreamFile(readCtx, path, 0, lines)
+	}()
+
+	read, fileSent := 0, start
+	batch := make([]sbio.Line, 0, restoreBatchSize)
+	sendBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var n, inOrder int
+		var err error
+		if format == FORMAT_ENVELOPE {
+			envelopes := make([]*sbc.Envelope, len(batch))
+			order := make([]int, len(batch))
+			for j, l := range batch {
+				order[j] = j
+				envelopes[j], err = sbc.ParseEnvelope(l.Data)
+				if err != nil {
+					return fmt.Errorf("invalid envelope on line %d: %v", l.Number, err)
+				}
+			}
+			sort.SliceStable(order, func(a, b int) bool { return envelopes[order[a]].SequenceNumber < envelopes[order[b]].SequenceNumber })
+			sorted := make([]*sbc.Envelope, len(order))
+			for j, k := range order {
+				sorted[j] = envelopes[k]
+			}
+			n, err = sb.SendManyEnvelopes(ctx, false, sorted)
+			inOrder = sentPrefix(order, n)
+		} else {
+			data := make([][]byte, len(batch))
+			for j, l := range batch {
+				data[j] = l.Data
+			}
+			n, err = sb.SendManyJsonMessages(ctx, false, data)
+			inOrder = n
+		}
+		fileSent += inOrder
+		batch = batch[:0]
+		if cbErr := sentBatch(fileSent, n); cbErr != nil {
+			return cbErr
+		}
+		return err
+	}
+
+	for line := range lines {
+		read++
+		if read <= start {
+			continue
+		}
+		batch = append(batch, line)
+		if len(batch) == restoreBatchSize {
+			if err := sendBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	// lines read before a read error are sent, so a resumed restore continues from the line reported
+	if err := sendBatch(); err != nil {
+		return err
+	}
+	return <-readErr
+}
+
+// sentPrefix returns the number of a batch's messages, in file order, sent before the first not sent, when the first n of order were sent.
+// order holds the file position of each message, in the order they were sent.
+func sentPrefix(order []int, n int) int {
+	sent := make([]bool, len(order))
+	for _, k := range order[:n] {
+		sent[k] = true
+	}
+	prefix := 0
+	for prefix < len(sent) && sent[prefix] {
+		prefix++
+	}
+	return prefix
+}
+
+// sendBatchSize is the number of messages sent between each send journal update.
+const sendBatchSize = 100
+
+// envelopeOverhead allows for the properties of an envelope, alongside its body, when limiting the length of an envelope line.
+const envelopeOverhead = 64 * 1024
+
+// sendFromFile streams each line of a file to a queue, as a JSON body or an envelope. Lines are read as they are sent, so the file is never held in memory.
+//
+// A line longer than maxSize, the maximum message size, stops the send with the line number. Envelope lines may be larger, to allow for a base64 body and properties,
+// and their bodies are checked when sent. Empty lines are skipped.
+//
+// Progress is written to a journal after every batch, at journalPath or alongside the file. A failed or interrupted send, run again with resume,
+// continues after the lines already sent. Without resume, an existing journal stops the send, so messages are not sent twice.
+//
+// Providing dedupe stamps each JSON body with a MessageID derived from the file and line, and each envelope without a MessageID, so a queue with
+// duplicate detection drops messages sent again.
+func sendFromFile(ctx context.Context, sb sbc.Controller, e sbc.Entity, dir, format, journalPath string, resume, dedupe bool, maxSize int) error {
+	if format != "" && format != FORMAT_TEXT && format != FORMAT_ENVELOPE {
+		return fmt.Errorf("unsupported input format: %s", format)
+	}
+
+	if journalPath == "" {
+		journalPath = sbio.JournalPath(dir, e.FileName())
+	}
+	journal, err := sbio.NewJournal(dir, e.String())
+	if err != nil {
+		return err
+	}
+	previous, err := sbio.ReadJournal(journalPath)
+	if err != nil {
+		return err
+	}
+	start := 0
+	if previous != nil && previous.Sent > 0 {
+		if !resume {
+			return fmt.Errorf(ERR_JOURNALEXISTS, journalPath, previous.Sent)
+		}
+		if !previous.Matches(journal) {
+			return fmt.Errorf(ERR_JOURNALMISMATCH, journalPath)
+		}
+		start = previous.Sent
+		fmt.Printf("resuming after line %d\n", start)
+	} else if resume {
+		fmt.Println("no send journal found, sending from the beginning")
+	}
 
-	err = sb.SendManyJsonMessages(false, data)
+	err = sb.SetupSource(e, true)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Sent %d messages\n", len(data))
+	defer sb.DisconnectSource()
+
+	lineLimit := maxSize
+	if format == FORMAT_ENVELOPE {
+		lineLimit = maxSize/3*4 + envelopeOverhead
+	}
+
+	// reading stops if sending fails
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	lines := make(chan sbio.Line, sendBatchSize)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- sbio.StreamFile(readCtx, dir, lineLimit, lines)
+	}()
+
+	read, sent := 0, 0
+	batch := make([]sbio.Line, 0, sendBatchSize)
+	sendBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := sendLines(ctx, sb, dir, format, dedupe, batch)
+		sent += n
+		if n > 0 {
+			journal.Sent = batch[n-1].Number
+			if jErr := sbio.WriteJournal(journalPath, journal); jErr != nil {
+				return jErr
+			}
+		}
+		if err != nil {
+			fmt.Printf("Sent %d messages. Run the same command with -resume to continue\n", sent)
+			if ctx.Err() != nil {
+				return errors.New(ERR_INTERRUPTED)
+			}
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := range lines {
+		read++
+		if line.Number <= start {
+			continue
+		}
+		batch = append(batch, line)
+		if len(batch) == sendBatchSize {
+			if err := sendBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	// lines read before a read error are sent, so a resumed send continues from the line reported
+	if err := sendBatch(); err != nil {
+		return err
+	}
+	if err := <-readErr; err != nil {
+		if ctx.Err() != nil {
+			fmt.Printf("Sent %d messages. Run the same command with -resume to continue\n", sent)
+			return errors.New(ERR_INTERRUPTED)
+		}
+		return err
+	}
+	if read == 0 {
+		return sbc.ErrNoMessagesToSend
+	}
+
+	err = os.Remove(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Printf("Sent %d messages\n", sent)
 	return nil
 }
 
-func tidy(sb sbc.Controller, q, pattern string, dlq, execute bool) error {
-	err := sb.SetupSourceQueue(q, dlq, true)
+// sendLines sends a batch of lines, returning the number sent. An error sending a line is returned as a LineError.
+func sendLines(ctx context.Context, sb sbc.Controller, file, format string, dedupe bool, lines []sbio.Line) (int, error) {
+	var n int
+	var err error
+	if format == FORMAT_ENVELOPE || dedupe {
+		envelopes := make([]*sbc.Envelope, len(lines))
+		for i, l := range lines {
+			if format == FORMAT_ENVELOPE {
+				envelopes[i], err = sbc.ParseEnvelope(l.Data)
+				if err != nil {
+					return 0, fmt.Errorf("invalid envelope on line %d: %v", l.Number, err)
+				}
+			} else {
+				envelopes[i] = sbc.NewJsonEnvelope("", l.Data)
+			}
+			if dedupe && envelopes[i].MessageID == "" {
+				envelopes[i].MessageID = sbio.LineMessageID(file, l.Number, l.Data)
+			}
+		}
+		n, err = sb.SendManyEnvelopes(ctx, false, envelopes)
+	} else {
+		data := make([][]byte, len(lines))
+		for i, l := range lines {
+			data[i] = l.Data
+		}
+		n, err = sb.SendManyJsonMessages(ctx, false, data)
+	}
+	if err != nil && ctx.Err() == nil {
+		return n, &sbio.LineError{Line: lines[n].Number, Err: err}
+	}
+	return n, err
+}
+
+// tidy identifies, or with execute, deletes messages matching a pattern, archiving them first to the output directory, or its subDir.
+func tidy(ctx context.Context, sb sbc.Controller, e sbc.Entity, pattern string, execute bool, subDir string) error {
+	err := sb.SetupSource(e, true)
 
 	if err != nil {
 		return err
 	}
 	defer sb.DisconnectSource()
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(ctx)
 
+	if ctx.Err() != nil {
+		return errors.New(ERR_INTERRUPTED)
+	}
 	if err != nil {
 		return err
 	}
@@ -255,26 +957,449 @@ func tidy(sb sbc.Controller, q, pattern string, dlq, execute bool) error {
 		return err
 	}
 
-	if !execute {
+	var archive sbc.Archiver
+	if execute {
+		a, err := sbio.NewFileArchiverIn(subDir, e.FileName())
+		if err != nil {
+			return fmt.Errorf("could not create archive, no messages deleted: %v", err)
+		}
+		defer a.Close()
+		fmt.Printf("archiving deleted messages to %s\n", a.Name())
+		archive = a
+	} else {
 		fmt.Println("Tidy executing as a dry run. Pass '-x' to action")
 	}
 
-	eChan := make(chan error)
-	go sb.TidyMessages(eChan, rex, execute, c)
+	progress, stop := printProgress(func(m *sbc.Message) {
+		fmt.Printf(STATUS_FOUND, rex.Find(m.Data))
+	})
+	p, err := sb.TidyMessages(ctx, progress, rex, execute, c, archive)
+	stop()
 
-	done := false
-	for !done {
-		e := <-eChan
-		if strings.Contains(e.Error(), "[status]") {
-			fmt.Printf("%s\n", e.Error())
+	if execute {
+		printOutcome("matched and deleted", p)
+	} else {
+		fmt.Printf("%d matching message(s) identified\n", p.Matched)
+	}
+	if ctx.Err() != nil {
+		return errors.New(ERR_INTERRUPTED)
+	}
+	if err != nil {
+		return err
+	}
+	if execute {
+		return verifyOutcome(sb, c, p)
+	}
+	return nil
+}
+
+// sessionState gets, sets or clears the state of a session, e.g. to debug a session stuck on an unexpected state.
+func sessionState(ctx context.Context, sb sbc.Controller, e sbc.Entity, args []string) error {
+	if e.Session == "" {
+		return fmt.Errorf("-session is required for the session command")
+	}
+	usage := "usage: sb-shovel -cmd session -session SESSION_ID get | set STATE | clear"
+	if len(args) == 0 {
+		return fmt.Errorf("no session command provided\n%s", usage)
+	}
+
+	err := sb.SetupSource(e, false)
+	if err != nil {
+		return err
+	}
+	defer sb.DisconnectSource()
+
+	switch args[0] {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("unexpected arguments for get command\n%s", usage)
+		}
+		state, err := sb.GetSessionState(ctx, e.Session)
+		if err != nil {
+			return err
+		}
+		if len(state) == 0 {
+			fmt.Printf("session %s has no state\n", e.Session)
+			return nil
+		}
+		fmt.Println(string(state))
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("unexpected arguments for set command\n%s", usage)
+		}
+		if err := sb.SetSessionState(ctx, e.Session, []byte(args[1])); err != nil {
+			return err
+		}
+		fmt.Printf("session %s state updated\n", e.Session)
+	case "clear":
+		if len(args) != 1 {
+			return fmt.Errorf("unexpected arguments for clear command\n%s", usage)
+		}
+		if err := sb.SetSessionState(ctx, e.Session, nil); err != nil {
+			return err
+		}
+		fmt.Printf("session %s state cleared\n", e.Session)
+	default:
+		return fmt.Errorf("unexpected session command provided\n%s", usage)
+	}
+	return nil
+}
+
+// inspect prints the message counts, size and settings of a queue, topic or subscription, as a table, or as JSON with -format json.
+func inspect(ctx context.Context, sb sbc.Controller, e sbc.Entity, format string) error {
+	if format != "" && format != FORMAT_TABLE && format != FORMAT_JSON {
+		return fmt.Errorf("unexpected format '%s', expected '%s' or '%s'", format, FORMAT_TABLE, FORMAT_JSON)
+	}
+	err := sb.SetupSource(e, false)
+	if err != nil {
+		return err
+	}
+	defer sb.DisconnectSource()
+
+	d, err := sb.GetSourceDetails(ctx)
+	if err != nil {
+		return err
+	}
+	if format == FORMAT_JSON {
+		b, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	return printDetails(os.Stdout, d)
+}
+
+// printDetails writes entity details as a table of one setting per line. Settings not reported for the entity are written as '-'.
+func printDetails(w io.Writer, d sbc.EntityDetails) error {
+	optional := func(v string, set bool) string {
+		if !set {
+			return "-"
+		}
+		return v
+	}
+	size := formatBytes(d.SizeInBytes)
+	if d.MaxSizeInBytes > 0 {
+		size = fmt.Sprintf("%s of %s (%.1f%%)", formatBytes(d.SizeInBytes), formatBytes(d.MaxSizeInBytes), float64(d.SizeInBytes)/float64(d.MaxSizeInBytes)*100)
+	}
+	lastAccessed := "-"
+	if d.LastAccessed != nil {
+		lastAccessed = d.LastAccessed.UTC().Format(time.RFC3339)
+	}
+	rows := [][2]string{
+		{"entity", d.Entity},
+		{"status", optional(d.Status, d.Status != "")},
+		{"active messages", strconv.FormatInt(d.ActiveMessages, 10)},
+		{"dead-letter messages", strconv.FormatInt(d.DeadLetterMessages, 10)},
+		{"scheduled messages", strconv.FormatInt(d.ScheduledMessages, 10)},
+		{"transfer messages", strconv.FormatInt(d.TransferMessages, 10)},
+		{"transfer dead-letter messages", strconv.FormatInt(d.TransferDeadLetterMessages, 10)},
+		{"size", size},
+		{"lock duration", optional(d.LockDuration.String(), d.LockDuration > 0)},
+		{"max delivery count", optional(strconv.Itoa(int(d.MaxDeliveryCount)), d.MaxDeliveryCount > 0)},
+		{"default message ttl", optional(d.DefaultMessageTTL.String(), d.DefaultMessageTTL > 0)},
+		{"duplicate detection window", optional(d.DuplicateDetectionWindow.String(), d.DuplicateDetectionWindow > 0)},
+		{"requires session", strconv.FormatBool(d.RequiresSession)},
+		{"forward to", optional(d.ForwardTo, d.ForwardTo != "")},
+		{"forward dead-lettered messages to", optional(d.ForwardDeadLetteredMessagesTo, d.ForwardDeadLetteredMessagesTo != "")},
+		{"last accessed", lastAccessed},
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\n", r[0], r[1])
+	}
+	return tw.Flush()
+}
+
+// formatBytes returns a size in bytes, KB, MB or GB, as powers of 1024.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1024*1024*1024))
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1fKB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// list prints every queue, topic and subscription in the namespace matching a glob pattern, with its active and dead-letter message counts,
+// as a table, or as JSON or CSV. Entities are sorted by name, or with -sort dlq, the most dead-lettered first.
+func list(ctx context.Context, sb sbc.Controller, pattern, sortBy, format string) error {
+	if format != "" && format != FORMAT_TABLE && format != FORMAT_JSON && format != FORMAT_CSV {
+		return fmt.Errorf("unexpected format '%s', expected '%s', '%s' or '%s'", format, FORMAT_TABLE, FORMAT_JSON, FORMAT_CSV)
+	}
+	if sortBy != "" && sortBy != SORT_NAME && sortBy != SORT_DLQ {
+		return fmt.Errorf("unexpected sort '%s', expected '%s' or '%s'", sortBy, SORT_NAME, SORT_DLQ)
+	}
+
+	entities, err := sb.ListEntities(ctx, pattern)
+	if err != nil {
+		return err
+	}
+	if sortBy == SORT_DLQ {
+		sort.SliceStable(entities, func(i, j int) bool {
+			return entities[i].DeadLetterMessages > entities[j].DeadLetterMessages
+		})
+	}
+
+	switch format {
+	case FORMAT_JSON:
+		b, err := json.MarshalIndent(entities, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	case FORMAT_CSV:
+		return writeEntitiesCSV(os.Stdout, entities)
+	}
+	if len(entities) == 0 {
+		fmt.Println("no entities found")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTITY\tACTIVE\tDEAD-LETTER\tSTATUS")
+	for _, d := range entities {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", d.Entity, d.ActiveMessages, d.DeadLetterMessages, d.Status)
+	}
+	return tw.Flush()
+}
+
+// writeEntitiesCSV writes the active and dead-letter message counts of each entity as CSV, with a header row.
+func writeEntitiesCSV(w io.Writer, entities []sbc.EntityDetails) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"entity", "active", "deadLetter", "status"})
+	for _, d := range entities {
+		cw.Write([]string{d.Entity, strconv.FormatInt(d.ActiveMessages, 10), strconv.FormatInt(d.DeadLetterMessages, 10), d.Status})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// isManyQueues reports whether -q names many queues, as a comma separated list, or a glob, e.g. 'orders-*'.
+func isManyQueues(q string) bool {
+	return strings.Contains(q, ",") || isGlob(q)
+}
+
+// expandQueues returns the details of each queue named by a comma separated list of queue names and globs, in the order named.
+// A glob matching no queues is ignored, but a name not matching a queue returns an error.
+//
+// Each name is described alone, as for a single queue. The namespace is listed, which requires the Manage right, only once and only if a glob is named.
+func expandQueues(ctx context.Context, sb sbc.Controller, q string) ([]sbc.EntityDetails, error) {
+	queues := []sbc.EntityDetails{}
+	seen := make(map[string]bool)
+	var listed []sbc.EntityDetails
+	for _, name := range strings.Split(q, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
 			continue
 		}
-		if e.Error() != "context canceled" && e.Error() != sbc.ERR_QUEUEEMPTY {
-			return e
+		if !isGlob(name) {
+			d, err := describeQueue(ctx, sb, name)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[d.Entity] {
+				seen[d.Entity] = true
+				queues = append(queues, d)
+			}
+			continue
+		}
+		if listed == nil {
+			var err error
+			if listed, err = sb.ListEntities(ctx, ""); err != nil {
+				return nil, err
+			}
+		}
+		for _, d := range listed {
+			if d.Type != sbc.TypeQueue {
+				continue
+			}
+			if ok, err := path.Match(name, d.Entity); err != nil {
+				return nil, fmt.Errorf("invalid entity pattern '%s': %w", name, err)
+			} else if ok && !seen[d.Entity] {
+				seen[d.Entity] = true
+				queues = append(queues, d)
+			}
 		}
-		done = true
 	}
-	close(eChan)
+	if len(queues) == 0 {
+		return nil, fmt.Errorf(ERR_NOQUEUESMATCH, q)
+	}
+	return queues, nil
+}
+
+// isGlob reports whether a queue name is a glob, e.g. 'orders-*'.
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
 
+// describeQueue returns the details of a single queue by name, connecting to it as the source queue.
+func describeQueue(ctx context.Context, sb sbc.Controller, name string) (sbc.EntityDetails, error) {
+	var d sbc.EntityDetails
+	err := sb.SetupSourceQueue(name, false, false)
+	if err == nil {
+		d, err = sb.GetSourceDetails(ctx)
+	}
+	if errors.Is(err, sbc.ErrNotFound) {
+		return d, fmt.Errorf("queue '%s' not found", name)
+	}
+	return d, err
+}
+
+// forEachQueue runs a command against the queue named by -q, or each of many queues named by a glob or list, as in isManyQueues.
+//
+// With many queues, each queue's output is written to a subdirectory of the output directory, named after the queue, and queues without messages are skipped.
+// A failing queue does not stop the command running against the remaining queues. A summary row is printed for each queue, and an error returned if any queue failed.
+func forEachQueue(ctx context.Context, sb sbc.Controller, e sbc.Entity, run func(e sbc.Entity, subDir string) error) error {
+	if !isManyQueues(e.Queue) {
+		return run(e, "")
+	}
+	queues, err := expandQueues(ctx, sb, e.Queue)
+	if err != nil {
+		return err
+	}
+	type queueRun struct {
+		e      sbc.Entity
+		count  int64
+		result string
+	}
+	runs := make([]queueRun, len(queues))
+	names := make([]string, len(queues))
+	for i, d := range queues {
+		runs[i] = queueRun{e: e, count: d.ActiveMessages}
+		runs[i].e.Queue = d.Entity
+		if e.DeadLetter {
+			runs[i].count = d.DeadLetterMessages
+		}
+		names[i] = d.Entity
+	}
+	fmt.Printf("%d queue(s) match '%s': %s\n", len(queues), e.Queue, strings.Join(names, ", "))
+
+	failed, outcome := 0, false
+	for i := range runs {
+		r := &runs[i]
+		switch {
+		case ctx.Err() != nil:
+			r.result = "skipped, interrupted"
+			continue
+		case r.count == 0:
+			r.result = "skipped, no messages"
+			continue
+		}
+		fmt.Printf("\n[%s]\n", r.e)
+		if err := run(r.e, r.e.FileName()); err != nil {
+			fmt.Println(err)
+			r.result = fmt.Sprintf("failed: %v", err)
+			failed++
+			var oe *outcomeError
+			outcome = outcome || errors.As(err, &oe)
+			continue
+		}
+		r.result = "ok"
+	}
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUEUE\tMESSAGES\tOUTPUT\tRESULT")
+	for _, r := range runs {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", r.e, r.count, sbio.OutputDir(r.e.FileName()), r.result)
+	}
+	tw.Flush()
+
+	if ctx.Err() != nil {
+		return errors.New(ERR_INTERRUPTED)
+	}
+	if failed > 0 {
+		msg := fmt.Sprintf(ERR_QUEUESFAILED, failed, len(queues))
+		if outcome {
+			return &outcomeError{msg}
+		}
+		return errors.New(msg)
+	}
 	return nil
 }
+
+// newSandbox returns an in-memory namespace for the -sandbox flag, holding the queues, topic and subscription named by e and the requeue target.
+// Queues and subscriptions are seeded with sample messages, half of them dead-lettered, so that every command can be practised without a namespace.
+// Globs in a list of queues name no queue, so only the listed queue names are created.
+func newSandbox(e sbc.Entity, targetConn string, target sbc.Entity) (*sbc.Broker, error) {
+	b := sbc.NewBroker()
+	sources := []sbc.Entity{}
+	switch {
+	case e.Subscription != "":
+		b.CreateSubscription(e.Topic, e.Subscription)
+		sources = append(sources, sbc.Entity{Topic: e.Topic, Subscription: e.Subscription})
+	case e.Topic != "":
+		b.CreateTopic(e.Topic)
+	}
+	for _, name := range strings.Split(e.Queue, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, "*?[") {
+			continue
+		}
+		if e.Session != "" {
+			b.CreateSessionQueue(name)
+		} else {
+			b.CreateQueue(name)
+		}
+		sources = append(sources, sbc.QueueEntity(name, false))
+	}
+
+	targets := b
+	if targetConn != "" {
+		targets = b.Namespace(targetConn)
+	}
+	if target.Queue != "" {
+		targets.CreateQueue(target.Queue)
+	}
+	if target.Topic != "" {
+		targets.CreateTopic(target.Topic)
+	}
+
+	for _, s := range sources {
+		if err := seedSandbox(b, s, e.Session); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// seedSandbox sends sandboxMessages sample orders to a queue or subscription, and as many again to its dead letter queue, with dead-letter reasons.
+func seedSandbox(b *sbc.Broker, e sbc.Entity, session string) error {
+	active := make([]*servicebus.Message, sandboxMessages)
+	deadLettered := make([]*servicebus.Message, sandboxMessages)
+	for i := range active {
+		order := 1001 + i
+		active[i] = &servicebus.Message{
+			ID:          fmt.Sprintf("order-%d", order),
+			ContentType: "application/json",
+			Data:        []byte(fmt.Sprintf(`{"orderId":%d,"status":"created"}`, order)),
+		}
+		dl := &servicebus.Message{
+			ID:             fmt.Sprintf("order-%d-failed", order),
+			ContentType:    "application/json",
+			Data:           []byte(fmt.Sprintf(`{"orderId":%d,"status":"failed"}`, order)),
+			UserProperties: map[string]interface{}{},
+		}
+		if i%2 == 0 {
+			dl.UserProperties[sbc.PROP_DEADLETTERREASON] = "MaxDeliveryCountExceeded"
+			dl.UserProperties[sbc.PROP_DEADLETTERDESCRIPTION] = "Message could not be consumed after 10 delivery attempts."
+		} else {
+			dl.UserProperties[sbc.PROP_DEADLETTERREASON] = "ValidationFailed"
+			dl.UserProperties[sbc.PROP_DEADLETTERDESCRIPTION] = "orderId has no matching customer"
+		}
+		if session != "" {
+			active[i].SessionID = &session
+			dl.SessionID = &session
+		}
+		deadLettered[i] = dl
+	}
+	if err := b.SendBatch(e.String(), false, active); err != nil {
+		return err
+	}
+	return b.SendBatch(e.String(), true, deadLettered)
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	servicebus "github.com/Azure/azure-service-bus-go"
 	cc "github.com/aagoldingay/sb-shovel/config"
 	sbio "github.com/aagoldingay/sb-shovel/io"
 	sbmock "github.com/aagoldingay/sb-shovel/mocks"
+	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
 func Test_Config_Update_Existing(t *testing.T) {
@@ -64,10 +73,54 @@ func Test_Config_List(t *testing.T) {
 	}
 }
 
+func Test_BuildSettings(t *testing.T) {
+	cfg, err := cc.NewConfigController("sb-shovel")
+	if err != nil {
+		t.Error(err)
+	}
+
+	cfg.UpdateConfig("TEST_SETTINGS.concurrency", "4")
+	cfg.UpdateConfig("TEST_SETTINGS.settle-timeout", "2s")
+	cfg.SaveConfig()
+	defer func() {
+		cfg.DeleteConfigValue("TEST_SETTINGS.concurrency")
+		cfg.DeleteConfigValue("TEST_SETTINGS.settle-timeout")
+		cfg.SaveConfig()
+	}()
+
+	s, err := buildSettings(cfg, "TEST_SETTINGS", map[string]string{"concurrency": "8", "page-size": "10", "batch-size": "50"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := sbc.Settings{Concurrency: 8, PageSize: 10, SettleTimeout: 2 * time.Second, BatchSize: 50}
+	if s != expected {
+		t.Errorf("settings were not as expected: %+v", s)
+	}
+}
+
+func Test_BuildSettings_Rate(t *testing.T) {
+	s, err := buildSettings(nil, "", map[string]string{"rate": "600/m", "burst": "20"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s.Rate != 10 || s.Burst != 20 {
+		t.Errorf("settings were not as expected: %+v", s)
+	}
+}
+
+func Test_BuildSettings_Fail_Invalid(t *testing.T) {
+	_, err := buildSettings(nil, "", map[string]string{"settle-timeout": "soon"})
+	if err == nil || err.Error() != "invalid settle-timeout 'soon'" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func Test_Pull_Fail_EmptyQueue(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
 
-	err := pull(m, "testqueue", false, 5)
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", false), 5, FORMAT_TEXT, `{{.Data | printf "%s"}}`, "")
 	if err == nil {
 		t.Error(err)
 	}
@@ -80,7 +133,7 @@ func Test_Pull_Fail_EmptyQueue(t *testing.T) {
 func Test_Pull_Success_OneFile(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
 
-	err := pull(m, "testqueue", true, 5)
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", true), 5, FORMAT_TEXT, `{{.Data | printf "%s"}}`, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -109,7 +162,7 @@ func Test_Pull_Success_OneFile(t *testing.T) {
 
 func Test_Pull_Success_TwoFiles(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 10}
-	err := pull(m, "testqueue", false, 5)
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", false), 5, FORMAT_TEXT, `{{.Data | printf "%s"}}`, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -142,9 +195,83 @@ func Test_Pull_Success_TwoFiles(t *testing.T) {
 	}
 }
 
+func Test_Pull_Success_Template(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", false), 5, FORMAT_TEXT, `{{.SequenceNumber}} - {{.ID}} - {{.Data | printf "%s"}}`, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c := sbio.ReadFile("sb-shovel-output/sb_output_000001.txt")
+
+	if len(c) != 5 {
+		t.Errorf("Unexpected lines in file: %d", len(c))
+	}
+
+	if len(c) > 0 && string(c[0]) != "1 - id-1 - hello, world" {
+		t.Errorf("Unexpected line format: %s", c[0])
+	}
+
+	// cleanup
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Pull_Fail_InvalidTemplate(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", false), 5, FORMAT_TEXT, `{{.Data`, "")
+	if err == nil {
+		t.Error("Invalid template was accepted")
+	}
+}
+
+func Test_Pull_Success_Envelope(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", true), 5, FORMAT_ENVELOPE, "", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	c := sbio.ReadFile("sb-shovel-output/sb_output_000001.txt")
+
+	if len(c) != 5 {
+		t.Errorf("Unexpected lines in file: %d", len(c))
+	}
+
+	for i := 0; i < len(c); i++ {
+		e := sbc.Envelope{}
+		if err := json.Unmarshal(c[i], &e); err != nil {
+			t.Errorf("Line %d is not a valid envelope: %v", i+1, err)
+			continue
+		}
+		if e.SequenceNumber != int64(i+1) {
+			t.Errorf("Unexpected sequence number on line %d: %d", i+1, e.SequenceNumber)
+		}
+		if string(e.BodyBase64) != "hello, world" {
+			t.Errorf("Unexpected body on line %d: %s", i+1, e.BodyBase64)
+		}
+	}
+
+	// cleanup
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Pull_Fail_InvalidFormat(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+	err := pull(context.Background(), m, sbc.QueueEntity("testqueue", false), 5, "xml", "", "")
+	if err == nil || err.Error() != "unsupported output format: xml" {
+		t.Error(err)
+	}
+}
+
 func Test_Delete_One_Fail_NoMessages(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
-	err := delete(m, "testqueue", false, false, false)
+	err := delete(context.Background(), m, sbc.QueueEntity("testqueue", false), nil, false, "")
 	if err.Error() != "no messages to delete" {
 		t.Error(err)
 	}
@@ -156,7 +283,7 @@ func Test_Delete_One_Fail_NoMessages(t *testing.T) {
 
 func Test_Delete_One_Success(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 1}
-	err := delete(m, "testqueue", false, false, false)
+	err := delete(context.Background(), m, sbc.QueueEntity("testqueue", false), nil, false, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -172,7 +299,7 @@ func Test_Delete_One_Success(t *testing.T) {
 
 func Test_Requeue_One_Success(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 1, TargetQueueCount: 0}
-	err := requeue(m, "testqueue", false, true)
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", true), sbc.Entity{}, "", nil, nil, false, false, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -193,15 +320,181 @@ func Test_Requeue_One_Success(t *testing.T) {
 
 func Test_Requeue_One_Fail_TargetDlq(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 1, TargetQueueCount: 0}
-	err := requeue(m, "testqueue", false, false)
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", false), sbc.Entity{}, "", nil, nil, false, false, false)
 	if err.Error() != "cannot requeue messages directly to a dead letter queue" {
 		t.Error(err)
 	}
 }
 
+func Test_Requeue_One_Success_TargetQueue(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 1, TargetQueueCount: 0}
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", false), sbc.QueueEntity("quarantine", false), "", nil, nil, false, false, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.TargetQueueName != "quarantine" {
+		t.Errorf("Unexpected target queue: %s", m.TargetQueueName)
+	}
+
+	if m.TargetNamespace != "" {
+		t.Errorf("Unexpected target namespace: %s", m.TargetNamespace)
+	}
+}
+
+func Test_Requeue_All_Success_TargetNamespace(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", false), sbc.Entity{}, "Endpoint=sb://other", nil, nil, true, false, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.TargetQueueName != "testqueue" {
+		t.Errorf("Unexpected target queue: %s", m.TargetQueueName)
+	}
+
+	if m.TargetNamespace != "Endpoint=sb://other" {
+		t.Errorf("Unexpected target namespace: %s", m.TargetNamespace)
+	}
+
+	if m.SourceQueueCount != 0 || m.TargetQueueCount != 10 {
+		t.Errorf("A queue had unexpected number of messages - source: %d , target: %d",
+			m.SourceQueueCount, m.TargetQueueCount)
+	}
+}
+
+func Test_Requeue_All_Success_Filter(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
+	f, err := buildFilter("ab+c", "type=order,region=eu", "MaxDelivery", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = requeue(context.Background(), m, sbc.QueueEntity("testqueue", true), sbc.Entity{}, "", f, nil, true, false, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.Filter == nil || m.Filter.Pattern.String() != "ab+c" || m.Filter.DeadLetterReason.String() != "MaxDelivery" {
+		t.Errorf("Unexpected filter: %+v", m.Filter)
+	}
+
+	if len(m.Filter.Properties) != 2 || m.Filter.Properties["type"] != "order" || m.Filter.Properties["region"] != "eu" {
+		t.Errorf("Unexpected property filter: %v", m.Filter.Properties)
+	}
+}
+
+func Test_Requeue_One_Fail_Filter(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
+	f, _ := buildFilter("ab+c", "", "", "", "", "")
+
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", true), sbc.Entity{}, "", f, nil, false, false, false)
+	if err == nil || err.Error() != "filters can only be applied when requeueing with -all" {
+		t.Error(err)
+	}
+}
+
+func Test_Requeue_All_Fail_FilterActiveQueue(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
+	f, _ := buildFilter("ab+c", "", "", "", "", "")
+
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", false), sbc.QueueEntity("target", false), "", f, nil, true, false, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "filters can only be applied when requeueing from a dead letter queue") {
+		t.Error(err)
+	}
+	if m.Filter != nil {
+		t.Errorf("Messages were requeued from an active queue: %+v", m.Filter)
+	}
+}
+
+func Test_Requeue_One_Success_Transform(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 1, TargetQueueCount: 0}
+	tr, err := buildTransform("", `{"version":2}`, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = requeue(context.Background(), m, sbc.QueueEntity("testqueue", true), sbc.Entity{}, "", nil, tr, false, false, false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, ok := m.Transform.(*sbc.MergePatchTransform); !ok {
+		t.Errorf("Unexpected transform: %T", m.Transform)
+	}
+}
+
+func Test_CheckEntity(t *testing.T) {
+	topic := sbc.Entity{Topic: "events"}
+	sub := sbc.Entity{Topic: "events", Subscription: "audit"}
+	if err := checkEntity("send", topic); err != nil {
+		t.Error(err)
+	}
+	if err := checkEntity("pull", sub); err != nil {
+		t.Error(err)
+	}
+	if err := checkEntity("pull", topic); err == nil || err.Error() != "-sub is required to pull messages from a topic" {
+		t.Error(err)
+	}
+	if err := checkEntity("send", sub); err == nil || err.Error() != "Cannot send to a subscription, provide only -topic" {
+		t.Error(err)
+	}
+	if err := checkEntity("restore", sbc.QueueEntity("testqueue", true)); err == nil || err.Error() != "Cannot send to a dead letter queue" {
+		t.Error(err)
+	}
+	if err := checkEntity("delete", sbc.Entity{Queue: "testqueue", Topic: "events"}); err == nil {
+		t.Error("Expected error for a queue and topic")
+	}
+}
+
+func Test_BuildTransform_Types(t *testing.T) {
+	tr, err := buildTransform(`{{.Data | printf "%s"}}`, "", "", "")
+	if _, ok := tr.(*sbc.TemplateTransform); !ok || err != nil {
+		t.Errorf("Unexpected transform: %T, %v", tr, err)
+	}
+
+	tr, err = buildTransform("", "", "ab+c", "abc")
+	if _, ok := tr.(*sbc.RegexTransform); !ok || err != nil {
+		t.Errorf("Unexpected transform: %T, %v", tr, err)
+	}
+
+	tr, err = buildTransform("", "", "", "")
+	if tr != nil || err != nil {
+		t.Errorf("Unexpected transform: %T, %v", tr, err)
+	}
+}
+
+func Test_BuildTransform_Fail_Multiple(t *testing.T) {
+	_, err := buildTransform(`{{.ID}}`, `{"version":2}`, "", "")
+	if err == nil || err.Error() != "only one of -transform-template, -transform-patch or -transform-find can be provided" {
+		t.Error(err)
+	}
+}
+
+func Test_BuildTransform_Fail_InvalidPatch(t *testing.T) {
+	_, err := buildTransform("", `{"version":`, "", "")
+	if err == nil || err.Error() != "merge patch is not valid JSON" {
+		t.Error(err)
+	}
+}
+
+func Test_BuildFilter_Empty(t *testing.T) {
+	f, err := buildFilter("", "", "", "", "", "")
+	if f != nil || err != nil {
+		t.Errorf("Unexpected filter: %+v, %v", f, err)
+	}
+}
+
+func Test_BuildFilter_Fail_InvalidProperty(t *testing.T) {
+	_, err := buildFilter("", "type", "", "", "", "")
+	if err == nil || err.Error() != "invalid property filter 'type', expected key=value" {
+		t.Error(err)
+	}
+}
+
 func Test_Delete_All_Success(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 10}
-	err := delete(m, "testqueue", false, true, false)
+	err := delete(context.Background(), m, sbc.QueueEntity("testqueue", false), nil, true, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -213,11 +506,79 @@ func Test_Delete_All_Success(t *testing.T) {
 	if m.SourceQueueClosed != true {
 		t.Error("Queue not closed")
 	}
+
+	archives, _ := filepath.Glob("sb-shovel-output/sb_archive_testqueue_*.txt")
+	if len(archives) != 1 {
+		t.Fatalf("Unexpected archive files: %v", archives)
+	}
+
+	c := sbio.ReadFile(archives[0])
+	if len(c) != 10 {
+		t.Errorf("Archive had unexpected number of messages: %d", len(c))
+	}
+
+	if _, err := sbc.ParseEnvelope(c[0]); err != nil {
+		t.Errorf("Archive did not contain envelopes: %v", err)
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Delete_All_Success_Age(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10}
+	f, err := buildFilter("", "", "", "", "7d", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = delete(context.Background(), m, sbc.QueueEntity("testqueue", true), f, true, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.Filter == nil || m.Filter.EnqueuedBefore.IsZero() || !m.Filter.EnqueuedAfter.IsZero() {
+		t.Errorf("Unexpected filter: %+v", m.Filter)
+	}
+
+	if d := time.Since(m.Filter.EnqueuedBefore); d < 7*24*time.Hour || d > 7*24*time.Hour+time.Minute {
+		t.Errorf("Unexpected enqueued before: %v", m.Filter.EnqueuedBefore)
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Delete_One_Fail_Age(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 10}
+	f, _ := buildFilter("", "", "", "", "", "72h")
+
+	err := delete(context.Background(), m, sbc.QueueEntity("testqueue", true), f, false, "")
+	if err == nil || err.Error() != "filters can only be applied when deleting with -all" {
+		t.Error(err)
+	}
+}
+
+func Test_ParseAge(t *testing.T) {
+	for s, expected := range map[string]time.Duration{"": 0, "72h": 72 * time.Hour, "7d": 7 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		d, err := parseAge(s)
+		if err != nil || d != expected {
+			t.Errorf("Unexpected age for '%s': %v, %v", s, d, err)
+		}
+	}
+
+	if _, err := parseAge("sevendays"); err == nil {
+		t.Error("invalid age was parsed")
+	}
 }
 
 func Test_Requeue_All_Success(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
-	err := requeue(m, "testqueue", true, true)
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", true), sbc.Entity{}, "", nil, nil, true, false, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -238,7 +599,7 @@ func Test_Requeue_All_Success(t *testing.T) {
 
 func Test_Requeue_All_Fail_TargetDlq(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 10, TargetQueueCount: 0}
-	err := requeue(m, "testqueue", true, false)
+	err := requeue(context.Background(), m, sbc.QueueEntity("testqueue", false), sbc.Entity{}, "", nil, nil, true, false, false)
 	if err.Error() != "cannot requeue messages directly to a dead letter queue" {
 		t.Error(err)
 	}
@@ -246,7 +607,7 @@ func Test_Requeue_All_Fail_TargetDlq(t *testing.T) {
 
 func Test_SendFromFile_Success(t *testing.T) {
 	m := &sbmock.MockServiceBusController{SourceQueueCount: 1}
-	err := sendFromFile(m, "testqueue", "test_files/cmd_send_test.txt")
+	err := sendFromFile(context.Background(), m, sbc.QueueEntity("testqueue", false), "test_files/cmd_send_test.txt", FORMAT_TEXT, "", false, false, sbc.DefaultMaxMessageSize)
 	if err != nil {
 		t.Error(err)
 	}
@@ -260,49 +621,871 @@ func Test_SendFromFile_Success(t *testing.T) {
 	}
 }
 
-func Test_Tidy_Invalid_Regex(t *testing.T) {
-	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+func Test_SendFromFile_Envelope_Success(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err := sendFromFile(context.Background(), m, sbc.QueueEntity("testqueue", false), "test_files/cmd_send_envelope_test.txt", FORMAT_ENVELOPE, "", false, false, sbc.DefaultMaxMessageSize)
+	if err != nil {
+		t.Error(err)
+	}
 
-	err := tidy(m, "testqueue", "(?<", false, false)
-	if err.Error() != "error parsing regexp: invalid or unsupported Perl syntax: `(?<`" {
+	if m.SourceQueueCount != 3 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
+
+	if m.SourceQueueClosed != true {
+		t.Error("Queue not closed")
+	}
+}
+
+func Test_SendFromFile_Envelope_Fail_InvalidLine(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err := sendFromFile(context.Background(), m, sbc.QueueEntity("testqueue", false), "test_files/cmd_send_test.txt", FORMAT_ENVELOPE, "", false, false, sbc.DefaultMaxMessageSize)
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid envelope on line 1") {
 		t.Error(err)
 	}
+
+	if m.SourceQueueCount != 0 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
 }
 
-func Test_Tidy_No_Execute(t *testing.T) {
-	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+func Test_Memory_SendFromFile_Resume(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	helper_writeFile(t, file, "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n{\"n\":4}\n")
 
-	execute := false
-	err := tidy(m, "testqueue", "ab+c", false, execute)
+	// the first batch of two messages uses the burst, then the send is interrupted while waiting for the rate limit
+	if err := sb.Configure(sbc.Settings{Rate: 1, Burst: 2, BatchSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := sendFromFile(ctx, sb, sbc.QueueEntity("testqueue", false), file, FORMAT_TEXT, "", false, false, sbc.DefaultMaxMessageSize)
+	if err == nil || err.Error() != ERR_INTERRUPTED {
+		t.Fatal(err)
+	}
 
+	journalPath := sbio.JournalPath(file, "testqueue")
+	err = sendFromFile(context.Background(), sb, sbc.QueueEntity("testqueue", false), file, FORMAT_TEXT, "", false, false, sbc.DefaultMaxMessageSize)
+	if err == nil || err.Error() != fmt.Sprintf(ERR_JOURNALEXISTS, journalPath, 2) {
+		t.Errorf("Send without -resume was not stopped: %v", err)
+	}
+
+	if err := sb.Configure(sbc.Settings{}); err != nil {
+		t.Fatal(err)
+	}
+	err = sendFromFile(context.Background(), sb, sbc.QueueEntity("testqueue", false), file, FORMAT_TEXT, "", true, false, sbc.DefaultMaxMessageSize)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if m.SourceQueueCount != 5 {
-		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 4 {
+		t.Fatalf("Queue had unexpected number of messages: %d", len(msgs))
 	}
-
-	if m.SourceQueueClosed != true {
-		t.Error("Queue not closed")
+	for i, m := range msgs {
+		if string(m.Data) != fmt.Sprintf("{\"n\":%d}", i+1) {
+			t.Errorf("Unexpected message %d: %s", i, m.Data)
+		}
+	}
+	if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+		t.Errorf("Journal was not removed: %v", err)
 	}
 }
 
-func Test_Tidy_Execute_Success(t *testing.T) {
-	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
-
-	execute := true
-	err := tidy(m, "testqueue", "ab+c", false, execute)
+func Test_Memory_SendFromFile_DedupeIDs(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	helper_writeFile(t, file, "{\"n\":1}\n{\"n\":1}\n")
 
+	err := sendFromFile(context.Background(), sb, sbc.QueueEntity("testqueue", false), file, FORMAT_TEXT, "", false, true, sbc.DefaultMaxMessageSize)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if m.SourceQueueCount != 3 {
-		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 2 {
+		t.Fatalf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.ID != sbio.LineMessageID(file, i+1, []byte(`{"n":1}`)) || m.ContentType != "application/json" {
+			t.Errorf("Unexpected message %d: %+v", i, m)
+		}
 	}
+	if msgs[0].ID == msgs[1].ID {
+		t.Error("Identical lines were given the same MessageID")
+	}
+}
 
-	if m.SourceQueueClosed != true {
-		t.Error("Queue not closed")
+func Test_Memory_SendFromFile_Fail_TooLarge(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	helper_writeFile(t, file, "{\"n\":1}\n{\"n\":\""+strings.Repeat("a", 100)+"\"}\n{\"n\":3}\n")
+
+	err := sendFromFile(context.Background(), sb, sbc.QueueEntity("testqueue", false), file, FORMAT_TEXT, "", false, false, 64)
+
+	var lineErr *sbio.LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 1 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+	if j, _ := sbio.ReadJournal(sbio.JournalPath(file, "testqueue")); j == nil || j.Sent != 1 {
+		t.Errorf("Unexpected journal: %+v", j)
+	}
+}
+
+func Test_Restore_Success_Directory(t *testing.T) {
+	dir := t.TempDir()
+	helper_writeFile(t, filepath.Join(dir, "sb_output_000002.txt"), "{\"n\":3}\n{\"n\":4}\n")
+	helper_writeFile(t, filepath.Join(dir, "sb_output_000001.txt"), "{\"n\":1}\n{\"n\":2}\n")
+	helper_writeFile(t, filepath.Join(dir, "unrelated.txt"), "{\"n\":0}\n")
+
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err := restore(context.Background(), m, sbc.QueueEntity("testqueue", false), dir, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.SourceQueueCount != 4 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
+
+	if _, err := os.Stat(sbio.CheckpointPath(dir, "testqueue")); !os.IsNotExist(err) {
+		t.Error("Checkpoint was not removed")
+	}
+}
+
+func Test_Restore_Success_EnvelopeSequenceOrder(t *testing.T) {
+	dir := t.TempDir()
+	b, err := os.ReadFile("test_files/cmd_send_envelope_test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	helper_writeFile(t, filepath.Join(dir, "sb_archive_testqueue_20220102T030405.000Z.txt"), lines[2]+"\n"+lines[0]+"\n"+lines[1]+"\n")
+
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err = restore(context.Background(), m, sbc.QueueEntity("testqueue", false), dir, FORMAT_ENVELOPE)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(m.Envelopes) != 3 {
+		t.Fatalf("Unexpected number of envelopes: %d", len(m.Envelopes))
+	}
+
+	for i, e := range m.Envelopes {
+		if e.SequenceNumber != int64(i+1) {
+			t.Errorf("Envelope %d restored out of order: %d", i, e.SequenceNumber)
+		}
+	}
+}
+
+func Test_Restore_Success_FormatPerFile(t *testing.T) {
+	dir := t.TempDir()
+	b, err := os.ReadFile("test_files/cmd_send_envelope_test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper_writeFile(t, filepath.Join(dir, "sb_archive_testqueue_20220102T030405.000Z.txt"), string(b))
+	helper_writeFile(t, filepath.Join(dir, "sb_output_000001.txt"), "{\"n\":1}\n{\"n\":2}\n")
+
+	// the archive is restored as envelopes without -format, and pull output as text
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err = restore(context.Background(), m, sbc.QueueEntity("testqueue", false), dir, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(m.Envelopes) != 3 || m.Envelopes[0].MessageID != "id-1" || m.SourceQueueCount != 5 {
+		t.Errorf("Unexpected restore: %d envelopes, %d messages", len(m.Envelopes), m.SourceQueueCount)
+	}
+}
+
+func Test_SentPrefix(t *testing.T) {
+	// file positions 2, 0, 3 and 1 are sent in that order
+	order := []int{2, 0, 3, 1}
+	for n, expected := range []int{0, 0, 1, 1, 4} {
+		if p := sentPrefix(order, n); p != expected {
+			t.Errorf("Unexpected prefix after %d sent: %d", n, p)
+		}
+	}
+}
+
+func Test_Restore_Success_Resume(t *testing.T) {
+	dir := t.TempDir()
+	helper_writeFile(t, filepath.Join(dir, "sb_output_000001.txt"), "{\"n\":1}\n{\"n\":2}\n")
+	helper_writeFile(t, filepath.Join(dir, "sb_output_000002.txt"), "{\"n\":3}\n{\"n\":4}\n{\"n\":5}\n")
+
+	err := sbio.WriteCheckpoint(sbio.CheckpointPath(dir, "testqueue"), &sbio.Checkpoint{File: "sb_output_000002.txt", Sent: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err = restore(context.Background(), m, sbc.QueueEntity("testqueue", false), dir, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.SourceQueueCount != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
+}
+
+func Test_Restore_Fail_NoFiles(t *testing.T) {
+	dir := t.TempDir()
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 0}
+	err := restore(context.Background(), m, sbc.QueueEntity("testqueue", false), dir, "")
+	if err == nil || !strings.HasPrefix(err.Error(), "no pull output or archive files found") {
+		t.Error(err)
+	}
+}
+
+func helper_writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Tidy_Invalid_Regex(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+
+	err := tidy(context.Background(), m, sbc.QueueEntity("testqueue", false), "(?<", false, "")
+	if err.Error() != "error parsing regexp: invalid or unsupported Perl syntax: `(?<`" {
+		t.Error(err)
+	}
+}
+
+func Test_Tidy_No_Execute(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+
+	execute := false
+	err := tidy(context.Background(), m, sbc.QueueEntity("testqueue", false), "ab+c", execute, "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.SourceQueueCount != 5 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
+
+	if archives, _ := filepath.Glob("sb-shovel-output/sb_archive_*.txt"); len(archives) != 0 {
+		t.Errorf("Unexpected archive files: %v", archives)
+	}
+
+	if m.SourceQueueClosed != true {
+		t.Error("Queue not closed")
+	}
+}
+
+func Test_Tidy_Execute_Success(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 5}
+
+	execute := true
+	err := tidy(context.Background(), m, sbc.QueueEntity("testqueue", false), "ab+c", execute, "")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.SourceQueueCount != 3 {
+		t.Errorf("Queue had unexpected number of messages: %d", m.SourceQueueCount)
+	}
+
+	if m.SourceQueueClosed != true {
+		t.Error("Queue not closed")
+	}
+
+	archives, _ := filepath.Glob("sb-shovel-output/sb_archive_testqueue_*.txt")
+	if len(archives) != 1 {
+		t.Fatalf("Unexpected archive files: %v", archives)
+	}
+
+	if c := sbio.ReadFile(archives[0]); len(c) != 2 {
+		t.Errorf("Archive had unexpected number of messages: %d", len(c))
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func helper_newMemoryController(t *testing.T, bodies ...string) (sbc.Controller, *sbc.Broker) {
+	t.Helper()
+	b := sbc.NewBroker()
+	b.CreateQueue("testqueue")
+	sb := sbc.NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range bodies {
+		if err := sb.SendJsonMessage(context.Background(), false, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sb, b
+}
+
+func Test_Memory_Tidy_Execute_AbandonsUnmatched(t *testing.T) {
+	sb, b := helper_newMemoryController(t, `{"v":"abc"}`, `{"v":"xyz"}`, `{"v":"abbc"}`)
+
+	err := tidy(context.Background(), sb, sbc.QueueEntity("testqueue", false), "ab+c", true, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 1 || string(msgs[0].Data) != `{"v":"xyz"}` || msgs[0].DeliveryCount != 1 {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Delete_Restore_RoundTrip(t *testing.T) {
+	sb, b := helper_newMemoryController(t, `{"n":1}`, `{"n":2}`, `{"n":3}`)
+
+	err := delete(context.Background(), sb, sbc.QueueEntity("testqueue", false), nil, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 0 {
+		t.Fatalf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+
+	err = restore(context.Background(), sb, sbc.QueueEntity("testqueue", false), "sb-shovel-output", FORMAT_ENVELOPE)
+	if err != nil {
+		t.Error(err)
+	}
+
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 3 {
+		t.Fatalf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+	for i, m := range msgs {
+		if string(m.Data) != fmt.Sprintf(`{"n":%d}`, i+1) || m.ContentType != "application/json" {
+			t.Errorf("Unexpected restored message %d: %+v", i, m)
+		}
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Delete_Interrupted(t *testing.T) {
+	sb, b := helper_newMemoryController(t, `{"n":1}`, `{"n":2}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := delete(ctx, sb, sbc.QueueEntity("testqueue", false), nil, true, "")
+	if err == nil || err.Error() != ERR_INTERRUPTED {
+		t.Error(err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Requeue_Interrupted(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	b.CreateQueue("target")
+	for i := 0; i < 3; i++ {
+		if err := b.Send("testqueue", true, &servicebus.Message{Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := requeue(ctx, sb, sbc.QueueEntity("testqueue", true), sbc.QueueEntity("target", false), "", nil, nil, true, false, false)
+	if err == nil || err.Error() != ERR_INTERRUPTED {
+		t.Error(err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", true); len(msgs) != 3 {
+		t.Errorf("Dead letter queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_Requeue_Fail_SubscriptionTarget(t *testing.T) {
+	sub := sbc.Entity{Topic: "events", Subscription: "audit"}
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 1}
+	err := requeue(context.Background(), m, sub, sbc.Entity{}, "", nil, nil, false, false, false)
+	if err == nil || err.Error() != "messages cannot be sent to a subscription. Provide -target-q or -target-topic" {
+		t.Error(err)
+	}
+
+	err = requeue(context.Background(), m, sub, sbc.Entity{Topic: "events"}, "", nil, nil, false, false, false)
+	if err == nil || err.Error() != "cannot requeue messages from a subscription to its own topic, as they would be received again" {
+		t.Error(err)
+	}
+
+	sub.DeadLetter = true
+	err = requeue(context.Background(), m, sub, sbc.Entity{Topic: "events"}, "", nil, nil, true, false, false)
+	if err == nil || err.Error() != "cannot requeue a subscription's dead letter queue to its own topic, as messages would be delivered to every subscription. Provide -target-q" {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Requeue_Subscription_Queue(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	b.CreateSubscription("events", "audit")
+	b.CreateSubscription("events", "billing")
+	b.CreateQueue("audit-retry")
+	audit := sbc.Entity{Topic: "events", Subscription: "audit", DeadLetter: true}
+	for i := 0; i < 3; i++ {
+		if err := b.Send("events/subscriptions/audit", true, &servicebus.Message{Data: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := requeue(context.Background(), sb, audit, sbc.Entity{Queue: "audit-retry"}, "", nil, nil, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs, _ := b.Messages("events/subscriptions/audit", true); len(msgs) != 0 {
+		t.Errorf("Dead letter queue had unexpected number of messages: %d", len(msgs))
+	}
+	if msgs, _ := b.Messages("audit-retry", false); len(msgs) != 3 {
+		t.Errorf("Target queue had unexpected number of messages: %d", len(msgs))
+	}
+	// other subscriptions of the topic are not sent the requeued messages
+	if msgs, _ := b.Messages("events/subscriptions/billing", false); len(msgs) != 0 {
+		t.Errorf("Subscription billing had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_Memory_SendFromFile_Topic(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	b.CreateSubscription("events", "audit")
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	helper_writeFile(t, file, "{\"n\":1}\n{\"n\":2}\n")
+
+	err := sendFromFile(context.Background(), sb, sbc.Entity{Topic: "events"}, file, FORMAT_TEXT, "", false, false, sbc.DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs, _ := b.Messages("events/subscriptions/audit", false); len(msgs) != 2 {
+		t.Errorf("Subscription had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_Memory_Delete_Fail_LockLost(t *testing.T) {
+	sb, b := helper_newMemoryController(t, `{"n":1}`, `{"n":2}`)
+	b.LockDuration = time.Nanosecond
+
+	err := delete(context.Background(), sb, sbc.QueueEntity("testqueue", false), nil, true, "")
+	if err == nil || err.Error() != fmt.Sprintf(ERR_UNSETTLED, 2) || exitStatus(err) != EXIT_OUTCOME {
+		t.Error(err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Tidy_Execute_Fail_CountMismatch(t *testing.T) {
+	recountDelay = 0
+	defer func() { recountDelay = time.Second }()
+
+	sb, b := helper_newMemoryController(t, `{"v":"abc"}`, `{"v":"xyz"}`)
+	// the unmatched message is dead-lettered when abandoned, so leaves the queue without being deleted
+	b.MaxDeliveryCount = 1
+
+	err := tidy(context.Background(), sb, sbc.QueueEntity("testqueue", false), "ab+c", true, "")
+	if err == nil || err.Error() != fmt.Sprintf(ERR_COUNTMISMATCH, 0, 1) || exitStatus(err) != EXIT_OUTCOME {
+		t.Error(err)
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_SessionState(t *testing.T) {
+	m := &sbmock.MockServiceBusController{}
+	e := sbc.Entity{Queue: "testqueue", Session: "a"}
+
+	if err := sessionState(context.Background(), m, e, []string{"set", "step-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.SessionStates["a"]) != "step-2" {
+		t.Errorf("Unexpected state: %s", m.SessionStates["a"])
+	}
+	if err := sessionState(context.Background(), m, e, []string{"get"}); err != nil {
+		t.Error(err)
+	}
+	if err := sessionState(context.Background(), m, e, []string{"clear"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.SessionStates["a"]; ok {
+		t.Error("State not cleared")
+	}
+	if !m.SourceQueueClosed {
+		t.Error("Queue not closed")
+	}
+}
+
+func Test_SessionState_Fail_Usage(t *testing.T) {
+	m := &sbmock.MockServiceBusController{}
+	err := sessionState(context.Background(), m, sbc.QueueEntity("testqueue", false), []string{"get"})
+	if err == nil || err.Error() != "-session is required for the session command" {
+		t.Error(err)
+	}
+
+	err = sessionState(context.Background(), m, sbc.Entity{Queue: "testqueue", Session: "a"}, []string{"set"})
+	if err == nil || !strings.HasPrefix(err.Error(), "unexpected arguments for set command") {
+		t.Error(err)
+	}
+}
+
+func Test_Memory_Delete_Session(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	b.CreateSessionQueue("sessions")
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	helper_writeFile(t, file, "{\"n\":1}\n{\"n\":2}\n")
+	for _, session := range []string{"a", "b"} {
+		err := sendFromFile(context.Background(), sb, sbc.Entity{Queue: "sessions", Session: session}, file, FORMAT_TEXT, "", false, false, sbc.DefaultMaxMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := delete(context.Background(), sb, sbc.Entity{Queue: "sessions", Session: "a"}, nil, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, _ := b.Messages("sessions", false)
+	if len(msgs) != 2 || msgs[0].SessionID != "b" || msgs[1].SessionID != "b" {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+
+	err = os.RemoveAll("sb-shovel-output")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Inspect(t *testing.T) {
+	m := &sbmock.MockServiceBusController{SourceQueueCount: 3}
+	for _, format := range []string{"", FORMAT_TABLE, FORMAT_JSON} {
+		if err := inspect(context.Background(), m, sbc.QueueEntity("testqueue", false), format); err != nil {
+			t.Errorf("Unexpected error for format '%s': %v", format, err)
+		}
+	}
+	if !m.SourceQueueClosed {
+		t.Error("Queue not closed")
+	}
+
+	err := inspect(context.Background(), m, sbc.QueueEntity("testqueue", false), FORMAT_ENVELOPE)
+	if err == nil || !strings.HasPrefix(err.Error(), "unexpected format 'envelope'") {
+		t.Error(err)
+	}
+}
+
+func Test_PrintDetails(t *testing.T) {
+	accessed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := sbc.EntityDetails{
+		Entity:             "events/subscriptions/audit",
+		Status:             "Active",
+		ActiveMessages:     12,
+		DeadLetterMessages: 2,
+		SizeInBytes:        256 * 1024 * 1024,
+		MaxSizeInBytes:     1024 * 1024 * 1024,
+		LockDuration:       sbc.Duration(30 * time.Second),
+		MaxDeliveryCount:   10,
+		ForwardTo:          "orders",
+		LastAccessed:       &accessed,
+	}
+	var buf strings.Builder
+	if err := printDetails(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"entity                             events/subscriptions/audit\n",
+		"active messages                    12\n",
+		"dead-letter messages               2\n",
+		"size                               256.0MB of 1.0GB (25.0%)\n",
+		"lock duration                      30s\n",
+		"duplicate detection window         -\n",
+		"forward to                         orders\n",
+		"last accessed                      2024-01-02T03:04:05Z\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Expected '%s' in output:\n%s", strings.TrimSpace(line), out)
+		}
+	}
+}
+
+func Test_Memory_Inspect_Topic(t *testing.T) {
+	sb, b := helper_newMemoryController(t)
+	b.CreateTopic("events")
+	if err := checkEntity("inspect", sbc.Entity{Topic: "events"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspect(context.Background(), sb, sbc.Entity{Topic: "events"}, FORMAT_JSON); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_List(t *testing.T) {
+	m := &sbmock.MockServiceBusController{Entities: []sbc.EntityDetails{
+		{Entity: "orders-eu", ActiveMessages: 4},
+		{Entity: "orders-us", DeadLetterMessages: 7},
+	}}
+	for _, format := range []string{"", FORMAT_TABLE, FORMAT_JSON, FORMAT_CSV} {
+		if err := list(context.Background(), m, "orders-*", SORT_DLQ, format); err != nil {
+			t.Errorf("Unexpected error for format '%s': %v", format, err)
+		}
+	}
+	if m.ListPattern != "orders-*" {
+		t.Errorf("Unexpected pattern: %s", m.ListPattern)
+	}
+	if m.Entities[0].Entity != "orders-us" {
+		t.Errorf("Entities not sorted by dead-letter count: %+v", m.Entities)
+	}
+}
+
+func Test_List_Fail_Usage(t *testing.T) {
+	m := &sbmock.MockServiceBusController{}
+	err := list(context.Background(), m, "", "", FORMAT_ENVELOPE)
+	if err == nil || !strings.HasPrefix(err.Error(), "unexpected format 'envelope'") {
+		t.Error(err)
+	}
+	err = list(context.Background(), m, "", "size", "")
+	if err == nil || !strings.HasPrefix(err.Error(), "unexpected sort 'size'") {
+		t.Error(err)
+	}
+}
+
+func Test_WriteEntitiesCSV(t *testing.T) {
+	var buf strings.Builder
+	err := writeEntitiesCSV(&buf, []sbc.EntityDetails{{Entity: "orders", ActiveMessages: 3, DeadLetterMessages: 1, Status: "Active"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "entity,active,deadLetter,status\norders,3,1,Active\n" {
+		t.Errorf("Unexpected CSV:\n%s", buf.String())
+	}
+}
+
+func Test_Memory_List(t *testing.T) {
+	sb, b := helper_newMemoryController(t, `{"v":"abc"}`)
+	b.CreateSubscription("events", "audit")
+	if err := list(context.Background(), sb, "", SORT_DLQ, ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func helper_newManyQueueBroker(t *testing.T) (sbc.Controller, *sbc.Broker) {
+	t.Helper()
+	sb, b := helper_newMemoryController(t)
+	for _, q := range []string{"orders-eu", "orders-us", "orders-uk", "payments"} {
+		b.CreateQueue(q)
+	}
+	b.CreateTopic("orders-events")
+	for _, q := range []string{"orders-eu", "orders-us", "payments"} {
+		for i := 1; i <= 2; i++ {
+			if err := b.Send(q, true, &servicebus.Message{Data: []byte(fmt.Sprintf(`{"q":"%s","n":%d}`, q, i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return sb, b
+}
+
+func Test_IsManyQueues(t *testing.T) {
+	for q, many := range map[string]bool{"orders": false, "orders-*": true, "orders,payments": true, "orders-?": true, "orders-[eu]*": true} {
+		if isManyQueues(q) != many {
+			t.Errorf("Unexpected result for '%s'", q)
+		}
+	}
+}
+
+func Test_ExpandQueues(t *testing.T) {
+	sb, _ := helper_newManyQueueBroker(t)
+	queues, err := expandQueues(context.Background(), sb, "payments, orders-*,orders-eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, d := range queues {
+		names = append(names, d.Entity)
+	}
+	if fmt.Sprint(names) != "[payments orders-eu orders-uk orders-us]" {
+		t.Errorf("Unexpected queues: %v", names)
+	}
+
+	if _, err := expandQueues(context.Background(), sb, "orders-*,missing"); err == nil || err.Error() != "queue 'missing' not found" {
+		t.Error(err)
+	}
+	if _, err := expandQueues(context.Background(), sb, "invoices-*"); err == nil || err.Error() != fmt.Sprintf(ERR_NOQUEUESMATCH, "invoices-*") {
+		t.Error(err)
+	}
+}
+
+func Test_ExpandQueues_ListsOnce(t *testing.T) {
+	m := &sbmock.MockServiceBusController{Entities: []sbc.EntityDetails{
+		{Entity: "orders-eu", Type: sbc.TypeQueue},
+		{Entity: "payments-eu", Type: sbc.TypeQueue},
+	}}
+	queues, err := expandQueues(context.Background(), m, "orders,payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 2 || m.ListCalls != 0 {
+		t.Errorf("Named queues were listed: %d queue(s), %d listing(s)", len(queues), m.ListCalls)
+	}
+
+	queues, err = expandQueues(context.Background(), m, "orders-*,payments-*,orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 3 || m.ListCalls != 1 {
+		t.Errorf("Namespace was not listed once: %d queue(s), %d listing(s)", len(queues), m.ListCalls)
+	}
+}
+
+func Test_Memory_Delete_ManyQueues(t *testing.T) {
+	sb, b := helper_newManyQueueBroker(t)
+	defer os.RemoveAll("sb-shovel-output")
+
+	err := forEachQueue(context.Background(), sb, sbc.QueueEntity("orders-*", true), func(e sbc.Entity, subDir string) error {
+		return delete(context.Background(), sb, e, nil, true, subDir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for q, expected := range map[string]int{"orders-eu": 0, "orders-us": 0, "payments": 2} {
+		if msgs, _ := b.Messages(q, true); len(msgs) != expected {
+			t.Errorf("Dead letter queue %s had unexpected number of messages: %d", q, len(msgs))
+		}
+	}
+	for _, q := range []string{"orders-eu", "orders-us"} {
+		archives, _ := filepath.Glob(filepath.Join("sb-shovel-output", q, "sb_archive_"+q+"_*.txt"))
+		if len(archives) != 1 {
+			t.Errorf("Unexpected archives for %s: %v", q, archives)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("sb-shovel-output", "orders-uk")); !os.IsNotExist(err) {
+		t.Error("Output directory created for a queue without messages")
+	}
+}
+
+func Test_Memory_Pull_ManyQueues(t *testing.T) {
+	sb, _ := helper_newManyQueueBroker(t)
+	defer os.RemoveAll("sb-shovel-output")
+
+	err := forEachQueue(context.Background(), sb, sbc.QueueEntity("orders-eu,payments", true), func(e sbc.Entity, subDir string) error {
+		return pull(context.Background(), sb, e, 100, "", `{{.Data | printf "%s"}}`, subDir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"orders-eu", "payments"} {
+		c := sbio.ReadFile(filepath.Join("sb-shovel-output", q, "sb_output_000001.txt"))
+		if len(c) != 2 || string(c[0]) != fmt.Sprintf(`{"q":"%s","n":1}`, q) {
+			t.Errorf("Unexpected output for %s: %s", q, c)
+		}
+	}
+}
+
+func Test_Memory_Tidy_ManyQueues_Fail(t *testing.T) {
+	sb, _ := helper_newManyQueueBroker(t)
+	defer os.RemoveAll("sb-shovel-output")
+
+	calls := 0
+	err := forEachQueue(context.Background(), sb, sbc.QueueEntity("orders-*", true), func(e sbc.Entity, subDir string) error {
+		calls++
+		if e.Queue == "orders-eu" {
+			return &outcomeError{"1 message(s) could not be settled"}
+		}
+		return tidy(context.Background(), sb, e, "n", false, subDir)
+	})
+	if err == nil || err.Error() != fmt.Sprintf(ERR_QUEUESFAILED, 1, 3) || exitStatus(err) != EXIT_OUTCOME {
+		t.Error(err)
+	}
+	if calls != 2 {
+		t.Errorf("Unexpected number of queues run: %d", calls)
+	}
+}
+
+func Test_NewSandbox(t *testing.T) {
+	b, err := newSandbox(sbc.Entity{Queue: "orders,orders-*, payments"}, "", sbc.Entity{Queue: "orders-retry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"orders", "payments"} {
+		active, err := b.Messages(q, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadLettered, err := b.Messages(q, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(active) != sandboxMessages || len(deadLettered) != sandboxMessages || deadLettered[0].DeadLetterReason == "" {
+			t.Errorf("Unexpected sample messages on %s: %d active, %d dead-lettered", q, len(active), len(deadLettered))
+		}
+	}
+	if m, err := b.Messages("orders-retry", false); err != nil || len(m) != 0 {
+		t.Errorf("Target queue was not created empty: %v %v", m, err)
+	}
+	if _, err := b.Messages("orders-*", false); err == nil {
+		t.Error("A queue was created for a glob")
+	}
+}
+
+func Test_Memory_Sandbox_Requeue_Subscription(t *testing.T) {
+	e := sbc.Entity{Topic: "events", Subscription: "audit", DeadLetter: true}
+	target := sbc.Entity{Queue: "audit-retry"}
+	b, err := newSandbox(e, "other", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := buildFilter("", "", "MaxDeliveryCountExceeded", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := sbc.NewMemoryController(b)
+	if err = requeue(context.Background(), sb, e, target, "other", filter, nil, true, false, false); err != nil {
+		t.Fatal(err)
+	}
+	requeued, err := b.Namespace("other").Messages("audit-retry", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requeued) != sandboxMessages/2 {
+		t.Errorf("Unexpected requeued messages: %d", len(requeued))
 	}
 }
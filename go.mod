@@ -2,11 +2,13 @@ module github.com/aagoldingay/sb-shovel
 
 go 1.21.0
 
-require github.com/Azure/azure-service-bus-go v0.10.16
+require (
+	github.com/Azure/azure-service-bus-go v0.10.16
+	github.com/Azure/go-amqp v0.13.11
+)
 
 require (
 	github.com/Azure/azure-amqp-common-go/v3 v3.1.0 // indirect
-	github.com/Azure/go-amqp v0.13.11 // indirect
 	github.com/Azure/go-autorest v14.2.0+incompatible // indirect
 	github.com/Azure/go-autorest/autorest v0.11.18 // indirect
 	github.com/Azure/go-autorest/autorest/adal v0.9.13 // indirect
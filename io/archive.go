@@ -0,0 +1,78 @@
+package io
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
+)
+
+const archivePrefix = "sb_archive_"
+
+// FileArchiver writes messages in envelope form to a local archive file before they are deleted.
+//
+// Each message is synced to disk before Archive returns, so that a message is never completed without a retained copy.
+// The archive can be restored to a queue using the send command with '-format envelope'.
+type FileArchiver struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+// IsArchive reports whether a file was written by a FileArchiver, by its name, so that its lines are envelopes.
+func IsArchive(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), archivePrefix)
+}
+
+// NewFileArchiver creates the output directory, if required, and a new archive file named after the queue and the current time.
+func NewFileArchiver(q string) (*FileArchiver, error) {
+	return NewFileArchiverIn("", q)
+}
+
+// NewFileArchiverIn creates an archive file in a subdirectory of the output directory, as named by OutputDir, as NewFileArchiver.
+func NewFileArchiverIn(sub, q string) (*FileArchiver, error) {
+	if err := CreateOutputDir(sub); err != nil {
+		return nil, err
+	}
+
+	fileName := fmt.Sprintf("%s/%s%s_%s.txt", OutputDir(sub), archivePrefix, fileSafeName(q), time.Now().UTC().Format("20060102T150405.000Z"))
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &FileArchiver{file: file}, nil
+}
+
+// Archive appends the message envelope to the archive as a single line, then syncs the file to disk.
+func (a *FileArchiver) Archive(m *sbc.Message) error {
+	b, err := m.Envelope().Marshal()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err = a.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close closes the archive file.
+func (a *FileArchiver) Close() error {
+	return a.file.Close()
+}
+
+// Name returns the path of the archive file.
+func (a *FileArchiver) Name() string {
+	return a.file.Name()
+}
+
+// fileSafeName removes path separators and the dead letter '$' from an entity name, for use in a file name.
+func fileSafeName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "$", "").Replace(name)
+}
@@ -0,0 +1,67 @@
+package io
+
+import (
+	"strings"
+	"testing"
+
+	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
+)
+
+func Test_FileArchiver_Archive_Success(t *testing.T) {
+	a, err := NewFileArchiver("testqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(a.Name(), dirName+"/"+archivePrefix+"testqueue_") {
+		t.Errorf("Unexpected archive name: %s", a.Name())
+	}
+
+	for _, m := range []*sbc.Message{{ID: "id-1", Data: []byte(`{"message":"hello, world"}`)}, {ID: "id-2", Data: []byte("hello, world")}} {
+		if err = a.Archive(m); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err = a.Close(); err != nil {
+		t.Error(err)
+	}
+
+	c := ReadFile(a.Name())
+	if len(c) != 2 {
+		t.Fatalf("Archive had unexpected number of messages: %d", len(c))
+	}
+
+	e, err := sbc.ParseEnvelope(c[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.MessageID != "id-2" || string(e.BodyBase64) != "hello, world" {
+		t.Errorf("Unexpected envelope: %+v", e)
+	}
+
+	if err = helper_deleteDir(t); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_FileArchiver_SubDir(t *testing.T) {
+	a, err := NewFileArchiverIn("orders/$DeadLetterQueue", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if !strings.HasPrefix(a.Name(), dirName+"/orders_DeadLetterQueue/"+archivePrefix+"orders_") {
+		t.Errorf("Unexpected archive name: %s", a.Name())
+	}
+
+	if !IsArchive(a.Name()) || IsArchive(dirName+"/sb_output_000001.txt") {
+		t.Error("Archive was not recognised by name")
+	}
+
+	if err = helper_deleteDir(t); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,9 +3,13 @@ package io
 import (
 	"bufio"
 	"fmt"
+	stdio "io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+
+	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
 const (
@@ -13,6 +17,44 @@ const (
 	prefix  = "sb_output_"
 )
 
+// Renderer formats a single message as one line of an output file. *template.Template satisfies this interface.
+type Renderer interface {
+	Execute(wr stdio.Writer, data interface{}) error
+}
+
+// EnvelopeRenderer writes each message as a single line of JSON, containing every system and user property alongside the body.
+type EnvelopeRenderer struct{}
+
+// Execute writes the envelope of a *sbc.Message to wr.
+func (EnvelopeRenderer) Execute(wr stdio.Writer, data interface{}) error {
+	msg, ok := data.(*sbc.Message)
+	if !ok {
+		return fmt.Errorf("unexpected type for envelope: %T", data)
+	}
+	b, err := msg.Envelope().Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = wr.Write(b)
+	return err
+}
+
+// OutputDir returns the output directory, or a subdirectory of it named after an entity, used when a command runs against many queues.
+func OutputDir(sub string) string {
+	if sub == "" {
+		return dirName
+	}
+	return filepath.Join(dirName, fileSafeName(sub))
+}
+
+// CreateOutputDir creates the output directory, or a subdirectory of it as named by OutputDir, if it does not already exist.
+func CreateOutputDir(sub string) error {
+	if sub == "" {
+		return CreateDir()
+	}
+	return os.MkdirAll(OutputDir(sub), 0777)
+}
+
 func CreateDir() error {
 	_, err := os.Stat(dirName)
 
@@ -30,6 +72,9 @@ func CreateDir() error {
 	return nil
 }
 
+// ReadFile reads every line of a file into memory, without a limit on line length. nil is returned if the file could not be read.
+//
+// Use StreamFile for large files.
 func ReadFile(dir string) [][]byte {
 	f, err := os.Open(dir)
 
@@ -44,24 +89,36 @@ func ReadFile(dir string) [][]byte {
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	buf := make([]byte, 64*5120)
-	scanner.Buffer(buf, 64*5120)
+	r := bufio.NewReaderSize(f, readBufferSize)
 	data := [][]byte{}
 
-	for scanner.Scan() {
-		data = append(data, scanner.Bytes())
+	for n := 1; ; n++ {
+		line, err := readLine(r, 0)
+		if err != nil && err != stdio.EOF {
+			fmt.Printf("ERROR: line %d: %v\n", n, err)
+			return nil
+		}
+		if err == stdio.EOF {
+			if len(line) > 0 {
+				data = append(data, line)
+			}
+			return data
+		}
+		data = append(data, line)
 	}
+}
 
-	return data
+func WriteFile(errChannel chan error, suffix int, data []*sbc.Message, r Renderer, wg *sync.WaitGroup) {
+	WriteFileIn("", errChannel, suffix, data, r, wg)
 }
 
-func WriteFile(errChannel chan error, suffix int, data []string, wg *sync.WaitGroup) {
+// WriteFileIn writes an output file to a subdirectory of the output directory, as named by OutputDir, as WriteFile.
+func WriteFileIn(sub string, errChannel chan error, suffix int, data []*sbc.Message, r Renderer, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	suffixPattern := map[int]string{1: "00000", 2: "0000", 3: "000", 4: "00", 5: "0"}
 
-	fileName := fmt.Sprintf("%s/%s%s%s.txt", dirName, prefix, suffixPattern[len(fmt.Sprint(suffix))], fmt.Sprint(suffix))
+	fileName := fmt.Sprintf("%s/%s%s%s.txt", OutputDir(sub), prefix, suffixPattern[len(fmt.Sprint(suffix))], fmt.Sprint(suffix))
 	file, err := os.Create(fileName)
 
 	if err != nil {
@@ -74,8 +131,13 @@ func WriteFile(errChannel chan error, suffix int, data []string, wg *sync.WaitGr
 
 	writer := bufio.NewWriterSize(file, 64*5120)
 
-	for _, line := range data {
-		_, err := writer.WriteString(line + "\n")
+	for _, msg := range data {
+		err := r.Execute(writer, msg)
+		if err != nil {
+			errChannel <- err
+			return
+		}
+		_, err = writer.WriteString("\n")
 		if err != nil {
 			errChannel <- err
 			return
@@ -5,6 +5,9 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"text/template"
+
+	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
 func Test_ReadFile_Success(t *testing.T) {
@@ -95,11 +98,12 @@ func Test_WriteFile_OneFile_Success(t *testing.T) {
 
 	eChan := make(chan error, 2)
 	var wg sync.WaitGroup
-	s := []string{"test1", "test2", "test3"}
+	s := []*sbc.Message{{Data: []byte("test1")}, {Data: []byte("test2")}, {Data: []byte("test3")}}
+	tmpl := template.Must(template.New("test").Parse(`{{.Data | printf "%s"}}`))
 
 	// test
 	wg.Add(1)
-	go WriteFile(eChan, 1, s, &wg)
+	go WriteFile(eChan, 1, s, tmpl, &wg)
 	wg.Wait()
 
 	if len(eChan) > 0 {
@@ -133,6 +137,54 @@ func Test_WriteFile_OneFile_Success(t *testing.T) {
 	}
 }
 
+func Test_WriteFile_Template_Success(t *testing.T) {
+	// setup
+	if _, err := os.Stat(dirName); os.IsNotExist(err) {
+		err := CreateDir()
+		if err != nil {
+			t.Errorf("Test setup failed: %s", err.Error())
+		}
+	}
+
+	eChan := make(chan error, 2)
+	var wg sync.WaitGroup
+	s := []*sbc.Message{
+		{ID: "a", SequenceNumber: 1, DeadLetterReason: "MaxDeliveryCountExceeded", Data: []byte("test1")},
+		{ID: "b", SequenceNumber: 2, UserProperties: map[string]interface{}{"type": "order"}, Data: []byte("test2")},
+	}
+	tmpl := template.Must(template.New("test").Parse(`{{.SequenceNumber}} {{.ID}} {{.DeadLetterReason}} {{index .UserProperties "type"}} {{.Data | printf "%s"}}`))
+
+	// test
+	wg.Add(1)
+	go WriteFile(eChan, 1, s, tmpl, &wg)
+	wg.Wait()
+
+	if len(eChan) > 0 {
+		t.Errorf("Error while writing file: %s", <-eChan)
+	}
+	close(eChan)
+
+	c := ReadFile(fmt.Sprintf("%s/sb_output_000001.txt", dirName))
+
+	if len(c) != 2 {
+		t.Fatalf("Unexpected number of lines per file: %d", len(c))
+	}
+
+	if string(c[0]) != "1 a MaxDeliveryCountExceeded <no value> test1" {
+		t.Errorf("Unexpected line 1: %s", c[0])
+	}
+
+	if string(c[1]) != "2 b  order test2" {
+		t.Errorf("Unexpected line 2: %s", c[1])
+	}
+
+	// teardown
+	err := helper_deleteDir(t)
+	if err != nil {
+		t.Errorf("Test teardown failed: %s", err.Error())
+	}
+}
+
 func helper_deleteDir(t *testing.T) error {
 	t.Helper()
 	err := os.RemoveAll(dirName)
@@ -141,3 +193,37 @@ func helper_deleteDir(t *testing.T) error {
 	}
 	return nil
 }
+
+func Test_WriteFileIn_SubDir(t *testing.T) {
+	// setup
+	if err := CreateOutputDir("orders-eu"); err != nil {
+		t.Fatalf("Test setup failed: %s", err.Error())
+	}
+	if OutputDir("orders-eu") != dirName+"/orders-eu" || OutputDir("") != dirName {
+		t.Errorf("Unexpected output directory: %s", OutputDir("orders-eu"))
+	}
+
+	eChan := make(chan error, 1)
+	var wg sync.WaitGroup
+	tmpl := template.Must(template.New("test").Parse(`{{.Data | printf "%s"}}`))
+
+	// test
+	wg.Add(1)
+	go WriteFileIn("orders-eu", eChan, 1, []*sbc.Message{{Data: []byte("test1")}}, tmpl, &wg)
+	wg.Wait()
+
+	if len(eChan) > 0 {
+		t.Errorf("Error while writing file: %s", <-eChan)
+	}
+
+	c := ReadFile(fmt.Sprintf("%s/orders-eu/sb_output_000001.txt", dirName))
+	if len(c) != 1 || string(c[0]) != "test1" {
+		t.Errorf("Unexpected file contents: %s", c)
+	}
+
+	// teardown
+	err := helper_deleteDir(t)
+	if err != nil {
+		t.Errorf("Test teardown failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+package io
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const journalPrefix = "sb_send_"
+
+// Journal records the progress of a send, so a failed or interrupted send can resume without resending messages.
+//
+// File is the base name of the input file, and Size its size in bytes when the send started, so a journal is not resumed against a changed file.
+// Sent is the number of the last line sent. Every line up to it has been sent.
+type Journal struct {
+	File  string `json:"file"`
+	Queue string `json:"queue"`
+	Size  int64  `json:"size"`
+	Sent  int    `json:"sent"`
+}
+
+// JournalPath returns the location of the send journal for an input file and queue, alongside the input file.
+func JournalPath(file, q string) string {
+	return filepath.Join(filepath.Dir(file), fmt.Sprintf("%s%s_%s.journal", journalPrefix, fileSafeName(filepath.Base(file)), fileSafeName(q)))
+}
+
+// NewJournal returns an empty journal for sending an input file to a queue.
+func NewJournal(file, q string) (*Journal, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{File: filepath.Base(file), Queue: q, Size: info.Size()}, nil
+}
+
+// Matches reports whether the journal was written for the same input file, unchanged, and queue.
+func (j *Journal) Matches(other *Journal) bool {
+	return j.File == other.File && j.Queue == other.Queue && j.Size == other.Size
+}
+
+// ReadJournal reads a send journal. nil is returned if no journal exists.
+func ReadJournal(path string) (*Journal, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	if err = json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("invalid send journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+// WriteJournal replaces the send journal, as in WriteCheckpoint.
+func WriteJournal(path string, j *Journal) error {
+	return writeJSON(path, j)
+}
+
+// LineMessageID returns a deterministic MessageID for a line of an input file, derived from the file's base name, the line number and its content.
+//
+// Sending the same line again produces the same MessageID, so a queue with duplicate detection enabled drops the repeat.
+func LineMessageID(file string, line int, data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(filepath.Base(file)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(line)))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
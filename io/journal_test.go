@@ -0,0 +1,67 @@
+package io
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Journal_RoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	if err := os.WriteFile(file, []byte("{}\n{}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	path := JournalPath(file, "testqueue")
+
+	j, err := ReadJournal(path)
+	if err != nil || j != nil {
+		t.Fatalf("Unexpected journal: %v, %v", j, err)
+	}
+
+	j, err = NewJournal(file, "testqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Sent = 1
+	if err = WriteJournal(path, j); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *read != *j || !read.Matches(j) {
+		t.Errorf("Unexpected journal: %+v", read)
+	}
+}
+
+func Test_Journal_Matches_Fail_Changed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	if err := os.WriteFile(file, []byte("{}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	j, err := NewJournal(file, "testqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, []byte("{}\n{}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	changed, _ := NewJournal(file, "testqueue")
+	other, _ := NewJournal(file, "otherqueue")
+	if j.Matches(changed) || changed.Matches(other) {
+		t.Error("Journal matched a changed file or different queue")
+	}
+}
+
+func Test_LineMessageID(t *testing.T) {
+	id := LineMessageID("dir/messages.txt", 1, []byte("{}"))
+	if len(id) != 32 || id != LineMessageID("other/messages.txt", 1, []byte("{}")) {
+		t.Errorf("MessageID was not deterministic: %s", id)
+	}
+	if id == LineMessageID("dir/messages.txt", 2, []byte("{}")) || id == LineMessageID("dir/other.txt", 1, []byte("{}")) {
+		t.Error("MessageID was not unique to the file and line")
+	}
+}
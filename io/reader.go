@@ -0,0 +1,109 @@
+package io
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	stdio "io"
+	"os"
+)
+
+// readBufferSize is the size of the buffer used to read lines. Longer lines are read in several parts.
+const readBufferSize = 64 * 1024
+
+// ErrLineTooLong is reported, in a LineError, when a line is longer than the maximum size. Compare using errors.Is.
+var ErrLineTooLong = errors.New("line is longer than the maximum message size")
+
+// Line is a single line of an input file, without its line ending. Number starts at 1.
+type Line struct {
+	Number int
+	Data   []byte
+}
+
+// LineError reports a line of an input file that could not be read or sent. Retrieve using errors.As.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// StreamFile reads a file one line at a time, sending each line to a channel, so files larger than memory can be sent.
+// The channel is closed once the file has been read, or reading stops.
+//
+// A line longer than maxSize bytes stops reading with a LineError wrapping ErrLineTooLong, without reading the rest of the line into memory.
+// A maxSize below 1 does not limit line length. Empty lines are skipped. If the context is cancelled, the context error is returned.
+func StreamFile(ctx context.Context, path string, maxSize int, lines chan<- Line) error {
+	defer close(lines)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, readBufferSize)
+	for n := 1; ; n++ {
+		data, err := readLine(r, maxSize)
+		if errors.Is(err, ErrLineTooLong) {
+			return &LineError{Line: n, Err: fmt.Errorf("%w of %d bytes", err, maxSize)}
+		}
+		if err != nil && err != stdio.EOF {
+			return &LineError{Line: n, Err: err}
+		}
+		if len(data) > 0 {
+			select {
+			case lines <- Line{Number: n, Data: data}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err == stdio.EOF {
+			return nil
+		}
+	}
+}
+
+// readLine reads the next line, without its line ending. io.EOF is returned with the last line of the file.
+//
+// A line longer than maxSize is discarded as it is read, so it is never held in memory.
+func readLine(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		// ReadSlice reuses its buffer, so each part is copied
+		part, err := r.ReadSlice('\n')
+		line = append(line, part...)
+		if err == bufio.ErrBufferFull {
+			// allow for a carriage return, which is not counted
+			if maxSize > 0 && len(line) > maxSize+1 {
+				for err == bufio.ErrBufferFull {
+					_, err = r.ReadSlice('\n')
+				}
+				return nil, ErrLineTooLong
+			}
+			continue
+		}
+		line = trimLineEnding(line)
+		if maxSize > 0 && len(line) > maxSize {
+			return nil, ErrLineTooLong
+		}
+		return line, err
+	}
+}
+
+func trimLineEnding(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == '\r' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+package io
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func helper_streamFile(t *testing.T, content string, maxSize int) ([]Line, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "messages.txt")
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan Line)
+	errc := make(chan error, 1)
+	go func() { errc <- StreamFile(context.Background(), path, maxSize, lines) }()
+
+	read := []Line{}
+	for l := range lines {
+		read = append(read, l)
+	}
+	return read, <-errc
+}
+
+func Test_StreamFile_Lines(t *testing.T) {
+	lines, err := helper_streamFile(t, "one\r\ntwo\n\nfour", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Line{{1, []byte("one")}, {2, []byte("two")}, {4, []byte("four")}}
+	if len(lines) != len(expected) {
+		t.Fatalf("Unexpected lines: %v", lines)
+	}
+	for i := range expected {
+		if lines[i].Number != expected[i].Number || string(lines[i].Data) != string(expected[i].Data) {
+			t.Errorf("Unexpected line %d: %d %s", i, lines[i].Number, lines[i].Data)
+		}
+	}
+}
+
+func Test_StreamFile_LongLine(t *testing.T) {
+	long := strings.Repeat("a", 3*readBufferSize)
+	lines, err := helper_streamFile(t, "one\n"+long+"\nthree\n", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || string(lines[1].Data) != long {
+		t.Errorf("Long line was not read in full: %d lines", len(lines))
+	}
+}
+
+func Test_StreamFile_Fail_TooLong(t *testing.T) {
+	lines, err := helper_streamFile(t, "one\n"+strings.Repeat("a", 2*readBufferSize)+"\nthree\n", readBufferSize)
+
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 || !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(lines) != 1 {
+		t.Errorf("Unexpected lines read before the error: %d", len(lines))
+	}
+}
+
+func Test_StreamFile_MaxSize(t *testing.T) {
+	lines, err := helper_streamFile(t, "abc\r\nabcd\n", 3)
+	if err == nil || len(lines) != 1 {
+		t.Errorf("Unexpected result: %v, %v", lines, err)
+	}
+}
+
+func Test_StreamFile_Cancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the unbuffered channel is never read, so the first line cannot be sent
+	err := StreamFile(ctx, path, 0, make(chan Line))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package io
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const checkpointPrefix = "sb_restore_"
+
+// Checkpoint records the progress of a restore, so an interrupted restore can resume without resending messages.
+//
+// File is the base name of the file being restored, and Sent the number of messages from that file already sent.
+type Checkpoint struct {
+	File string `json:"file"`
+	Sent int    `json:"sent"`
+}
+
+// ListRestoreFiles returns the pull output and delete archive files to restore, in file order.
+//
+// If path is a file, only that file is returned. If path is a directory, files written by pull ('sb_output_') and delete or tidy ('sb_archive_') are returned.
+func ListRestoreFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".txt") {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) || strings.HasPrefix(name, archivePrefix) {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	// file numbers and archive times are zero padded, so lexical order is file order
+	sort.Strings(files)
+	return files, nil
+}
+
+// CheckpointPath returns the location of the restore checkpoint for a queue, alongside the files being restored.
+func CheckpointPath(path, q string) string {
+	dir := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s%s.checkpoint", checkpointPrefix, fileSafeName(q)))
+}
+
+// ReadCheckpoint reads a restore checkpoint. nil is returned if no checkpoint exists.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid restore checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// WriteCheckpoint replaces the restore checkpoint. The checkpoint is written to a temporary file first, so it is never left partially written.
+func WriteCheckpoint(path string, c *Checkpoint) error {
+	return writeJSON(path, c)
+}
+
+// writeJSON replaces a file with the JSON encoding of v, writing to a temporary file first.
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
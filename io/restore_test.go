@@ -0,0 +1,53 @@
+package io
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ListRestoreFiles_Order(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"sb_output_000010.txt", "sb_output_000002.txt", "sb_archive_testqueue_20220102T030405.000Z.txt", "notes.txt", "sb_restore_testqueue.checkpoint"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ListRestoreFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"sb_archive_testqueue_20220102T030405.000Z.txt", "sb_output_000002.txt", "sb_output_000010.txt"}
+	if len(files) != len(expected) {
+		t.Fatalf("Unexpected files: %v", files)
+	}
+	for i := range expected {
+		if filepath.Base(files[i]) != expected[i] {
+			t.Errorf("Unexpected file at %d: %s", i, files[i])
+		}
+	}
+}
+
+func Test_Checkpoint_RoundTrip(t *testing.T) {
+	path := CheckpointPath(t.TempDir(), "testqueue")
+
+	c, err := ReadCheckpoint(path)
+	if err != nil || c != nil {
+		t.Fatalf("Unexpected checkpoint: %v, %v", c, err)
+	}
+
+	if err = WriteCheckpoint(path, &Checkpoint{File: "sb_output_000002.txt", Sent: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = ReadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.File != "sb_output_000002.txt" || c.Sent != 100 {
+		t.Errorf("Unexpected checkpoint: %+v", c)
+	}
+}
@@ -1,68 +1,175 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	cc "github.com/aagoldingay/sb-shovel/config"
 	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
-var dir, command, connectionString, queueName, pattern /*, tmpl*/ string
-var all, isDlq, delay, help, execute bool
-var maxWriteCache int
-var commandList = map[string]bool{"config": true, "delete": true, "pull": true, "requeue": true, "send": true, "tidy": true}
+var dir, command, connectionString, queueName, topicName, subName, sessionID, targetTopic, pattern, properties, reason, description, format, targetConn, targetQueue, tmpl string
+var transformTmpl, transformPatch, transformFind, transformReplace, olderThan, newerThan, settleTimeout, rate, journal string
+var all, audit, isDlq, delay, help, execute, resume, dedupeIDs, sandbox, newIDs bool
+var maxMessageSize, entityPattern, sortBy string
+var maxWriteCache, concurrency, pageSize, prefetch, burst, maxAttempts, batchSize int
+var commandList = map[string]bool{"config": true, "delete": true, "inspect": true, "list": true, "pull": true, "requeue": true, "restore": true, "send": true, "session": true, "tidy": true}
 
 var version = "v0.6.2"
 
+// EXIT_OUTCOME is the exit status when an operation on many messages did not do everything it reported, e.g. the queue recount differs.
+const EXIT_OUTCOME = 3
+
+// exitStatus returns the exit status for an error returned by a command.
+func exitStatus(err error) int {
+	var oe *outcomeError
+	if errors.As(err, &oe) {
+		return EXIT_OUTCOME
+	}
+	return 0
+}
+
 func outputCommands() string {
 	s := ""
 	// config
 	s += "config\n\tpersist Service Bus connection strings to a file in the same location as the executable\n\t"
 	s += "sb-shovel -cmd config update KEY_NAME KEY_VALUE\n\t"
 	s += "sb-shovel -cmd config list\n\t"
-	s += "sb-shovel -cmd config remove KEY_NAME"
+	s += "sb-shovel -cmd config remove KEY_NAME\n\t"
+	s += "tune a connection, used when connecting with '-conn cfg|KEY_NAME': sb-shovel -cmd config update KEY_NAME.concurrency 8\n\t"
+	s += "settings: concurrency, page-size, prefetch, settle-timeout, rate, burst, max-attempts, max-message-size, batch-size. flags of the same name take precedence"
 	s += "\n"
 
 	// delete
-	s += "delete\n\tremove messages from queue\n\t"
-	s += "requires: -conn, -q\n\toptional: -all, -dlq, -delay\n\t"
-	s += "WARNING: providing '-all' will delete all messages\n\t"
-	s += "WARNING: execution without '-delay' may cause issues if you are dealing with extremely large queues"
+	s += "delete\n\tremove messages from a queue or subscription\n\t"
+	s += "requires: -conn, -q or -topic and -sub\n\toptional: -all, -dlq, -session, -rate, -burst, -older-than, -newer-than\n\t"
+	s += "delete only messages by age, with -all: -older-than 7d, -newer-than 72h\n\t"
+	s += "-pattern, -property, -dl-reason and -dl-description are rejected. To delete messages matching a pattern, use tidy\n\t"
+	s += "clear the dead letter queues of many queues, by glob or list: -q 'orders-*' -dlq -all, -q 'orders,payments' -dlq -all\n\t"
+	s += "messages deleted with '-all' are first archived to 'sb-shovel-output/sb_archive_<queue>_<time>.txt', which can be restored with send -format envelope\n\t"
+	s += "after '-all', the queue is recounted. sb-shovel exits with status 3 if a message could not be settled, or the count is not as expected\n\t"
+	s += "WARNING: providing '-all' will delete all messages, unless filtered by age\n\t"
+	s += "WARNING: messages that do not match an age filter are abandoned. An abandoned message is redelivered ahead of later matches, which stops the run\n\t"
+	s += "WARNING: execution without '-rate' may cause issues if you are dealing with extremely large queues"
+	s += "\n"
+
+	// inspect
+	s += "inspect\n\treport the message counts, size and settings of a queue, topic or subscription\n\t"
+	s += "requires: -conn, -q or -topic, optionally with -sub\n\toptional: -format\n\t"
+	s += "counts active, dead-letter, scheduled and transfer messages, with the size against the maximum size, lock duration, max delivery count, ttl, duplicate detection window, forwarding and status\n\t"
+	s += "write the report as JSON, e.g. for monitoring scripts: -format json\n\t"
+	s += "NOTE: the last accessed time is only reported for subscriptions"
+	s += "\n"
+
+	// list
+	s += "list\n\tlist every queue, topic and subscription in a namespace, with its active and dead-letter message counts\n\t"
+	s += "requires: -conn\n\toptional: -name, -sort, -format\n\t"
+	s += "list only matching entities: -name 'orders-*', or a topic's subscriptions: -name 'events/subscriptions/*'\n\t"
+	s += "find the queues with dead letters: -sort dlq\n\t"
+	s += "write the list as JSON or CSV: -format json, -format csv\n\t"
+	s += "any namespace stored by the config command can be listed: -conn \"cfg|PROD\"\n\t"
+	s += "NOTE: listing requires a connection string with the Manage right"
 	s += "\n"
 
 	// pull
-	s += "pull\n\tperform local file pull from queue\n\t"
-	s += "requires: -conn, -q\n\toptional: -dlq, -out-lines\n\t" // , -template
+	s += "pull\n\tperform local file pull from a queue or subscription\n\t"
+	s += "requires: -conn, -q or -topic and -sub\n\toptional: -dlq, -session, -out-lines, -template, -format\n\t"
 	s += "output pattern: 'sb-shovel-output/sb_output_<file_number>'\n\t"
-	// s += "alter file pattern: -template '{{.SystemProperties.SequenceNumber}} - {{.ID}} - {{.Data | printf \"%s\"}}'"
+	s += "alter line format: -template '{{.SequenceNumber}} - {{.ID}} - {{.DeadLetterReason}} - {{.Data | printf \"%s\"}}'\n\t"
+	s += "full message export: -format envelope writes one JSON object per message, with all system and user properties\n\t"
+	s += "pull many queues, by glob or list, into 'sb-shovel-output/<queue>/': -q 'orders-*'\n\t"
 	s += "WARNING: local files with the same naming pattern will be overwritten"
 	s += "\n"
 
 	// requeue
-	s += "requeue\n\treceive then send messages from one queue to another\n\t"
-	s += "requires: -conn, -q\n\toptional: -dlq, -all\n\t"
+	s += "requeue\n\treceive then send messages, with their properties, from one queue to another\n\t"
+	s += "requires: -conn, -q or -topic and -sub\n\toptional: -dlq, -session, -all, -audit, -new-ids, -target-q, -target-topic, -target-conn, -pattern, -property, -dl-reason, -dl-description, -rate, -burst, -batch-size\n\t"
+	s += "stamp the dead-letter reason, requeue time and requeue count onto messages: -audit\n\t"
+	s += "messages keep their MessageID. Give each a new MessageID, keeping the original in the 'sb-shovel-original-message-id' property, e.g. for a target with duplicate detection: -new-ids\n\t"
+	s += "move messages to another queue, or another namespace: -target-q quarantine -target-conn \"cfg|OTHER_ENV\"\n\t"
+	s += "requeue a subscription's dead letter queue to a queue its consumer reads, as publishing to its topic would reach every subscription: -topic events -sub audit -dlq -target-q audit-retry\n\t"
+	s += "requeue only matching messages from a dead letter queue, with -dlq -all: -pattern \"ab+c\" -property \"type=order\" -dl-reason \"MaxDeliveryCountExceeded\" -older-than 72h\n\t"
+	s += "WARNING: each message that does not match a filter is abandoned, incrementing its DeliveryCount. Filters are rejected on active queues, where this dead-letters messages after repeated runs\n\t"
+	s += "fix message bodies before they are sent, using one of:\n\t\t"
+	s += "-transform-template '{{.Data | printf \"%s\"}}'\n\t\t"
+	s += "-transform-patch '{\"version\":2,\"legacyField\":null}'\n\t\t"
+	s += "-transform-find \"/v1/(\\w+)\" -transform-replace \"/v2/$1\"\n\t"
+	s += "avoid flooding consumers of the target queue: -rate 200/s -burst 50\n\t"
+	s += "WARNING: messages that do not match a filter are abandoned. An abandoned message is redelivered ahead of later matches, which stops the run\n\t"
 	s += "WARNING: providing '-all' will delete all messages"
 	s += "\n"
 
+	// restore
+	s += "restore\n\treplay pull output or delete archive files onto a queue, in file and sequence order\n\t"
+	s += "requires: -conn, -q or -topic, -dir\n\toptional: -format, -session, -rate, -burst, -batch-size\n\t"
+	s += "-dir may be a directory, e.g. 'sb-shovel-output', or a single file\n\t"
+	s += "archives are always restored with their original properties. Restore files pulled with -format envelope the same way: -format envelope\n\t"
+	s += "progress is checkpointed to 'sb_restore_<queue>.checkpoint' in the directory. Run the same command again to resume a failed restore\n\t"
+	s += "WARNING: delete the checkpoint file to restore from the beginning"
+	s += "\n"
+
 	// send
-	s += "send\n\tsend JSON messages to a defined queue from a file\n\t"
-	s += "requires: -conn, -q, -dir\n\toptional: -dlq\n\t"
-	s += "WARNING: max read size for a file line is 64*4096 characters\n\t"
+	s += "send\n\tsend JSON messages to a defined queue or topic from a file\n\t"
+	s += "requires: -conn, -q or -topic, -dir\n\toptional: -format, -session, -rate, -burst, -journal, -resume, -dedupe-ids, -max-message-size, -batch-size\n\t"
+	s += "restore messages with their original properties from a pull output file: -format envelope\n\t"
+	s += "progress is written to 'sb_send_<file>_<queue>.journal' alongside the file, or -journal. Run the same command with -resume to continue a failed send\n\t"
+	s += "let duplicate detection drop messages sent twice, by stamping a MessageID derived from the file and line: -dedupe-ids\n\t"
+	s += "lines are read as they are sent. A line larger than the maximum message size stops the send: -max-message-size 1MB for premium namespaces\n\t"
 	s += "WARNING: ensure messages are properly formatted before sending"
 	s += "\n"
 
+	// session
+	s += "session\n\tget, set or clear the state of a session, e.g. to debug a stuck session\n\t"
+	s += "requires: -conn, -q or -topic and -sub, -session\n\t"
+	s += "sb-shovel -cmd session -conn \"cfg|PROD\" -q orders -session SESSION_ID get\n\t"
+	s += "sb-shovel -cmd session -conn \"cfg|PROD\" -q orders -session SESSION_ID set STATE\n\t"
+	s += "sb-shovel -cmd session -conn \"cfg|PROD\" -q orders -session SESSION_ID clear\n\t"
+	s += "session-enabled queues and subscriptions are received from one session at a time by delete, requeue and tidy, or only the session given by -session\n\t"
+	s += "pull with -session writes only that session's messages. send and restore stamp -session onto messages without a SessionID\n\t"
+	s += "WARNING: a message abandoned, e.g. by a filter, is redelivered ahead of the rest of its session, so later messages of the session are left for another run"
+	s += "\n"
+
 	// tidy
 	s += "tidy\n\tselectively delete messages containing a regex pattern\n\t"
-	s += "requires: -conn, -q, -pattern\n\toptional: -x\n\t"
+	s += "requires: -conn, -q or -topic and -sub, -pattern\n\toptional: -x, -session, -rate, -burst\n\t"
 	s += "WARNING: -x (execute) must be provided to delete any matching messages\n\t"
-	s += "WARNING: Using this command abandons messages that are not matched.\n\t"
+	s += "matching messages are first archived to 'sb-shovel-output/sb_archive_<queue>_<time>.txt'\n\t"
+	s += "tidy many queues, by glob or list, archiving to 'sb-shovel-output/<queue>/': -q 'orders-*'\n\t"
+	s += "WARNING: Using this command abandons messages that are not matched. An abandoned message is redelivered ahead of later matches, which stops the run\n\t"
 	s += "NOTE: refer to the approved syntax: https://github.com/google/re2/wiki/Syntax"
 	// s += "\n"
 	return s
 }
 
+// checkEntity returns an error if the entity is not valid, or cannot be used by the command: send and restore send to a queue or topic,
+// inspect reports on any entity, and other commands receive from a queue or subscription.
+func checkEntity(command string, e sbc.Entity) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	switch command {
+	case "inspect":
+	case "restore", "send":
+		if e.DeadLetter {
+			return fmt.Errorf("Cannot send to a dead letter queue")
+		}
+		if !e.CanSend() {
+			return fmt.Errorf("Cannot send to a subscription, provide only -topic")
+		}
+	default:
+		if !e.CanReceive() {
+			return fmt.Errorf("-sub is required to %s messages from a topic", command)
+		}
+	}
+	return nil
+}
+
 func checkIfConfig(s string) (bool, string) {
 	if strings.HasPrefix(s, "cfg|") {
 		return true, strings.Split(s, "|")[1]
@@ -70,27 +177,114 @@ func checkIfConfig(s string) (bool, string) {
 	return false, ""
 }
 
+// resolveConfigValue replaces a 'cfg|KEY' reference with its value from the config file. Any other value is returned unchanged.
+func resolveConfigValue(cfg cc.ConfigManager, s string) (string, error) {
+	isConfig, key := checkIfConfig(s)
+	if !isConfig {
+		return s, nil
+	}
+	err := cfg.LoadConfig()
+	if err != nil && err.Error() != cc.ERR_NOCONFIG {
+		return "", err
+	}
+	v, err := cfg.GetConfigValue(key)
+	if err != nil || v == "" {
+		return "", fmt.Errorf("attribute not found in config.")
+	}
+	return v, nil
+}
+
+// settingOverrides returns the values of the setting flags provided on the command line.
+//
+// The deprecated -delay flag, of a 250ms delay every 50 messages, is equivalent to '-rate 200/s'.
+func settingOverrides() map[string]string {
+	overrides := make(map[string]string)
+	if delay {
+		overrides["rate"] = "200/s"
+	}
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range settingFlags {
+			if f.Name == name {
+				overrides[name] = f.Value.String()
+			}
+		}
+	})
+	return overrides
+}
+
+// interruptContext returns a context cancelled by the first Ctrl+C (or SIGTERM), allowing the running command to settle in-flight messages
+// and print a summary. A second Ctrl+C exits immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigChan:
+			fmt.Println("\ninterrupt received, finishing in-flight messages. Press Ctrl+C again to exit immediately")
+			signal.Stop(sigChan)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigChan)
+		}
+	}()
+	return ctx, cancel
+}
+
 func main() {
 	flag.StringVar(&connectionString, "conn", "", "service bus connection string\ne.g. \"Endpoint=sb://<service_bus>.servicebus.windows.net/;SharedAccessKeyName=<key_name>;SharedAccessKey=<key_value>\"")
-	flag.StringVar(&queueName, "q", "", "service bus queue name")
+	flag.StringVar(&queueName, "q", "", "service bus queue name\npull, delete and tidy commands: a glob, e.g. 'orders-*', or comma separated list of queues, each run in turn with its own output subdirectory")
+	flag.StringVar(&topicName, "topic", "", "service bus topic name, in place of -q\nsend and restore commands publish to the topic. Other commands require -sub")
+	flag.StringVar(&subName, "sub", "", "service bus subscription name, of -topic")
+	flag.StringVar(&sessionID, "session", "", "session id of a session-enabled queue or subscription, received from alone\nsend and restore commands: SessionID of messages sent without one")
 	flag.StringVar(&command, "cmd", "", outputCommands())
-	flag.StringVar(&pattern, "pattern", "", "regex pattern to match against message contents")
-	// flag.StringVar(&tmpl, "template", `{{.Data | printf "%s"}}`, "template syntax: https://pkg.go.dev/text/template\nmessage attributes: see https://pkg.go.dev/github.com/Azure/azure-service-bus-go#Message")
-	flag.StringVar(&dir, "dir", "", "directory of file containing json messages to send")
+	flag.StringVar(&targetConn, "target-conn", "", "requeue command: service bus connection string for the target queue, if in another namespace\naccepts 'cfg|KEY' references")
+	flag.StringVar(&targetQueue, "target-q", "", "requeue command: target queue name, if not the source queue\naccepts 'cfg|KEY' references")
+	flag.StringVar(&targetTopic, "target-topic", "", "requeue command: target topic name, in place of -target-q\naccepts 'cfg|KEY' references")
+	flag.StringVar(&pattern, "pattern", "", "regex pattern to match against message contents\nrequeue command: from a dead letter queue only. A message that does not match is abandoned, incrementing its DeliveryCount, and remains on the queue")
+	flag.StringVar(&properties, "property", "", "requeue command: comma separated key=value pairs, matched against message user properties\nfrom a dead letter queue only. A message that does not match is abandoned, incrementing its DeliveryCount, and remains on the queue")
+	flag.StringVar(&reason, "dl-reason", "", "requeue command: regex pattern to match against the message's dead-letter reason, from a dead letter queue only")
+	flag.StringVar(&description, "dl-description", "", "requeue command: regex pattern to match against the message's dead-letter error description, from a dead letter queue only")
+	flag.StringVar(&olderThan, "older-than", "", "delete and requeue commands: only messages enqueued longer ago than this age e.g. 72h, 7d\nrequeue command: from a dead letter queue only. A message that does not match is abandoned, incrementing its DeliveryCount")
+	flag.StringVar(&newerThan, "newer-than", "", "delete and requeue commands: only messages enqueued more recently than this age e.g. 72h, 7d\nrequeue command: from a dead letter queue only. A message that does not match is abandoned, incrementing its DeliveryCount")
+	flag.StringVar(&transformTmpl, "transform-template", "", "requeue command: replace each message body with the output of a template\nmessage attributes are the same as -template")
+	flag.StringVar(&transformPatch, "transform-patch", "", "requeue command: apply a JSON merge patch (RFC 7386) to each message body")
+	flag.StringVar(&transformFind, "transform-find", "", "requeue command: regex pattern to replace in each message body, with -transform-replace")
+	flag.StringVar(&transformReplace, "transform-replace", "", "requeue command: replacement for -transform-find, supporting expansion e.g. '$1'")
+	flag.StringVar(&tmpl, "template", `{{.Data | printf "%s"}}`, "pull command: format of each output line\ntemplate syntax: https://pkg.go.dev/text/template\nmessage attributes: ID, SessionID, SequenceNumber, EnqueuedTime, DeadLetterReason, UserProperties, Data")
+	flag.StringVar(&format, "format", "", "pull command: output format, either 'text' (default, uses -template) or 'envelope' (JSON Lines)\ninspect command: output format, either 'table' (default) or 'json'\nlist command: output format, either 'table' (default), 'json' or 'csv'\nsend and restore commands: input format, either 'text' (default, one message body per line) or 'envelope'")
+	flag.StringVar(&entityPattern, "name", "", "list command: glob of entity paths to list, e.g. 'orders-*' or 'events/subscriptions/*'")
+	flag.StringVar(&sortBy, "sort", "", "list command: order of entities, either 'name' (default) or 'dlq', the most dead-lettered first")
+	flag.StringVar(&dir, "dir", "", "directory of file containing json messages to send\nrestore command: directory of pull output or archive files, or a single file")
 	flag.BoolVar(&all, "all", false, "perform the operation on an entire entity")
-	flag.BoolVar(&isDlq, "dlq", false, "point to the defined queue's deadletter subqueue")
+	flag.BoolVar(&audit, "audit", false, "requeue command: stamp audit properties onto requeued messages")
+	flag.BoolVar(&newIDs, "new-ids", false, "requeue command: give each requeued message a new MessageID, keeping the original in the 'sb-shovel-original-message-id' user property")
+	flag.BoolVar(&isDlq, "dlq", false, "point to the defined queue or subscription's deadletter subqueue")
 	flag.BoolVar(&execute, "x", false, "tidy command: perform delete operation")
-	flag.BoolVar(&delay, "delay", false, "include a 250ms delay for every 50 messages sent")
+	flag.StringVar(&maxMessageSize, "max-message-size", "", fmt.Sprintf("largest message body sent, e.g. 256KB or up to 100MB on premium namespaces (default %dKB)", sbc.DefaultMaxMessageSize/1024))
+	flag.BoolVar(&resume, "resume", false, "send command: continue a failed send after the messages recorded in its journal")
+	flag.BoolVar(&dedupeIDs, "dedupe-ids", false, "send command: stamp each message with a MessageID derived from the file and line, for duplicate detection")
+	flag.StringVar(&journal, "journal", "", "send command: path of the send journal (default 'sb_send_<file>_<queue>.journal' alongside the file)")
+	flag.BoolVar(&delay, "delay", false, "deprecated: equivalent to '-rate 200/s'")
 	flag.BoolVar(&help, "help", false, "information about this tool")
+	flag.BoolVar(&sandbox, "sandbox", false, "run the command against an in-memory namespace holding the entities named, seeded with sample messages, in place of -conn\nnothing is sent to Service Bus, and changes are lost when the command ends")
 	flag.IntVar(&maxWriteCache, "out-lines", 100, "number of lines per file")
+	flag.IntVar(&concurrency, "concurrency", 0, fmt.Sprintf("delete and tidy commands: maximum number of messages processed at once (default %d)", sbc.DefaultConcurrency))
+	flag.IntVar(&pageSize, "page-size", 0, fmt.Sprintf("pull and tidy commands: number of messages fetched by each peek (default %d)", sbc.DefaultPageSize))
+	flag.IntVar(&prefetch, "prefetch", 0, fmt.Sprintf("number of messages buffered when receiving many messages (default %d)", sbc.DefaultPrefetch))
+	flag.StringVar(&settleTimeout, "settle-timeout", "", fmt.Sprintf("timeout for each attempt to complete or abandon a message (default %v)", sbc.DefaultSettleTimeout))
+	flag.StringVar(&rate, "rate", "", "delete, requeue, restore, send and tidy commands: maximum messages changed per second, minute or hour, e.g. 200/s (default unlimited)")
+	flag.IntVar(&burst, "burst", 0, "number of messages changed at once before -rate applies (default 1)")
+	flag.IntVar(&maxAttempts, "max-attempts", 0, fmt.Sprintf("number of attempts for each call to Service Bus failing with a transient error, e.g. ServerBusy (default %d)", sbc.DefaultMaxAttempts))
+	flag.IntVar(&batchSize, "batch-size", 0, fmt.Sprintf("requeue, restore and send commands: maximum number of messages sent in each batch, within the namespace's batch size limit, and no more than -burst with -rate (default %d)", sbc.DefaultBatchSize))
 	flag.Parse()
 	args := flag.Args()
 
 	if _, cmdPres := commandList[command]; !cmdPres || help ||
-		(cmdPres && command != "config" && (len(connectionString) == 0 || len(queueName) == 0)) && len(args) > 0 ||
+		(cmdPres && command != "config" && (len(connectionString) == 0 && !sandbox || len(queueName) == 0 && len(topicName) == 0)) && len(args) > 0 ||
 		(cmdPres && command == "config" && len(args) == 0) {
 		fmt.Printf("sb-shovel %s\nManage large message operations on a given Service Bus.\n\n", version)
-		fmt.Println("Example Usage:\n\tsb-shovel.exe -cmd pull -conn \"<servicebus_connectionstring>\" -q queueName\n\tsb-shovel.exe -cmd delete -conn \"<servicebus_connectionstring>\" -q queueName -dlq")
+		fmt.Println("Example Usage:\n\tsb-shovel.exe -cmd pull -conn \"<servicebus_connectionstring>\" -q queueName\n\tsb-shovel.exe -cmd delete -conn \"<servicebus_connectionstring>\" -q queueName -dlq\n\tsb-shovel.exe -cmd pull -conn \"<servicebus_connectionstring>\" -topic topicName -sub subscriptionName\n\tsb-shovel.exe -cmd requeue -sandbox -q queueName -dlq -all -dl-reason MaxDeliveryCountExceeded")
 		flag.PrintDefaults()
 		return
 	}
@@ -100,32 +294,91 @@ func main() {
 		fmt.Println(err)
 	}
 
+	// deferred first, so the exit status is set after every other deferred call has run
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
 	var sb sbc.Controller
+	var settings sbc.Settings
+	entity := sbc.Entity{Queue: queueName, Topic: topicName, Subscription: subName, DeadLetter: isDlq, Session: sessionID}
 
 	if command != "config" {
+		if sandbox && connectionString != "" {
+			fmt.Println("-conn is not supported with -sandbox")
+			return
+		}
+		profile := ""
 		if isConfig, key := checkIfConfig(connectionString); isConfig {
-			err := cfg.LoadConfig()
-			if err != nil && err.Error() != cc.ERR_NOCONFIG {
+			connectionString, err = resolveConfigValue(cfg, connectionString)
+			if err != nil {
 				fmt.Println(err)
 				return
 			}
-			connectionString, err = cfg.GetConfigValue(key)
-			if err != nil || connectionString == "" {
-				fmt.Println("attribute not found in config.")
-				return
-			}
 			fmt.Printf("connecting to %s\n", key)
+			profile = key
+		}
+		if targetConn, err = resolveConfigValue(cfg, targetConn); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if targetQueue, err = resolveConfigValue(cfg, targetQueue); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if targetTopic, err = resolveConfigValue(cfg, targetTopic); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if sandbox {
+			var b *sbc.Broker
+			if b, err = newSandbox(entity, targetConn, sbc.Entity{Queue: targetQueue, Topic: targetTopic}); err == nil {
+				sb = sbc.NewMemoryController(b)
+				fmt.Print(STATUS_SANDBOX)
+			}
+		} else {
+			sb, err = sbc.NewServiceBusController(connectionString)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		settings, err = buildSettings(cfg, profile, settingOverrides())
+		if err == nil {
+			settings, err = settings.WithDefaults()
 		}
-		sb, err = sbc.NewServiceBusController(connectionString)
 		if err != nil {
 			fmt.Println(err)
+			return
+		}
+		if err = sb.Configure(settings); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer printRetryStats(sb)
+	}
+
+	if command != "config" && command != "list" {
+		if err := checkEntity(command, entity); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if isManyQueues(queueName) && command != "pull" && command != "delete" && command != "tidy" {
+			fmt.Println("-q accepts a glob or list of queues only for the pull, delete and tidy commands")
+			return
 		}
 	}
 
 	switch command {
 	case "config":
-		if delay {
-			fmt.Println("-delay is not supported for this command")
+		if delay || rate != "" {
+			fmt.Println("-rate is not supported for this command")
 			return
 		}
 		if isDlq {
@@ -136,56 +389,105 @@ func main() {
 			fmt.Println("-dir is not supported by this command")
 			return
 		}
+		if sandbox {
+			fmt.Println("-sandbox is not supported by this command")
+			return
+		}
 		config(cfg, args)
 		return
+	case "inspect":
+		if delay || rate != "" {
+			fmt.Println("-rate is not supported for this command")
+			return
+		}
+		err := inspect(ctx, sb, entity, format)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	case "list":
+		if queueName != "" || topicName != "" || subName != "" || isDlq {
+			fmt.Println("-q, -topic, -sub and -dlq are not supported by this command, filter entities with -name")
+			return
+		}
+		err := list(ctx, sb, entityPattern, sortBy, format)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
 	case "pull":
 		if maxWriteCache < 1 {
 			fmt.Println("Value for -out-lines is not valid. Must be >= 1")
 			return
 		}
-		if delay {
-			fmt.Println("Delay is not supported for this command")
+		if delay || rate != "" {
+			fmt.Println("-rate is not supported for this command")
 			return
 		}
-		err := pull(sb, queueName, isDlq, maxWriteCache)
+		err := forEachQueue(ctx, sb, entity, func(e sbc.Entity, subDir string) error {
+			return pull(ctx, sb, e, maxWriteCache, format, tmpl, subDir)
+		})
 		if err != nil {
 			fmt.Println(err)
 		}
 		return
 	case "delete":
-		if delay {
-			fmt.Println("Delay is not supported for this command")
+		if pattern != "" || properties != "" || reason != "" || description != "" {
+			fmt.Println("-pattern, -property, -dl-reason and -dl-description are not supported by this command, use tidy to delete messages matching a pattern")
 			return
 		}
-		err := delete(sb, queueName, isDlq, all, delay)
+		filter, err := buildFilter("", "", "", "", olderThan, newerThan)
 		if err != nil {
 			fmt.Println(err)
+			return
+		}
+		err = forEachQueue(ctx, sb, entity, func(e sbc.Entity, subDir string) error {
+			return delete(ctx, sb, e, filter, all, subDir)
+		})
+		if err != nil {
+			fmt.Println(err)
+			exitCode = exitStatus(err)
 		}
 		return
 	case "requeue":
-		if delay {
-			fmt.Println("Delay is not supported for this command")
+		filter, err := buildFilter(pattern, properties, reason, description, olderThan, newerThan)
+		if err != nil {
+			fmt.Println(err)
 			return
 		}
-		err := requeue(sb, queueName, all, isDlq)
+		transform, err := buildTransform(transformTmpl, transformPatch, transformFind, transformReplace)
 		if err != nil {
 			fmt.Println(err)
+			return
+		}
+		err = requeue(ctx, sb, entity, sbc.Entity{Queue: targetQueue, Topic: targetTopic}, targetConn, filter, transform, all, audit, newIDs)
+		if err != nil {
+			fmt.Println(err)
+			exitCode = exitStatus(err)
 		}
 		return
-	case "send":
+	case "restore":
 		if len(dir) == 0 {
 			fmt.Println("Value for -dir flag missing")
 			return
 		}
-		if isDlq {
-			fmt.Println("Cannot send to a dead letter queue")
-			return
+		err := restore(ctx, sb, entity, dir, format)
+		if err != nil {
+			fmt.Println(err)
 		}
-		if delay {
-			fmt.Println("Delay is not supported for this command")
+		return
+	case "send":
+		if len(dir) == 0 {
+			fmt.Println("Value for -dir flag missing")
 			return
 		}
-		err := sendFromFile(sb, queueName, dir)
+		err := sendFromFile(ctx, sb, entity, dir, format, journal, resume, dedupeIDs, settings.MaxMessageSize)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	case "session":
+		err := sessionState(ctx, sb, entity, args)
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -199,17 +501,16 @@ func main() {
 			fmt.Println("Value for -out-lines is not valid. Must be >= 1")
 			return
 		}
-		if delay {
-			fmt.Println("Delay is not supported for this command")
-			return
-		}
 		if len(pattern) == 0 {
 			fmt.Println("Pattern must be specified, else all messages risk being deleted")
 			return
 		}
-		err := tidy(sb, queueName, pattern, isDlq, execute)
+		err := forEachQueue(ctx, sb, entity, func(e sbc.Entity, subDir string) error {
+			return tidy(ctx, sb, e, pattern, execute, subDir)
+		})
 		if err != nil {
 			fmt.Println(err)
+			exitCode = exitStatus(err)
 		}
 		fmt.Println("finished processing messages")
 		return
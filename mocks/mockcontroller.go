@@ -1,9 +1,10 @@
 package mocks
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"regexp"
+	"time"
 
 	sbc "github.com/aagoldingay/sb-shovel/sbcontroller"
 )
@@ -11,18 +12,42 @@ import (
 type MockServiceBusController struct {
 	sbc.Controller
 
+	Source, Target                       sbc.Entity
 	SourceQueueCount, TargetQueueCount   int
 	SourceQueueClosed, TargetQueueClosed bool
+	TargetNamespace, TargetQueueName     string
+	Filter                               *sbc.Filter
+	Transform                            sbc.Transform
+	Envelopes                            []*sbc.Envelope
+	Settings                             sbc.Settings
+	Retries                              sbc.RetryStats
+	SessionStates                        map[string][]byte
+	Entities                             []sbc.EntityDetails
+	ListPattern                          string
+	ListCalls                            int
+}
+
+func (m *MockServiceBusController) Configure(settings sbc.Settings) error {
+	m.Settings = settings
+	return nil
 }
 
-func (m *MockServiceBusController) DeleteOneMessage() error {
+func (m *MockServiceBusController) DeleteOneMessage(ctx context.Context) error {
 	m.SourceQueueCount--
 	return nil
 }
 
-func (m *MockServiceBusController) DeleteManyMessages(errChan chan error, total int, delay bool) {
+func (m *MockServiceBusController) DeleteManyMessages(ctx context.Context, progress chan<- sbc.Progress, total int, filter *sbc.Filter, archive sbc.Archiver) (sbc.Progress, error) {
+	m.Filter = filter
+	p := sbc.Progress{Total: total, Processed: m.SourceQueueCount, Matched: m.SourceQueueCount, Completed: m.SourceQueueCount}
+	if err := m.archive(archive, m.SourceQueueCount); err != nil {
+		return sbc.Progress{Total: total}, err
+	}
+	if progress != nil {
+		progress <- p
+	}
 	m.SourceQueueCount = 0
-	errChan <- fmt.Errorf("context canceled")
+	return p, nil
 }
 
 func (m *MockServiceBusController) DisconnectSource() error {
@@ -46,60 +71,148 @@ func (m *MockServiceBusController) DisconnectQueues() error {
 	return nil
 }
 
-func (m *MockServiceBusController) ReadSourceQueue(outChan chan []string, errChan chan error, maxWrite int) {
-	msgs := []string{}
+func (m *MockServiceBusController) ReadSourceQueue(ctx context.Context, outChan chan []*sbc.Message, errChan chan error, maxWrite int) {
+	msgs := []*sbc.Message{}
+	seq := int64(0)
 	for i := 0; i < m.SourceQueueCount/5; i++ {
 		for j := 0; j < maxWrite; j++ {
-			msgs = append(msgs, "hello, world")
+			seq++
+			msgs = append(msgs, &sbc.Message{ID: fmt.Sprintf("id-%d", seq), SequenceNumber: seq, Data: []byte("hello, world")})
 		}
 		outChan <- msgs
-		msgs = []string{}
+		msgs = []*sbc.Message{}
 	}
-	errChan <- errors.New(sbc.ERR_QUEUEEMPTY)
+	errChan <- sbc.ErrQueueEmpty
 }
 
-func (m *MockServiceBusController) RequeueOneMessage() error {
+func (m *MockServiceBusController) RequeueOneMessage(ctx context.Context, transform sbc.Transform, audit, newID bool) error {
+	m.Transform = transform
 	m.SourceQueueCount--
 	m.TargetQueueCount++
 	return nil
 }
 
-func (m *MockServiceBusController) RequeueManyMessages(total int) error {
-	m.TargetQueueCount = m.SourceQueueCount
+func (m *MockServiceBusController) RetryStats() sbc.RetryStats {
+	return m.Retries
+}
+
+func (m *MockServiceBusController) RequeueManyMessages(ctx context.Context, progress chan<- sbc.Progress, total int, filter *sbc.Filter, transform sbc.Transform, audit, newID bool) (sbc.Progress, error) {
+	m.Filter = filter
+	m.Transform = transform
+	n := m.SourceQueueCount
+	m.TargetQueueCount += n
 	m.SourceQueueCount = 0
+	return sbc.Progress{Total: total, Processed: n, Matched: n, Completed: n}, nil
+}
+
+func (m *MockServiceBusController) SendEnvelope(ctx context.Context, q bool, e *sbc.Envelope) error {
+	m.SourceQueueCount++
 	return nil
 }
 
-func (m *MockServiceBusController) SendJsonMessage(q bool, data []byte) error {
+func (m *MockServiceBusController) SendManyEnvelopes(ctx context.Context, q bool, data []*sbc.Envelope) (int, error) {
+	m.Envelopes = append(m.Envelopes, data...)
+	m.SourceQueueCount += len(data)
+	return len(data), nil
+}
+
+func (m *MockServiceBusController) SendJsonMessage(ctx context.Context, q bool, data []byte) error {
 	m.SourceQueueCount++
 	return nil
 }
 
-func (m *MockServiceBusController) SendManyJsonMessages(q bool, data [][]byte) error {
+func (m *MockServiceBusController) SendManyJsonMessages(ctx context.Context, q bool, data [][]byte) (int, error) {
 	m.SourceQueueCount += len(data)
+	return len(data), nil
+}
+
+func (m *MockServiceBusController) SetupSource(e sbc.Entity, purge bool) error {
+	m.Source = e
 	return nil
 }
 
 func (m *MockServiceBusController) SetupSourceQueue(name string, dlq, purge bool) error {
+	return m.SetupSource(sbc.QueueEntity(name, dlq), purge)
+}
+
+func (m *MockServiceBusController) SetupTarget(e sbc.Entity, purge bool) error {
+	m.Target = e
+	m.TargetQueueName = e.String()
 	return nil
 }
 
-func (m *MockServiceBusController) SetupTargetQueue(name string, dlq, purge bool) error {
+func (m *MockServiceBusController) SetupTargetNamespace(conn string) error {
+	m.TargetNamespace = conn
 	return nil
 }
 
-func (m *MockServiceBusController) TidyMessages(errChan chan error, rex *regexp.Regexp, execute bool, total int) {
+func (m *MockServiceBusController) SetupTargetQueue(name string, dlq, purge bool) error {
+	return m.SetupTarget(sbc.QueueEntity(name, dlq), purge)
+}
+
+func (m *MockServiceBusController) TidyMessages(ctx context.Context, progress chan<- sbc.Progress, rex *regexp.Regexp, execute bool, total int, archive sbc.Archiver) (sbc.Progress, error) {
 	if execute {
+		if err := m.archive(archive, 2); err != nil {
+			return sbc.Progress{Total: total}, err
+		}
 		m.SourceQueueCount -= 2
 	}
-	errChan <- fmt.Errorf(sbc.ERR_FOUNDPATTERN, "abbc")
-	errChan <- fmt.Errorf(sbc.ERR_FOUNDPATTERN, "abbbc")
-	errChan <- fmt.Errorf("context canceled")
+	p := sbc.Progress{Total: total, Processed: total}
+	if execute {
+		p.Completed = 2
+	}
+	for _, data := range []string{"abbc", "abbbc"} {
+		p.Matched++
+		if progress != nil {
+			progress <- sbc.Progress{Total: total, Processed: p.Processed, Matched: p.Matched, Message: &sbc.Message{Data: []byte(data)}}
+		}
+	}
+	return p, nil
+}
+
+func (m *MockServiceBusController) GetSessionState(ctx context.Context, id string) ([]byte, error) {
+	return m.SessionStates[id], nil
+}
+
+func (m *MockServiceBusController) SetSessionState(ctx context.Context, id string, state []byte) error {
+	if m.SessionStates == nil {
+		m.SessionStates = make(map[string][]byte)
+	}
+	if state == nil {
+		delete(m.SessionStates, id)
+		return nil
+	}
+	m.SessionStates[id] = state
+	return nil
 }
 
-func (m *MockServiceBusController) GetSourceQueueCount() (int, error) {
+func (m *MockServiceBusController) GetSourceDetails(ctx context.Context) (sbc.EntityDetails, error) {
+	return sbc.EntityDetails{Entity: m.Source.String(), Status: "Active", ActiveMessages: int64(m.SourceQueueCount), LockDuration: sbc.Duration(time.Minute), MaxDeliveryCount: 10}, nil
+}
+
+func (m *MockServiceBusController) ListEntities(ctx context.Context, pattern string) ([]sbc.EntityDetails, error) {
+	m.ListPattern = pattern
+	m.ListCalls++
+	return m.Entities, nil
+}
+
+func (m *MockServiceBusController) GetSourceQueueCount(ctx context.Context) (int, error) {
 	return m.SourceQueueCount, nil
 }
-func (m *MockServiceBusController) GetTargetQueueCount() (int, error) {
+func (m *MockServiceBusController) GetTargetQueueCount(ctx context.Context) (int, error) {
 	return m.TargetQueueCount, nil
 }
+
+// archive writes n fake messages to the archive, if provided.
+func (m *MockServiceBusController) archive(archive sbc.Archiver, n int) error {
+	if archive == nil {
+		return nil
+	}
+	for i := 1; i <= n; i++ {
+		err := archive.Archive(&sbc.Message{ID: fmt.Sprintf("id-%d", i), SequenceNumber: int64(i), Data: []byte("hello, world")})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
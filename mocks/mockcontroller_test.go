@@ -1,17 +1,18 @@
 package mocks
 
 import (
+	"context"
 	"testing"
 
 	"github.com/aagoldingay/sb-shovel/sbcontroller"
 )
 
 func CalculateQueueSize(c sbcontroller.Controller) int {
-	s, err := c.GetSourceQueueCount()
+	s, err := c.GetSourceQueueCount(context.Background())
 	if err != nil {
 		return 0
 	}
-	t, err := c.GetTargetQueueCount()
+	t, err := c.GetTargetQueueCount(context.Background())
 	if err != nil {
 		return 0
 	}
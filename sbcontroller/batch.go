@@ -0,0 +1,190 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+// errNotSent is reported for messages not sent because an earlier message failed, when sending stops at the first failure.
+var errNotSent = errors.New("not sent, as an earlier message could not be sent")
+
+// messageBatch is a group of messages sent in a single call. A batch without a MessageBatch holds one message, to be sent alone, as it cannot be batched.
+type messageBatch struct {
+	batch *servicebus.MessageBatch
+	msgs  []*servicebus.Message
+}
+
+// batchIterator implements servicebus.BatchIterator over a single, already packed, MessageBatch. A new iterator is needed for each attempt to send it.
+type batchIterator struct {
+	batch *servicebus.MessageBatch
+}
+
+func (it *batchIterator) Done() bool {
+	return it.batch == nil
+}
+
+func (it *batchIterator) Next(messageID string, opts *servicebus.BatchOptions) (*servicebus.MessageBatch, error) {
+	if it.batch == nil {
+		return nil, servicebus.ErrNoMessages{}
+	}
+	mb := it.batch
+	mb.ID = messageID
+	it.batch = nil
+	return mb, nil
+}
+
+// maxBatchSize returns the largest batch accepted by a namespace, 256KB for the standard tier, or 1MB for premium namespaces,
+// identified by a maximum message size above the standard tier's.
+func maxBatchSize(maxMessageSize int) servicebus.MaxMessageSizeInBytes {
+	if maxMessageSize > DefaultMaxMessageSize {
+		return servicebus.PremiumMaxMessageSizeInBytes
+	}
+	return servicebus.StandardMaxMessageSizeInBytes
+}
+
+// packBatches packs messages, in order, into batches of at most count messages whose encoded size fits within maxBytes.
+//
+// A message larger than Settings.MaxMessageSize, or too large for a batch of its own, is placed alone in a nil batch, so sending it alone reports the error.
+func packBatches(msgs []*servicebus.Message, count, maxMessageSize int) []*messageBatch {
+	maxBytes := maxBatchSize(maxMessageSize)
+	batches := []*messageBatch{}
+	var current *messageBatch
+	for _, m := range msgs {
+		if checkMessageSize(m, maxMessageSize) != nil {
+			current = nil
+			batches = append(batches, &messageBatch{msgs: []*servicebus.Message{m}})
+			continue
+		}
+		if current != nil && len(current.msgs) < count {
+			if ok, err := current.batch.Add(m); ok && err == nil {
+				current.msgs = append(current.msgs, m)
+				continue
+			}
+		}
+		current = nil
+		mb := servicebus.NewMessageBatch(maxBytes, "", nil)
+		if ok, err := mb.Add(m); ok && err == nil {
+			current = &messageBatch{batch: mb, msgs: []*servicebus.Message{m}}
+			batches = append(batches, current)
+			continue
+		}
+		batches = append(batches, &messageBatch{msgs: []*servicebus.Message{m}})
+	}
+	return batches
+}
+
+// batchSender sends messages in batches, respecting a Controller's rate limit and retrying transient errors.
+//
+// A batch that cannot be sent is sent again one message at a time, so a message the broker rejects does not lose the rest of its batch.
+type batchSender struct {
+	settings Settings
+	limiter  *limiter
+	retrier  *retrier
+	// session is stamped onto messages sent without a SessionID
+	session   string
+	sendBatch func(ctx context.Context, b *messageBatch) error
+	// send sends a single message, retrying transient errors
+	send func(ctx context.Context, m *servicebus.Message) error
+}
+
+// sendAll sends messages in order, returning the error for each message, nil once sent.
+//
+// If isolate is false, sending stops at the first message that cannot be sent, and errNotSent is reported for every message after it.
+// Otherwise, every message is attempted.
+func (s *batchSender) sendAll(ctx context.Context, msgs []*servicebus.Message, isolate bool) []error {
+	errs := make([]error, len(msgs))
+	withSessionID(msgs, s.session)
+	i := 0
+	for _, b := range packBatches(msgs, s.settings.batchSize(), s.settings.MaxMessageSize) {
+		if err := s.limiter.waitN(ctx, len(b.msgs)); err != nil {
+			fillErrors(errs[i:], err)
+			return errs
+		}
+		var err error
+		if b.batch != nil {
+			if err = s.retrier.do(ctx, func() error { return s.sendBatch(ctx, b) }); err == nil {
+				i += len(b.msgs)
+				continue
+			}
+		}
+		for _, m := range b.msgs {
+			// a message rejected by the broker fails its whole batch, so each message is sent alone, unless the broker could not be reached
+			if err != nil && (isTransient(err) || ctx.Err() != nil) {
+				errs[i] = err
+			} else {
+				errs[i] = s.send(ctx, m)
+			}
+			if errs[i] != nil && !isolate {
+				fillErrors(errs[i+1:], errNotSent)
+				return errs
+			}
+			i++
+		}
+	}
+	return errs
+}
+
+func fillErrors(errs []error, err error) {
+	for i := range errs {
+		errs[i] = err
+	}
+}
+
+// sentBefore returns the number of messages sent before the first error, and that error.
+func sentBefore(errs []error) (int, error) {
+	for i, err := range errs {
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(errs), nil
+}
+
+// envelopeMessages rebuilds messages from envelopes, stopping at the first envelope that cannot be rebuilt, and returning its error.
+func envelopeMessages(data []*Envelope) ([]*servicebus.Message, error) {
+	msgs := make([]*servicebus.Message, 0, len(data))
+	for _, e := range data {
+		m, err := e.toServiceBusMessage()
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// jsonMessages builds a JSON message for each item of data.
+func jsonMessages(data [][]byte) []*servicebus.Message {
+	msgs := make([]*servicebus.Message, len(data))
+	for i, d := range data {
+		msgs[i] = newJsonMessage(d)
+	}
+	return msgs
+}
+
+// sendMany sends messages in batches, stopping at the first message that cannot be sent. The number of messages sent before it is returned, with its error,
+// or err once every message is sent, e.g. for messages that could not be built.
+func (s *batchSender) sendMany(ctx context.Context, msgs []*servicebus.Message, err error) (int, error) {
+	n, sendErr := sentBefore(s.sendAll(ctx, msgs, false))
+	if sendErr != nil {
+		return n, sendErr
+	}
+	return n, err
+}
+
+// pendingRequeue is a received message waiting to be sent to the target queue by RequeueManyMessages.
+type pendingRequeue struct {
+	received *servicebus.Message
+	original *Message
+	msg      *servicebus.Message
+}
+
+func pendingMessages(pending []*pendingRequeue) []*servicebus.Message {
+	msgs := make([]*servicebus.Message, len(pending))
+	for i, p := range pending {
+		msgs[i] = p.msg
+	}
+	return msgs
+}
@@ -0,0 +1,111 @@
+package sbcontroller
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func helper_newMessages(n, size int) []*servicebus.Message {
+	msgs := make([]*servicebus.Message, n)
+	for i := range msgs {
+		msgs[i] = &servicebus.Message{ID: "id", Data: bytes.Repeat([]byte("a"), size)}
+	}
+	return msgs
+}
+
+func Test_PackBatches_Count(t *testing.T) {
+	batches := packBatches(helper_newMessages(5, 10), 2, DefaultMaxMessageSize)
+	if len(batches) != 3 {
+		t.Fatalf("Unexpected number of batches: %d", len(batches))
+	}
+	for i, expected := range []int{2, 2, 1} {
+		if batches[i].batch == nil || len(batches[i].msgs) != expected {
+			t.Errorf("Unexpected batch %d: %d message(s)", i, len(batches[i].msgs))
+		}
+	}
+}
+
+func Test_PackBatches_Size(t *testing.T) {
+	// two 100KB messages fit within a standard namespace's 256KB batch, but not three
+	batches := packBatches(helper_newMessages(5, 100*1024), DefaultBatchSize, DefaultMaxMessageSize)
+	if len(batches) != 3 || len(batches[0].msgs) != 2 || len(batches[2].msgs) != 1 {
+		t.Fatalf("Unexpected batches: %d", len(batches))
+	}
+
+	// premium namespaces accept 1MB batches
+	batches = packBatches(helper_newMessages(5, 100*1024), DefaultBatchSize, PremiumMaxMessageSize)
+	if len(batches) != 1 || len(batches[0].msgs) != 5 {
+		t.Errorf("Unexpected premium batches: %d", len(batches))
+	}
+}
+
+func Test_PackBatches_TooLarge(t *testing.T) {
+	msgs := append(helper_newMessages(1, 10), helper_newMessages(1, 300*1024)...)
+	msgs = append(msgs, helper_newMessages(1, 10)...)
+
+	batches := packBatches(msgs, DefaultBatchSize, DefaultMaxMessageSize)
+	if len(batches) != 3 {
+		t.Fatalf("Unexpected number of batches: %d", len(batches))
+	}
+	if batches[1].batch != nil || len(batches[1].msgs) != 1 || batches[1].msgs[0] != msgs[1] {
+		t.Errorf("Message too large for a batch was not sent alone: %+v", batches[1])
+	}
+	if batches[2].batch == nil || batches[2].msgs[0] != msgs[2] {
+		t.Errorf("Message after a message too large was not batched: %+v", batches[2])
+	}
+}
+
+func Test_BatchIterator(t *testing.T) {
+	b := packBatches(helper_newMessages(2, 10), DefaultBatchSize, DefaultMaxMessageSize)[0]
+	it := &batchIterator{batch: b.batch}
+	if it.Done() {
+		t.Fatal("Iterator was done before its batch was sent")
+	}
+	mb, err := it.Next("batch-id", nil)
+	if err != nil || mb != b.batch || mb.ID != "batch-id" {
+		t.Errorf("Unexpected batch: %+v, %v", mb, err)
+	}
+	if !it.Done() {
+		t.Error("Iterator was not done after its batch was sent")
+	}
+}
+
+func Test_BatchSender_BatchesWithinBurst(t *testing.T) {
+	settings := Settings{Rate: 1000, Burst: 3, BatchSize: DefaultBatchSize, MaxMessageSize: DefaultMaxMessageSize}
+	sizes := []int{}
+	s := &batchSender{
+		settings: settings,
+		limiter:  newLimiter(settings.Rate, settings.Burst),
+		retrier:  newRetrier(1),
+		sendBatch: func(ctx context.Context, b *messageBatch) error {
+			sizes = append(sizes, len(b.msgs))
+			return nil
+		},
+	}
+	if n, err := s.sendMany(context.Background(), helper_newMessages(10, 10), nil); n != 10 || err != nil {
+		t.Fatalf("Unexpected send: %d, %v", n, err)
+	}
+	for _, n := range sizes {
+		if n > settings.Burst {
+			t.Errorf("Batch of %d message(s) is larger than the burst: %v", n, sizes)
+		}
+	}
+	if len(sizes) != 4 {
+		t.Errorf("Unexpected batches: %v", sizes)
+	}
+}
+
+func Test_Settings_BatchSize(t *testing.T) {
+	if n := (Settings{BatchSize: 100, Burst: 5}).batchSize(); n != 100 {
+		t.Errorf("Batch size was capped without a rate: %d", n)
+	}
+	if n := (Settings{BatchSize: 100, Rate: 10, Burst: 5}).batchSize(); n != 5 {
+		t.Errorf("Batch size was not capped at the burst: %d", n)
+	}
+	if n := (Settings{BatchSize: 2, Rate: 10, Burst: 5}).batchSize(); n != 2 {
+		t.Errorf("Batch size was raised to the burst: %d", n)
+	}
+}
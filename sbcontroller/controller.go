@@ -6,18 +6,15 @@ package sbcontroller
 import (
 	"context"
 	"errors"
-	"fmt"
 	"regexp"
-	"strings"
-	"sync"
 	"time"
 
 	servicebus "github.com/Azure/azure-service-bus-go"
 )
 
 const (
-	ERR_DELETESTATUS     string = "\r[status] completed %d of %d messages"
-	ERR_FOUNDPATTERN     string = "[status] identified %s in message"
+	ERR_LOCKLOST         string = "message lock lost, the message remains on the queue"
+	ERR_MESSAGETOOLARGE  string = "message is larger than the maximum message size"
 	ERR_NOMESSAGESTOSEND string = "no messages to send"
 	ERR_NOQUEUEOBJECT    string = "no queue to close"
 	ERR_NOTFOUND         string = "could not find service bus queue - 404"
@@ -26,55 +23,102 @@ const (
 )
 
 // Controller is a generic wrapper to control interactions with a Service Bus client.
+//
+// Operations take a context, which is cancelled when the user interrupts sb-shovel. Operations on many messages stop receiving,
+// abandon any message received after cancellation or once the total is reached, and wait for in-flight messages to be settled before returning.
+//
+// Operations on many messages send Progress events to an optional channel, which must be read until the operation returns,
+// and return the final Progress with an error: nil once complete, the context error if cancelled, or the first MessageError encountered.
+// The outcome of every received message is recorded in the Progress, so its counts reflect what happened on the queue.
+//
+// Calls to Service Bus failing with transient errors, e.g. ServerBusy or a lost AMQP link, are retried with a backoff up to Settings.MaxAttempts,
+// and every call pauses while the broker signals throttling. The retries are counted by RetryStats.
 type Controller interface {
-	DeleteOneMessage() error
-	DeleteManyMessages(errChan chan error, total int, delay bool)
+	Configure(settings Settings) error
+	DeleteOneMessage(ctx context.Context) error
+	DeleteManyMessages(ctx context.Context, progress chan<- Progress, total int, filter *Filter, archive Archiver) (Progress, error)
 	DisconnectQueues() error
 	DisconnectSource() error
 	DisconnectTarget() error
-	GetSourceQueueCount() (int, error)
-	GetTargetQueueCount() (int, error)
-	ReadSourceQueue(outChan chan []string, errChan chan error, maxWrite int)
-	RequeueOneMessage() error
-	RequeueManyMessages(total int) error
-	SendJsonMessage(q bool, data []byte) error
-	SendManyJsonMessages(q bool, data [][]byte) error
+	GetSessionState(ctx context.Context, id string) ([]byte, error)
+	GetSourceDetails(ctx context.Context) (EntityDetails, error)
+	GetSourceQueueCount(ctx context.Context) (int, error)
+	GetTargetQueueCount(ctx context.Context) (int, error)
+	ListEntities(ctx context.Context, pattern string) ([]EntityDetails, error)
+	ReadSourceQueue(ctx context.Context, outChan chan []*Message, errChan chan error, maxWrite int)
+	RequeueOneMessage(ctx context.Context, transform Transform, audit, newID bool) error
+	RequeueManyMessages(ctx context.Context, progress chan<- Progress, total int, filter *Filter, transform Transform, audit, newID bool) (Progress, error)
+	RetryStats() RetryStats
+	SendEnvelope(ctx context.Context, q bool, e *Envelope) error
+	SendJsonMessage(ctx context.Context, q bool, data []byte) error
+	SendManyEnvelopes(ctx context.Context, q bool, data []*Envelope) (int, error)
+	SendManyJsonMessages(ctx context.Context, q bool, data [][]byte) (int, error)
+	SetSessionState(ctx context.Context, id string, state []byte) error
+	SetupSource(e Entity, purge bool) error
 	SetupSourceQueue(name string, dlq, purge bool) error
+	SetupTarget(e Entity, purge bool) error
+	SetupTargetNamespace(conn string) error
 	SetupTargetQueue(name string, dlq, purge bool) error
-	TidyMessages(errChan chan error, rex *regexp.Regexp, execute bool, total int)
+	TidyMessages(ctx context.Context, progress chan<- Progress, rex *regexp.Regexp, execute bool, total int, archive Archiver) (Progress, error)
 
-	closeQueue(q *servicebus.Queue) error
-	getQueueCount(q *servicebus.Queue, dlq bool) (int, error)
-	sendMessage(q *servicebus.Queue, data []byte) error
-	setupQueue(name string, dlq, purge bool) (*servicebus.Queue, error)
+	closeEntity(e entityConn) error
+	getEntityCount(ctx context.Context, e entityConn) (int, error)
+	sendMessage(ctx context.Context, e entityConn, m *servicebus.Message) error
+	setupEntity(ns namespace, e Entity, purge bool) (entityConn, error)
 }
 
 // ServiceBusController is the concrete implementation for the azure-service-bus-go package.
+//
+// The source and target may each be a queue, a topic or a subscription, as described by Entity. The target is connected through the same namespace
+// as the source, unless SetupTargetNamespace is called.
+//
+// A ServiceBusController over an in-memory Broker, as returned by NewMemoryController, runs the same operations without a Service Bus namespace.
 type ServiceBusController struct {
 	Controller
-	client                   *servicebus.Namespace
-	ctx                      context.Context
-	isSourceDlq, isTargetDlq bool
-	source, target           *servicebus.Queue
+	client, targetClient namespace
+	limiter              *limiter
+	retrier              *retrier
+	settings             Settings
+	source, target       entityConn
 }
 
 // NewServiceBusController builds and returns a ServiceBusController, initialising the azure-service-bus-go package client using a supplied connection string.
 func NewServiceBusController(conn string) (Controller, error) {
-	ns, err := servicebus.NewNamespace(servicebus.NamespaceWithConnectionString(conn))
+	ns, err := newServiceBusNamespace(conn)
 	if err != nil {
 		return nil, err
 	}
 	return &ServiceBusController{
-		client: ns,
-		ctx:    context.Background(),
-		source: nil,
-		target: nil}, nil
+		client:       ns,
+		targetClient: ns,
+		retrier:      newRetrier(DefaultMaxAttempts),
+		settings:     DefaultSettings(),
+		source:       nil,
+		target:       nil}, nil
+}
+
+// Configure replaces the Controller's settings. Zero values use the defaults. An error is returned if a setting is invalid.
+//
+// This must be called before SetupSourceQueue and SetupTargetQueue for the prefetch count to take effect.
+func (sb *ServiceBusController) Configure(settings Settings) error {
+	s, err := settings.WithDefaults()
+	if err != nil {
+		return err
+	}
+	sb.settings = s
+	sb.limiter = newLimiter(s.Rate, s.Burst)
+	sb.retrier.attempts = s.MaxAttempts
+	return nil
 }
 
 // DeleteOneMessage receives then completes exactly ONE message from the queue. An error is returned if a problem was encountered.
-func (sb *ServiceBusController) DeleteOneMessage() error {
-	if err := sb.source.ReceiveOne(sb.ctx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
-		return m.Complete(sb.ctx)
+func (sb *ServiceBusController) DeleteOneMessage(ctx context.Context) error {
+	if err := sb.source.ReceiveOne(ctx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
+		if err := sb.limiter.wait(ctx); err != nil {
+			sb.abandonMessage(m)
+			return err
+		}
+		return sb.retrier.do(ctx, func() error { return sb.source.complete(ctx, m) })
 	})); err != nil {
 		return err
 	}
@@ -83,356 +127,636 @@ func (sb *ServiceBusController) DeleteOneMessage() error {
 
 // DeleteManyMessages concurrently receives and completes many messages.
 //
-// Given a total number (e.g. the current value on the queue), this process will run until that many messages have been deleted.
+// Given a total number (e.g. the current value on the queue), this process will run until that many messages have been received,
+// or no message arrives within receiveIdleTimeout.
+//
+// Providing a filter only deletes messages matching every criteria of the filter, selected by peeking up to total messages before receiving.
+// Messages not selected are abandoned, and remain on the queue. Receiving stops once a message is redelivered, as described in receive.go.
+//
+// Providing an archive writes each message to it before the message is completed. A message that cannot be archived is abandoned, and stops the operation.
 //
-// Choosing to action a delay will slow down the operation per 50 messages.
+// At most Settings.Concurrency messages are processed at once, and matched messages are deleted no faster than Settings.Rate.
+// Messages waiting for the rate limit when the context is cancelled are abandoned.
 //
-// Errors are returned via a channel.
-func (sb *ServiceBusController) DeleteManyMessages(errChan chan error, total int, delay bool) {
-	count := 0
-	var wg sync.WaitGroup
+// Progress is sent every 50 messages. Matched messages that could not be completed, after retrying, are counted as failed or lock lost.
+func (sb *ServiceBusController) DeleteManyMessages(ctx context.Context, progress chan<- Progress, total int, filter *Filter, archive Archiver) (Progress, error) {
+	var failure firstError
+	tracker := newProgressTracker(progress, total)
+	pool := newWorkerPool(sb.settings.Concurrency)
+
+	selected, err := sb.selectMessages(ctx, total, filter.matcher())
+	if err != nil {
+		return tracker.snapshot(), err
+	}
+
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	processMessage := func(m *servicebus.Message) {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
-		defer cancel()
-		defer wg.Done()
-		m.Complete(ctx)
-	}
-
-	innerCtx, cancel := context.WithCancel(sb.ctx)
-	if err := sb.source.Receive(innerCtx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
-		count++
-		if count > 0 && count%50 == 0 {
-			errChan <- fmt.Errorf(ERR_DELETESTATUS, count, total)
-			if delay {
-				time.Sleep(250 * time.Millisecond)
-			}
+		msg := newMessage(m)
+		if err := sb.limiter.wait(ctx); err != nil {
+			sb.settleMessage(tracker, m, false)
+			return
 		}
-		wg.Add(1)
-		go processMessage(m)
-		if count == total {
-			wg.Wait()
+		tracker.matched(msg, false)
+		if err := sb.archiveMessage(archive, m, msg); err != nil {
+			tracker.failed()
+			failure.set(err)
 			cancel()
+			return
 		}
-		return nil
-	})); err != nil {
-		errChan <- err
-		return
+		sb.settleMessage(tracker, m, true)
 	}
+
+	// receiving waits for a free worker, so messages are not held locked while queued
+	err = sb.receiveMany(innerCtx, tracker, total, selected, func(m *servicebus.Message) bool {
+		return pool.run(innerCtx, func() { processMessage(m) })
+	})
+	// in-flight messages are settled before reporting
+	pool.wait()
+	return tracker.snapshot(), operationError(ctx, failure.get(), err)
 }
 
 // DisconnectQueues performs both DisconnectSource and DisconnectTarget.
 func (sb *ServiceBusController) DisconnectQueues() error {
 	err := sb.DisconnectSource()
-	if err != nil && err.Error() != ERR_NOQUEUEOBJECT {
+	if err != nil && !errors.Is(err, ErrNoQueueObject) {
 		return err
 	}
 	err = sb.DisconnectTarget()
-	if err != nil && err.Error() != ERR_NOQUEUEOBJECT {
+	if err != nil && !errors.Is(err, ErrNoQueueObject) {
 		return err
 	}
 	return nil
 }
 
-// DisconnectSource breaks the connection for the queue assigned to the internal source queue attribute on the Controller.
+// DisconnectSource breaks the connection for the entity assigned to the internal source attribute on the Controller.
 func (sb *ServiceBusController) DisconnectSource() error {
 	if sb.source != nil {
-		return sb.closeQueue(sb.source)
+		return sb.closeEntity(sb.source)
 	}
-	return errors.New(ERR_NOQUEUEOBJECT)
+	return ErrNoQueueObject
 }
 
-// DisconnectSource breaks the connection for the queue assigned to the internal target queue attribute on the Controller.
+// DisconnectSource breaks the connection for the entity assigned to the internal target attribute on the Controller.
 func (sb *ServiceBusController) DisconnectTarget() error {
 	if sb.target != nil {
-		return sb.closeQueue(sb.target)
+		return sb.closeEntity(sb.target)
+	}
+	return ErrNoQueueObject
+}
+
+// GetSessionState retrieves the state of a session of the configured source queue, or subscription, e.g. to debug a stuck session.
+// ErrNoSessions is returned if the source does not require sessions.
+func (sb *ServiceBusController) GetSessionState(ctx context.Context, id string) ([]byte, error) {
+	var state []byte
+	err := sb.retrier.do(ctx, func() error {
+		var err error
+		state, err = sb.source.sessionState(ctx, id)
+		return err
+	})
+	return state, entityError(err)
+}
+
+// GetSourceDetails retrieves the message counts, size and settings of the configured source queue, topic or subscription.
+// The details of a dead letter queue are those of its queue or subscription. ErrNotFound is returned if the entity does not exist.
+func (sb *ServiceBusController) GetSourceDetails(ctx context.Context) (EntityDetails, error) {
+	var d EntityDetails
+	err := sb.retrier.do(ctx, func() error {
+		var err error
+		d, err = sb.source.describe(ctx)
+		return err
+	})
+	return d, entityError(err)
+}
+
+// ListEntities retrieves the details of every queue, topic and subscription in the namespace whose path matches a glob pattern,
+// e.g. 'orders-*' or 'events/subscriptions/*', sorted by path. An empty pattern matches every entity. Listing requires the Manage right.
+func (sb *ServiceBusController) ListEntities(ctx context.Context, pattern string) ([]EntityDetails, error) {
+	if err := checkPattern(pattern); err != nil {
+		return nil, err
+	}
+	all, err := sb.client.list(ctx, sb.retrier)
+	if err != nil {
+		return nil, err
+	}
+	details := []EntityDetails{}
+	for _, d := range all {
+		if matchPattern(pattern, d.Entity) {
+			details = append(details, d)
+		}
 	}
-	return errors.New(ERR_NOQUEUEOBJECT)
+	sortDetails(details)
+	return details, nil
 }
 
-// GetSourceQueueCount retrieves the count of messages on the configured source queue.
-func (sb *ServiceBusController) GetSourceQueueCount() (int, error) {
-	return sb.getQueueCount(sb.source, sb.isSourceDlq)
+// GetSourceQueueCount retrieves the count of messages on the configured source queue, or subscription.
+func (sb *ServiceBusController) GetSourceQueueCount(ctx context.Context) (int, error) {
+	return sb.getEntityCount(ctx, sb.source)
 }
 
-// GetTargetQueueCount retrieves teh count of messages on the configured target queue.
-func (sb *ServiceBusController) GetTargetQueueCount() (int, error) {
-	return sb.getQueueCount(sb.target, sb.isTargetDlq)
+// GetTargetQueueCount retrieves teh count of messages on the configured target queue, or topic.
+func (sb *ServiceBusController) GetTargetQueueCount(ctx context.Context) (int, error) {
+	return sb.getEntityCount(ctx, sb.target)
 }
 
 // ReadSourceQueue peeks messages on the configured source queue, returning a batch of messages, controlled by the maxWrite variable, to a channel.
 //
-// Errors are returned on a separate channel.
-func (sb *ServiceBusController) ReadSourceQueue(outChan chan []string, errChan chan error, maxWrite int) {
-	opts := []servicebus.PeekOption{servicebus.PeekWithPageSize(100)}
-	messageIterator, err := sb.source.Peek(sb.ctx, opts...)
+// Errors are returned on a separate channel, ending with ErrQueueEmpty once every message has been read. If the context is cancelled, messages already read are returned before the context error.
+func (sb *ServiceBusController) ReadSourceQueue(ctx context.Context, outChan chan []*Message, errChan chan error, maxWrite int) {
+	messageIterator, err := sb.peek(ctx)
 	if err != nil {
 		errChan <- err
 		return
 	}
 
-	messagesOutput := []string{}
+	messagesOutput := []*Message{}
 
 	done := false
 	for !messageIterator.Done() && !done {
 		if len(messagesOutput) == maxWrite {
 			outChan <- messagesOutput
-			messagesOutput = []string{}
+			messagesOutput = []*Message{}
 		}
 
-		msg, err := messageIterator.Next(sb.ctx)
+		msg, err := sb.next(ctx, messageIterator)
 		if err != nil {
+			if ctx.Err() != nil {
+				if len(messagesOutput) > 0 {
+					outChan <- messagesOutput
+				}
+				errChan <- ctx.Err()
+				return
+			}
 			switch err.(type) {
 			case servicebus.ErrNoMessages:
 				if len(messagesOutput) > 0 {
 					outChan <- messagesOutput
 				}
 				done = true
-				errChan <- errors.New(ERR_QUEUEEMPTY)
+				errChan <- ErrQueueEmpty
 				return
 			default:
-				if strings.Contains(err.Error(), "401") {
-					errChan <- errors.New(ERR_UNAUTHORISED)
-					return
-				}
-				if strings.Contains(err.Error(), "404") {
-					errChan <- errors.New(ERR_NOTFOUND)
-					return
-				}
-				errChan <- err
+				errChan <- entityError(err)
 				return
 			}
 		}
-		messagesOutput = append(messagesOutput, string(msg.Data))
+		messagesOutput = append(messagesOutput, newMessage(msg))
 	}
 }
 
-// RequeueOneMessage receives exactly ONE message from the source queue, resends the Data property of a message to the target queue,
+// RequeueOneMessage receives exactly ONE message from the source queue, resends a copy of the message, including its properties, to the target queue,
 // then completes from the source queue.
 //
+// Providing a transform rewrites the message body before it is sent.
+//
+// Providing audit as true stamps the original dead-letter reason, the time of requeue and a requeue count onto the message's user properties.
+// The copy keeps the message's MessageID, unless newID is true, as in newRequeueMessage.
+//
 // An error is returned if a problem was encountered.
-func (sb *ServiceBusController) RequeueOneMessage() error {
-	if err := sb.source.ReceiveOne(sb.ctx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
-		err := sb.sendMessage(sb.target, m.Data)
+func (sb *ServiceBusController) RequeueOneMessage(ctx context.Context, transform Transform, audit, newID bool) error {
+	if err := sb.source.ReceiveOne(ctx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
+		if err := sb.limiter.wait(ctx); err != nil {
+			sb.abandonMessage(m)
+			return err
+		}
+		msg, err := newTransformedMessage(m, transform, audit, newID)
 		if err != nil {
+			sb.abandonMessage(m)
 			return err
 		}
-		return m.Complete(sb.ctx)
+		err = sb.sendMessage(ctx, sb.target, msg)
+		if err != nil {
+			sb.abandonMessage(m)
+			return newMessageError("send", newMessage(m), err)
+		}
+		return sb.retrier.do(context.Background(), func() error { return sb.source.complete(context.Background(), m) })
 	})); err != nil {
 		return err
 	}
 	return nil
 }
 
-// RequeueManyMessages receives from a source queue, sends as new to the target queue, then completes from the source queue. This is performed
-// on many messages, controlled by the total parameter.
-func (sb *ServiceBusController) RequeueManyMessages(total int) error {
-	count := 0
+// RequeueManyMessages receives from a source queue, sends a copy of each message, including its properties, to the target queue, then completes from the source queue.
+// This is performed on many messages, controlled by the total parameter.
+//
+// Providing a filter only requeues messages matching every criteria of the filter, selected as in DeleteManyMessages.
+// Messages not selected are abandoned, and remain on the source queue.
+//
+// Providing a transform rewrites each message body before it is sent. A message that cannot be transformed or sent is abandoned, and stops the operation.
+//
+// Providing audit as true stamps the original dead-letter reason, the time of requeue and a requeue count onto each message's user properties.
+// Copies keep their message's MessageID, unless newID is true, as in newRequeueMessage.
+//
+// Matched messages are sent to the target queue in batches of up to Settings.BatchSize, no faster than Settings.Rate, and each is completed once its batch is sent.
+// A message that cannot be sent is abandoned, without losing the rest of its batch, and stops the operation once its batch has been settled.
+// Messages waiting to be sent when the context is cancelled are abandoned.
+//
+// Progress is sent every 50 messages. Matched messages that could not be completed once sent are counted as failed or lock lost.
+// These messages remain on the source queue, as well as being sent to the target queue.
+func (sb *ServiceBusController) RequeueManyMessages(ctx context.Context, progress chan<- Progress, total int, filter *Filter, transform Transform, audit, newID bool) (Progress, error) {
+	var failure firstError
+	tracker := newProgressTracker(progress, total)
+	pending := []*pendingRequeue{}
+
+	selected, err := sb.selectMessages(ctx, total, filter.matcher())
+	if err != nil {
+		return tracker.snapshot(), err
+	}
+
+	// flush sends the pending messages, completing those sent, and abandoning the rest
+	flush := func() error {
+		batch := pending
+		pending = []*pendingRequeue{}
+		errs := sb.sender(true).sendAll(ctx, pendingMessages(batch), true)
+		var err error
+		for i, p := range batch {
+			switch {
+			case errs[i] == nil:
+				sb.settleMessage(tracker, p.received, true)
+			case ctx.Err() != nil:
+				sb.settleMessage(tracker, p.received, false)
+			default:
+				tracker.failed()
+				sb.abandonMessage(p.received)
+				if err == nil {
+					err = newMessageError("send", p.original, errs[i])
+				}
+			}
+		}
+		return err
+	}
+
 	processMessage := func(m *servicebus.Message) error {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
-		defer cancel()
-		err := sb.sendMessage(sb.target, m.Data)
+		original := newMessage(m)
+		tracker.matched(original, false)
+		msg, err := newTransformedMessage(m, transform, audit, newID)
 		if err != nil {
+			tracker.failed()
+			sb.abandonMessage(m)
 			return err
 		}
-		m.Complete(ctx)
+		pending = append(pending, &pendingRequeue{received: m, original: original, msg: msg})
+		if len(pending) >= sb.settings.batchSize() {
+			return flush()
+		}
 		return nil
 	}
 
-	innerCtx, cancel := context.WithCancel(sb.ctx)
-	if err := sb.source.Receive(innerCtx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
-		count++
-		if count > 0 && count%50 == 0 {
-			fmt.Printf(ERR_DELETESTATUS, count, total)
-		}
-		err := processMessage(m)
-		if err != nil {
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err = sb.receiveMany(innerCtx, tracker, total, selected, func(m *servicebus.Message) bool {
+		if err := processMessage(m); err != nil {
+			failure.set(err)
 			cancel()
-			return err
 		}
-		if count == total {
-			cancel()
+		return true
+	})
+	// messages transformed before the operation stopped are still sent, unless it was cancelled
+	if len(pending) > 0 {
+		if flushErr := flush(); flushErr != nil {
+			failure.set(flushErr)
 		}
-		return nil
-	})); err != nil {
+	}
+	return tracker.snapshot(), operationError(ctx, failure.get(), err)
+}
+
+// RetryStats returns the number of calls retried after transient errors, and the number of times the broker signalled throttling.
+func (sb *ServiceBusController) RetryStats() RetryStats {
+	return sb.retrier.snapshot()
+}
+
+// SendEnvelope sends to either the source or target queue, rebuilding the message from an Envelope with its original properties.
+// Messages are sent no faster than Settings.Rate.
+//
+// If q is true, the message is sent to target.
+// If q is false, the message is sent to the source.
+func (sb *ServiceBusController) SendEnvelope(ctx context.Context, q bool, e *Envelope) error {
+	if err := sb.limiter.wait(ctx); err != nil {
 		return err
 	}
-	return nil
+	m, err := e.toServiceBusMessage()
+	if err != nil {
+		return err
+	}
+	if !q {
+		return sb.sendMessage(ctx, sb.source, m)
+	}
+	return sb.sendMessage(ctx, sb.target, m)
 }
 
 // SendJsonMessage sends to either the source or target queue, passing in solely the message content.
+// Messages are sent no faster than Settings.Rate.
 //
 // If q is true, the message is sent to target.
 // If q is false, the message is sent to the source.
 //
 // The message is sent in JSON format.
-func (sb *ServiceBusController) SendJsonMessage(q bool, data []byte) error {
+func (sb *ServiceBusController) SendJsonMessage(ctx context.Context, q bool, data []byte) error {
+	if err := sb.limiter.wait(ctx); err != nil {
+		return err
+	}
 	if !q {
-		return sb.sendMessage(sb.source, data)
+		return sb.sendMessage(ctx, sb.source, newJsonMessage(data))
 	}
-	return sb.sendMessage(sb.target, data)
+	return sb.sendMessage(ctx, sb.target, newJsonMessage(data))
 }
 
-// SendManyJsonMessages sends many messages, from an array, to either the source or target.
+// SendManyEnvelopes sends many messages, from an array of envelopes, to either the source or target.
+// Messages are sent in batches of up to Settings.BatchSize, no faster than Settings.Rate.
 //
 // If q is true, the message is sent to target.
 // If q is false, the message is sent to source.
 //
-// The message is sent in JSON format.
-func (sb *ServiceBusController) SendManyJsonMessages(q bool, data [][]byte) error {
+// Sending stops at the first message that cannot be sent. A batch that fails is sent again one message at a time, so the messages before it are still sent.
+// The number of messages sent is returned, including when an error stops the operation.
+func (sb *ServiceBusController) SendManyEnvelopes(ctx context.Context, q bool, data []*Envelope) (int, error) {
 	if len(data) == 0 {
-		return errors.New(ERR_NOMESSAGESTOSEND)
+		return 0, ErrNoMessagesToSend
 	}
-	for i := 0; i < len(data); i++ {
-		err := sb.SendJsonMessage(q, data[i])
-		if err != nil {
-			return err
-		}
+	msgs, err := envelopeMessages(data)
+	return sb.sender(q).sendMany(ctx, msgs, err)
+}
+
+// SendManyJsonMessages sends many messages, from an array, to either the source or target.
+// Messages are sent in batches of up to Settings.BatchSize, no faster than Settings.Rate.
+//
+// If q is true, the message is sent to target.
+// If q is false, the message is sent to source.
+//
+// The message is sent in JSON format. The number of messages sent is returned, including when an error stops the operation, as in SendManyEnvelopes.
+func (sb *ServiceBusController) SendManyJsonMessages(ctx context.Context, q bool, data [][]byte) (int, error) {
+	if len(data) == 0 {
+		return 0, ErrNoMessagesToSend
 	}
-	return nil
+	return sb.sender(q).sendMany(ctx, jsonMessages(data), nil)
+}
+
+// SetSessionState replaces the state of a session of the configured source queue, or subscription. A nil state clears it.
+// ErrNoSessions is returned if the source does not require sessions.
+func (sb *ServiceBusController) SetSessionState(ctx context.Context, id string, state []byte) error {
+	err := sb.retrier.do(ctx, func() error {
+		return sb.source.setSessionState(ctx, id, state)
+	})
+	return entityError(err)
 }
 
-// SetupSourceQueue configures the queue connection, by name and whether the dead letter queue should be treated as the queue.
+// SetupSource configures the source connection, to a queue, topic or subscription, or the dead letter queue of a queue or subscription.
+// An error is returned if the Entity is not valid.
 //
-// Specifying purge as true will increase the prefetch count for faster processing of many messages.
+// Specifying purge as true will increase the prefetch count, to Settings.Prefetch, for faster processing of many messages.
+func (sb *ServiceBusController) SetupSource(e Entity, purge bool) error {
+	var err error
+	sb.source, err = sb.setupEntity(sb.client, e, purge)
+	return err
+}
+
+// SetupSourceQueue configures the queue connection, by name and whether the dead letter queue should be treated as the queue, as SetupSource.
 func (sb *ServiceBusController) SetupSourceQueue(name string, dlq, purge bool) error {
+	return sb.SetupSource(QueueEntity(name, dlq), purge)
+}
+
+// SetupTarget configures the target connection, as SetupSource.
+func (sb *ServiceBusController) SetupTarget(e Entity, purge bool) error {
 	var err error
-	sb.source, err = sb.setupQueue(name, dlq, purge)
-	sb.isSourceDlq = dlq
+	sb.target, err = sb.setupEntity(sb.targetClient, e, purge)
 	return err
 }
 
-// SetupTargetQueue configures the queue connection, by name and whether the dead letter queue should be treated as the queue.
+// SetupTargetNamespace connects the target queue to a different Service Bus namespace, using the supplied connection string.
 //
-// Specifying purge as true will increase the prefetch count for faster processing of many messages.
+// This must be called before SetupTargetQueue to take effect.
+func (sb *ServiceBusController) SetupTargetNamespace(conn string) error {
+	ns, err := sb.client.open(conn)
+	if err != nil {
+		return err
+	}
+	sb.targetClient = ns
+	return nil
+}
+
+// SetupTargetQueue configures the queue connection, by name and whether the dead letter queue should be treated as the queue, as SetupSource.
 func (sb *ServiceBusController) SetupTargetQueue(name string, dlq, purge bool) error {
-	var err error
-	sb.target, err = sb.setupQueue(name, dlq, purge)
-	sb.isTargetDlq = dlq
-	return err
+	return sb.SetupTarget(QueueEntity(name, dlq), purge)
 }
 
 // TidyMessages concurrently receives and identifies messages to be deleted based on a supplied regex pattern.
 //
-// WARNING: This operation will not delete messages by default. Provide execute as true to trigger deletion. Messages not matched are abandoned.
-func (sb *ServiceBusController) TidyMessages(errChan chan error, rex *regexp.Regexp, execute bool, total int) {
-	count := 0
-	var wg sync.WaitGroup
+// WARNING: This operation will not delete messages by default. Provide execute as true to trigger deletion. Without execute, every message is peeked.
+// With execute, messages matching the pattern are selected by peeking up to total messages, and receiving stops as described in receive.go.
+// Messages not selected are abandoned.
+//
+// Providing an archive writes each matched message to it before the message is completed, as in DeleteManyMessages.
+// Matched messages are deleted no faster than Settings.Rate.
+//
+// At most Settings.Concurrency messages are processed at once. Progress is sent every 50 messages, and for each matched message with the message attached.
+func (sb *ServiceBusController) TidyMessages(ctx context.Context, progress chan<- Progress, rex *regexp.Regexp, execute bool, total int, archive Archiver) (Progress, error) {
+	var failure firstError
+	tracker := newProgressTracker(progress, total)
+	pool := newWorkerPool(sb.settings.Concurrency)
 
-	processMessage := func(m *servicebus.Message) {
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
-		defer cancel()
-		defer wg.Done()
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		result := rex.Find(m.Data)
+	processMessage := func(m *servicebus.Message) {
+		// only matched messages are selected when executing
+		if !rex.Match(m.Data) {
+			return
+		}
 
-		if string(result) == "" {
-			if execute {
-				m.Abandon(ctx)
+		if execute {
+			if err := sb.limiter.wait(ctx); err != nil {
+				sb.settleMessage(tracker, m, false)
+				return
 			}
-			return
 		}
 
-		errChan <- fmt.Errorf(ERR_FOUNDPATTERN, string(result))
+		msg := newMessage(m)
+		tracker.matched(msg, true)
 
 		if execute {
-			m.Complete(ctx)
+			if err := sb.archiveMessage(archive, m, msg); err != nil {
+				tracker.failed()
+				failure.set(err)
+				cancel()
+				return
+			}
+			sb.settleMessage(tracker, m, true)
 		}
 	}
 
 	if execute {
-		innerCtx, cancel := context.WithCancel(sb.ctx)
-		if err := sb.source.Receive(innerCtx, servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
-			count++
-			wg.Add(1)
-			go processMessage(m)
-			if count == total {
-				wg.Wait()
-				cancel()
-			}
-			return nil
-		})); err != nil {
-			errChan <- err
-			return
-		}
-	} else {
-		opts := []servicebus.PeekOption{servicebus.PeekWithPageSize(100)}
-		messageIterator, err := sb.source.Peek(sb.ctx, opts...)
+		selected, err := sb.selectMessages(ctx, total, func(m *Message) bool { return rex.Match(m.Data) })
 		if err != nil {
-			errChan <- err
-			return
+			return tracker.snapshot(), err
 		}
+		err = sb.receiveMany(innerCtx, tracker, total, selected, func(m *servicebus.Message) bool {
+			return pool.run(innerCtx, func() { processMessage(m) })
+		})
+		// in-flight messages are settled, and their progress sent, before returning
+		pool.wait()
+		return tracker.snapshot(), operationError(ctx, failure.get(), err)
+	}
 
-		done := false
-		for !messageIterator.Done() && !done {
-			msg, err := messageIterator.Next(sb.ctx)
-			if err != nil {
-				switch err.(type) {
-				case servicebus.ErrNoMessages:
-					done = true
-					errChan <- errors.New(ERR_QUEUEEMPTY)
-					return
-				default:
-					if strings.Contains(err.Error(), "401") {
-						errChan <- errors.New(ERR_UNAUTHORISED)
-						return
-					}
-					if strings.Contains(err.Error(), "404") {
-						errChan <- errors.New(ERR_NOTFOUND)
-						return
-					}
-					errChan <- err
-					return
-				}
+	messageIterator, err := sb.peek(ctx)
+	if err != nil {
+		return tracker.snapshot(), entityError(err)
+	}
+
+	for !messageIterator.Done() {
+		msg, err := sb.next(ctx, messageIterator)
+		if err != nil {
+			pool.wait()
+			if _, ok := err.(servicebus.ErrNoMessages); ok && ctx.Err() == nil {
+				break
 			}
-			wg.Add(1)
-			go processMessage(msg)
+			return tracker.snapshot(), operationError(ctx, nil, entityError(err))
+		}
+		if !pool.run(ctx, func() { processMessage(msg) }) {
+			break
 		}
-		wg.Wait()
+		tracker.processed()
 	}
+	pool.wait()
+	return tracker.snapshot(), nil
 }
 
-func (sb *ServiceBusController) closeQueue(q *servicebus.Queue) error {
-	return q.Close(sb.ctx)
+// archiveMessage writes a message to the archive, if provided. On failure, the message is abandoned so it remains on the queue.
+func (sb *ServiceBusController) archiveMessage(archive Archiver, m *servicebus.Message, msg *Message) error {
+	if archive == nil {
+		return nil
+	}
+	if err := archive.Archive(msg); err != nil {
+		sb.abandonMessage(m)
+		return newMessageError("archive", msg, err)
+	}
+	return nil
 }
 
-func (sb *ServiceBusController) getQueueCount(q *servicebus.Queue, dlq bool) (int, error) {
-	qm := sb.client.NewQueueManager()
+// settleMessage completes, or abandons, a received message and records the outcome. Failed attempts are retried with a backoff, up to Settings.MaxAttempts,
+// unless the message's lock has been lost. Settling is not bound to an operation's context, so it completes after cancellation.
+func (sb *ServiceBusController) settleMessage(tracker *progressTracker, m *servicebus.Message, complete bool) {
+	for attempt := 1; ; attempt++ {
+		sb.retrier.wait(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), sb.settings.SettleTimeout)
+		var err error
+		if complete {
+			err = sb.source.complete(ctx, m)
+		} else {
+			err = sb.source.abandon(ctx, m)
+		}
+		cancel()
 
-	qe, err := qm.Get(sb.ctx, strings.Split(q.Name, "/")[0])
-	if err != nil {
-		return 0, err
+		switch {
+		case err == nil && complete:
+			tracker.completed()
+			return
+		case err == nil:
+			tracker.abandoned()
+			return
+		case isLockLost(err) || lockExpired(m):
+			tracker.lockLost()
+			return
+		case attempt >= sb.settings.MaxAttempts:
+			tracker.failed()
+			return
+		}
+		tracker.retried()
+		sb.retrier.retried(err)
+		time.Sleep(sb.retrier.delay(attempt))
 	}
+}
 
-	if dlq {
-		return int(*qe.CountDetails.DeadLetterMessageCount), nil
-	}
-	return int(*qe.CountDetails.ActiveMessageCount), nil
+// abandonMessage returns a message to the queue, without recording an outcome. It is used for messages received after an operation has stopped,
+// and for messages that have already failed. The abandon is not bound to an operation's context, so it completes after cancellation.
+func (sb *ServiceBusController) abandonMessage(m *servicebus.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), sb.settings.SettleTimeout)
+	defer cancel()
+	sb.source.abandon(ctx, m)
+}
+
+// lockExpired reports whether the lock on a received message has expired, so it can no longer be settled.
+func lockExpired(m *servicebus.Message) bool {
+	return m.SystemProperties != nil && m.SystemProperties.LockedUntil != nil && time.Now().After(*m.SystemProperties.LockedUntil)
+}
+
+// closeEntity closes the entity, and any sessions received from.
+func (sb *ServiceBusController) closeEntity(e entityConn) error {
+	return e.close(context.Background())
 }
 
-func (sb *ServiceBusController) sendMessage(q *servicebus.Queue, data []byte) error {
-	return q.Send(sb.ctx, &servicebus.Message{
-		Data:        data,
-		ContentType: "application/json",
+// getEntityCount returns the number of messages on an entity, from its runtime count details, retrying transient errors.
+func (sb *ServiceBusController) getEntityCount(ctx context.Context, e entityConn) (int, error) {
+	var n int
+	err := sb.retrier.do(ctx, func() error {
+		var err error
+		n, err = e.count(ctx)
+		return err
 	})
+	return n, err
 }
 
-func (sb *ServiceBusController) setupQueue(name string, dlq, purge bool) (*servicebus.Queue, error) {
-	if dlq {
-		name = fmt.Sprintf("%s/%s", name, servicebus.DeadLetterQueueName)
-	}
+// next returns the next peeked message, retrying transient errors.
+func (sb *ServiceBusController) next(ctx context.Context, it servicebus.MessageIterator) (*servicebus.Message, error) {
+	var msg *servicebus.Message
+	err := sb.retrier.do(ctx, func() error {
+		var err error
+		msg, err = it.Next(ctx)
+		return err
+	})
+	return msg, err
+}
 
-	var q *servicebus.Queue
-	var err error
+// peek starts peeking the source queue, Settings.PageSize messages at a time, retrying transient errors.
+func (sb *ServiceBusController) peek(ctx context.Context) (servicebus.MessageIterator, error) {
+	var it servicebus.MessageIterator
+	err := sb.retrier.do(ctx, func() error {
+		var err error
+		it, err = sb.source.Peek(ctx, servicebus.PeekWithPageSize(sb.settings.PageSize))
+		return err
+	})
+	return it, err
+}
 
-	if purge {
-		q, err = sb.client.NewQueue(name, servicebus.QueueWithPrefetchCount(250))
-	} else {
-		q, err = sb.client.NewQueue(name)
+// sendMessage sends a message, retrying transient errors. A message may be sent twice if the broker accepted an attempt reported as failed.
+//
+// A message body larger than Settings.MaxMessageSize is not sent, and ErrMessageTooLarge is returned.
+func (sb *ServiceBusController) sendMessage(ctx context.Context, e entityConn, m *servicebus.Message) error {
+	if err := checkMessageSize(m, sb.settings.MaxMessageSize); err != nil {
+		return err
 	}
-	if err != nil {
-		return nil, err
+	withSessionID([]*servicebus.Message{m}, e.entity().Session)
+	return sb.retrier.do(ctx, func() error { return e.Send(ctx, m) })
+}
+
+// sender returns a batchSender for the source queue, or the target queue if q is true.
+func (sb *ServiceBusController) sender(q bool) *batchSender {
+	e := sb.source
+	if q {
+		e = sb.target
+	}
+	var session string
+	if e != nil {
+		session = e.entity().Session
 	}
+	return &batchSender{
+		settings:  sb.settings,
+		limiter:   sb.limiter,
+		retrier:   sb.retrier,
+		session:   session,
+		sendBatch: func(ctx context.Context, b *messageBatch) error { return e.sendBatch(ctx, b) },
+		send:      func(ctx context.Context, m *servicebus.Message) error { return sb.sendMessage(ctx, e, m) },
+	}
+}
 
-	return q, nil
+// setupEntity connects to a queue, topic or subscription, with a prefetch count of Settings.Prefetch if purge is true.
+func (sb *ServiceBusController) setupEntity(ns namespace, e Entity, purge bool) (entityConn, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	var prefetch uint32
+	if purge {
+		prefetch = sb.settings.Prefetch
+	}
+	return ns.connect(e, prefetch, sb.settings.PageSize)
 }
@@ -1,7 +1,9 @@
 package sbcontroller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -54,7 +56,7 @@ func Test_ServiceBusController_NewServiceBusController_FakeResource(t *testing.T
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Source queue returned an unexpected count: %d", c)
 	}
@@ -82,7 +84,7 @@ func Test_ServiceBusController_NewServiceBusController_Success(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = sb.GetSourceQueueCount()
+	_, err = sb.GetSourceQueueCount(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -117,11 +119,11 @@ func Test_ServiceBusController_DisconnectQueues(t *testing.T) {
 		t.Error(err)
 	}
 
-	_, err = sb.GetSourceQueueCount()
+	_, err = sb.GetSourceQueueCount(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
-	_, err = sb.GetTargetQueueCount()
+	_, err = sb.GetTargetQueueCount(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -151,7 +153,7 @@ func Test_ServiceBusController_GetSourceQueueCount_DeadLetterQueue(t *testing.T)
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Source queue returned an unexpected count: %d", c)
 	}
@@ -183,10 +185,10 @@ func Test_ServiceBusController_ReadSourceQueue_Empty(t *testing.T) {
 		t.Error(err)
 	}
 
-	returnedMsgs := make(chan []string)
+	returnedMsgs := make(chan []*Message)
 	eChan := make(chan error)
 
-	go sb.ReadSourceQueue(returnedMsgs, eChan, 5)
+	go sb.ReadSourceQueue(context.Background(), returnedMsgs, eChan, 5)
 
 	done := false
 	for !done {
@@ -196,7 +198,7 @@ func Test_ServiceBusController_ReadSourceQueue_Empty(t *testing.T) {
 				t.Errorf("Queue unexpectedly had %d messages", len(msgs))
 			}
 		case e := <-eChan:
-			if e.Error() != ERR_QUEUEEMPTY {
+			if !errors.Is(e, ErrQueueEmpty) {
 				t.Error(err)
 			}
 			done = true
@@ -232,13 +234,13 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_OneBatch(t *test
 
 	msgBody := `{"message":"hello, world %d"}`
 	for i := 0; i < 5; i++ {
-		sb.SendJsonMessage(false, []byte(fmt.Sprintf(msgBody, i)))
+		sb.SendJsonMessage(context.Background(), false, []byte(fmt.Sprintf(msgBody, i)))
 	}
 
-	returnedMsgs := make(chan []string)
+	returnedMsgs := make(chan []*Message)
 	eChan := make(chan error)
 
-	go sb.ReadSourceQueue(returnedMsgs, eChan, 5)
+	go sb.ReadSourceQueue(context.Background(), returnedMsgs, eChan, 5)
 
 	batches := 0
 	done := false
@@ -250,13 +252,13 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_OneBatch(t *test
 			}
 
 			for i := 0; i < len(msgs); i++ {
-				if msgs[i] != fmt.Sprintf(msgBody, i) {
-					t.Errorf("Unexpected message body: %s", msgs[i])
+				if string(msgs[i].Data) != fmt.Sprintf(msgBody, i) {
+					t.Errorf("Unexpected message body: %s", msgs[i].Data)
 				}
 			}
 			batches++
 		case e := <-eChan:
-			if e.Error() != ERR_QUEUEEMPTY {
+			if !errors.Is(e, ErrQueueEmpty) {
 				t.Error(e)
 			}
 			done = true
@@ -270,7 +272,7 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_OneBatch(t *test
 	}
 
 	for i := 0; i < 5; i++ {
-		err = sb.DeleteOneMessage()
+		err = sb.DeleteOneMessage(context.Background())
 		if err != nil {
 			t.Error(err)
 		}
@@ -301,13 +303,13 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_MultipleBatches(
 
 	msgBody := `{"message":"hello, world %d"}`
 	for i := 0; i < 10; i++ {
-		sb.SendJsonMessage(false, []byte(fmt.Sprintf(msgBody, i)))
+		sb.SendJsonMessage(context.Background(), false, []byte(fmt.Sprintf(msgBody, i)))
 	}
 
-	returnedMsgs := make(chan []string)
+	returnedMsgs := make(chan []*Message)
 	eChan := make(chan error)
 
-	go sb.ReadSourceQueue(returnedMsgs, eChan, 5)
+	go sb.ReadSourceQueue(context.Background(), returnedMsgs, eChan, 5)
 
 	batches := 0
 	i := 0
@@ -320,14 +322,14 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_MultipleBatches(
 			}
 
 			for j := 0; j < len(msgs); j++ {
-				if msgs[j] != fmt.Sprintf(msgBody, i) {
-					t.Errorf("Unexpected message body: %s", msgs[j])
+				if string(msgs[j].Data) != fmt.Sprintf(msgBody, i) {
+					t.Errorf("Unexpected message body: %s", msgs[j].Data)
 				}
 				i++
 			}
 			batches++
 		case e := <-eChan:
-			if e.Error() != ERR_QUEUEEMPTY {
+			if !errors.Is(e, ErrQueueEmpty) {
 				t.Error(e)
 			}
 			done = true
@@ -341,7 +343,7 @@ func Test_ServiceBusController_ReadSourceQueue_MultipleMessages_MultipleBatches(
 	}
 
 	for i := 0; i < 10; i++ {
-		err = sb.DeleteOneMessage()
+		err = sb.DeleteOneMessage(context.Background())
 		if err != nil {
 			t.Error(err)
 		}
@@ -370,7 +372,7 @@ func Test_ServiceBusController_Send_And_Delete_One(t *testing.T) {
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -378,12 +380,12 @@ func Test_ServiceBusController_Send_And_Delete_One(t *testing.T) {
 		t.Error()
 	}
 
-	err = sb.SendJsonMessage(false, []byte("hello world"))
+	err = sb.SendJsonMessage(context.Background(), false, []byte("hello world"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 1 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -391,12 +393,12 @@ func Test_ServiceBusController_Send_And_Delete_One(t *testing.T) {
 		t.Error()
 	}
 
-	err = sb.DeleteOneMessage()
+	err = sb.DeleteOneMessage(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -425,7 +427,7 @@ func Test_ServiceBusController_Send_And_Delete_Many(t *testing.T) {
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -439,12 +441,12 @@ func Test_ServiceBusController_Send_And_Delete_Many(t *testing.T) {
 		sendMessages = append(sendMessages, []byte(`{"hello":"world"}`))
 	}
 
-	err = sb.SendManyJsonMessages(false, sendMessages)
+	_, err = sb.SendManyJsonMessages(context.Background(), false, sendMessages)
 	if err != nil {
 		t.Error()
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != messageCount {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -452,26 +454,17 @@ func Test_ServiceBusController_Send_And_Delete_Many(t *testing.T) {
 		t.Error()
 	}
 
-	eChan := make(chan error)
-	go sb.DeleteManyMessages(eChan, c, false)
-
-	done := false
-	for !done {
-		e := <-eChan
-		if strings.Contains(e.Error(), "[status]") {
-			continue
-		}
-		if e.Error() != "context canceled" {
-			t.Error(e)
-		}
-		done = true
+	p, err := sb.DeleteManyMessages(context.Background(), nil, c, nil, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if p.Completed != c {
+		t.Errorf("Unexpected number of messages deleted: %d", p.Completed)
 	}
-
-	close(eChan)
 
 	time.Sleep(2 * time.Second)
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -505,7 +498,7 @@ func Test_ServiceBusController_Send_And_Delete_Trigger_Status(t *testing.T) {
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -519,12 +512,12 @@ func Test_ServiceBusController_Send_And_Delete_Trigger_Status(t *testing.T) {
 		sendMessages = append(sendMessages, []byte(`{"hello":"world"}`))
 	}
 
-	err = sb.SendManyJsonMessages(false, sendMessages)
+	_, err = sb.SendManyJsonMessages(context.Background(), false, sendMessages)
 	if err != nil {
 		t.Error()
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != messageCount {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -532,26 +525,17 @@ func Test_ServiceBusController_Send_And_Delete_Trigger_Status(t *testing.T) {
 		t.Error()
 	}
 
-	eChan := make(chan error)
-	go sb.DeleteManyMessages(eChan, c, false)
-
-	done := false
-	for !done {
-		e := <-eChan
-		if strings.Contains(e.Error(), "[status]") {
-			continue
-		}
-		if e.Error() != "context canceled" {
-			t.Error(e)
-		}
-		done = true
+	p, err := sb.DeleteManyMessages(context.Background(), nil, c, nil, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if p.Completed != c {
+		t.Errorf("Unexpected number of messages deleted: %d", p.Completed)
 	}
-
-	close(eChan)
 
 	time.Sleep(2 * time.Second)
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -583,7 +567,7 @@ func Test_ServiceBusController_TidyMessages_Success(t *testing.T) {
 		t.Error(err)
 	}
 
-	c, err := sb.GetSourceQueueCount()
+	c, err := sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -592,14 +576,14 @@ func Test_ServiceBusController_TidyMessages_Success(t *testing.T) {
 	}
 
 	for i := 0; i < 2; i++ {
-		err = sb.SendJsonMessage(false, []byte("abbc"))
+		err = sb.SendJsonMessage(context.Background(), false, []byte("abbc"))
 		if err != nil {
 			t.Error(err)
 		}
 
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 2 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -613,22 +597,12 @@ func Test_ServiceBusController_TidyMessages_Success(t *testing.T) {
 	}
 
 	// test without execute flag
-	eChan := make(chan error)
-	go sb.TidyMessages(eChan, rx, false, c)
-
-	done := false
-	for !done {
-		e := <-eChan
-		if strings.Contains(e.Error(), "[status]") {
-			continue
-		}
-		if e.Error() != "context canceled" && e.Error() != ERR_QUEUEEMPTY {
-			t.Error(e)
-		}
-		done = true
+	p, err := sb.TidyMessages(context.Background(), nil, rx, false, c, nil)
+	if err != nil || p.Matched != 2 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
 	}
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 2 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
@@ -637,25 +611,14 @@ func Test_ServiceBusController_TidyMessages_Success(t *testing.T) {
 	}
 
 	// test with execute flag
-	go sb.TidyMessages(eChan, rx, true, c)
-
-	done = false
-	for !done {
-		e := <-eChan
-		if strings.Contains(e.Error(), "[status]") {
-			continue
-		}
-		if e.Error() != "context canceled" {
-			t.Error(e)
-		}
-		done = true
+	p, err = sb.TidyMessages(context.Background(), nil, rx, true, c, nil)
+	if err != nil || p.Completed != 2 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
 	}
 
-	close(eChan)
-
 	time.Sleep(2 * time.Second)
 
-	c, err = sb.GetSourceQueueCount()
+	c, err = sb.GetSourceQueueCount(context.Background())
 	if c != 0 {
 		t.Errorf("Unexpected queue count: %d", c)
 	}
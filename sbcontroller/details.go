@@ -0,0 +1,294 @@
+package sbcontroller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+// The Type of EntityDetails.
+const (
+	TypeQueue        string = "queue"
+	TypeTopic        string = "topic"
+	TypeSubscription string = "subscription"
+)
+
+// EntityDetails is a report of the runtime state and configuration of a queue, topic or subscription, as returned by Controller.GetSourceDetails.
+//
+// A setting not reported by Service Bus for the kind of entity, e.g. MaxSizeInBytes for a subscription, is zero.
+type EntityDetails struct {
+	Entity                     string   `json:"entity"`
+	Type                       string   `json:"type"`
+	Status                     string   `json:"status,omitempty"`
+	ActiveMessages             int64    `json:"activeMessages"`
+	DeadLetterMessages         int64    `json:"deadLetterMessages"`
+	ScheduledMessages          int64    `json:"scheduledMessages"`
+	TransferMessages           int64    `json:"transferMessages"`
+	TransferDeadLetterMessages int64    `json:"transferDeadLetterMessages"`
+	SizeInBytes                int64    `json:"sizeInBytes"`
+	MaxSizeInBytes             int64    `json:"maxSizeInBytes,omitempty"`
+	LockDuration               Duration `json:"lockDuration,omitempty"`
+	MaxDeliveryCount           int32    `json:"maxDeliveryCount,omitempty"`
+	DefaultMessageTTL          Duration `json:"defaultMessageTtl,omitempty"`
+	// DuplicateDetectionWindow is zero if duplicate detection is not enabled.
+	DuplicateDetectionWindow      Duration `json:"duplicateDetectionWindow,omitempty"`
+	RequiresSession               bool     `json:"requiresSession"`
+	ForwardTo                     string   `json:"forwardTo,omitempty"`
+	ForwardDeadLetteredMessagesTo string   `json:"forwardDeadLetteredMessagesTo,omitempty"`
+	// LastAccessed is only reported by Service Bus for subscriptions.
+	LastAccessed *time.Time `json:"lastAccessed,omitempty"`
+}
+
+// Duration is a time.Duration written to JSON as a string, e.g. "1m0s". The largest duration, used by Service Bus when a duration is not limited, is written as "unlimited".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	if d == math.MaxInt64 {
+		return "unlimited"
+	}
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// listPageSize is the number of entities fetched by each call listing queues, topics or subscriptions, the most returned by Service Bus.
+const listPageSize = 100
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an ISO 8601 duration, as reported by Service Bus, e.g. "PT1M" or "P14D". A duration too large for a time.Duration,
+// e.g. the TimeSpan.MaxValue reported for an unlimited time to live, is the largest Duration.
+func parseISODuration(s string) (Duration, error) {
+	parts := isoDuration.FindStringSubmatch(s)
+	if parts == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid ISO 8601 duration '%s'", s)
+	}
+	seconds := 0.0
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if parts[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(parts[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ISO 8601 duration '%s'", s)
+		}
+		seconds += v * unit
+	}
+	if seconds*float64(time.Second) >= math.MaxInt64 {
+		return math.MaxInt64, nil
+	}
+	return Duration(seconds * float64(time.Second)), nil
+}
+
+// describe fetches the runtime details of the entity. A dead letter queue is described by its queue or subscription.
+func (e *serviceBusEntity) describe(ctx context.Context) (EntityDetails, error) {
+	switch {
+	case e.Queue != "":
+		q, err := e.ns.NewQueueManager().Get(ctx, e.Queue)
+		if err != nil {
+			return EntityDetails{}, err
+		}
+		return queueDetails(e.Queue, q.QueueDescription)
+	case e.Subscription != "":
+		s, err := e.topic.NewSubscriptionManager().Get(ctx, e.Subscription)
+		if err != nil {
+			return EntityDetails{}, err
+		}
+		return subscriptionDetails(e.Topic, e.Subscription, s.SubscriptionDescription)
+	}
+	t, err := e.ns.NewTopicManager().Get(ctx, e.Topic)
+	if err != nil {
+		return EntityDetails{}, err
+	}
+	return topicDetails(e.Topic, t.TopicDescription)
+}
+
+// list fetches the details of every queue, topic and subscription in the namespace, a page at a time. Listing requires the Manage right.
+func (ns serviceBusNamespace) list(ctx context.Context, r *retrier) ([]EntityDetails, error) {
+	details := []EntityDetails{}
+	add := func(d EntityDetails, err error) error {
+		if err != nil {
+			return err
+		}
+		details = append(details, d)
+		return nil
+	}
+
+	queues, err := listPages(ctx, r, func(skip, top int) ([]*servicebus.QueueEntity, error) {
+		return ns.NewQueueManager().List(ctx, servicebus.ListQueuesWithSkip(skip), servicebus.ListQueuesWithTop(top))
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range queues {
+		if err := add(queueDetails(q.Name, q.QueueDescription)); err != nil {
+			return nil, err
+		}
+	}
+
+	topics, err := listPages(ctx, r, func(skip, top int) ([]*servicebus.TopicEntity, error) {
+		return ns.NewTopicManager().List(ctx, servicebus.ListTopicsWithSkip(skip), servicebus.ListTopicsWithTop(top))
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range topics {
+		if err := add(topicDetails(t.Name, t.TopicDescription)); err != nil {
+			return nil, err
+		}
+		sm, err := ns.NewSubscriptionManager(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		subs, err := listPages(ctx, r, func(skip, top int) ([]*servicebus.SubscriptionEntity, error) {
+			return sm.List(ctx, servicebus.ListSubscriptionsWithSkip(skip), servicebus.ListSubscriptionsWithTop(top))
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range subs {
+			if err := add(subscriptionDetails(t.Name, s.Name, s.SubscriptionDescription)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return details, nil
+}
+
+func queueDetails(name string, q *servicebus.QueueDescription) (EntityDetails, error) {
+	d := EntityDetails{
+		Entity:                        name,
+		Type:                          TypeQueue,
+		SizeInBytes:                   valueOf(q.SizeInBytes),
+		MaxSizeInBytes:                int64(valueOf(q.MaxSizeInMegabytes)) * 1024 * 1024,
+		MaxDeliveryCount:              valueOf(q.MaxDeliveryCount),
+		RequiresSession:               valueOf(q.RequiresSession),
+		ForwardTo:                     valueOf(q.ForwardTo),
+		ForwardDeadLetteredMessagesTo: valueOf(q.ForwardDeadLetteredMessagesTo),
+	}
+	var window *string
+	if valueOf(q.RequiresDuplicateDetection) {
+		window = q.DuplicateDetectionHistoryTimeWindow
+	}
+	return d, d.setRuntime(q.Status, q.CountDetails, q.LockDuration, q.DefaultMessageTimeToLive, window)
+}
+
+func subscriptionDetails(topic, name string, s *servicebus.SubscriptionDescription) (EntityDetails, error) {
+	d := EntityDetails{
+		Entity:                        Entity{Topic: topic, Subscription: name}.String(),
+		Type:                          TypeSubscription,
+		MaxDeliveryCount:              valueOf(s.MaxDeliveryCount),
+		RequiresSession:               valueOf(s.RequiresSession),
+		ForwardTo:                     valueOf(s.ForwardTo),
+		ForwardDeadLetteredMessagesTo: valueOf(s.ForwardDeadLetteredMessagesTo),
+	}
+	if s.AccessedAt != nil {
+		accessed := s.AccessedAt.Time
+		d.LastAccessed = &accessed
+	}
+	return d, d.setRuntime(s.Status, s.CountDetails, s.LockDuration, s.DefaultMessageTimeToLive, nil)
+}
+
+func topicDetails(name string, t *servicebus.TopicDescription) (EntityDetails, error) {
+	d := EntityDetails{
+		Entity:         name,
+		Type:           TypeTopic,
+		SizeInBytes:    valueOf(t.SizeInBytes),
+		MaxSizeInBytes: int64(valueOf(t.MaxSizeInMegabytes)) * 1024 * 1024,
+	}
+	var window *string
+	if valueOf(t.RequiresDuplicateDetection) {
+		window = t.DuplicateDetectionHistoryTimeWindow
+	}
+	return d, d.setRuntime(t.Status, t.CountDetails, nil, t.DefaultMessageTimeToLive, window)
+}
+
+// setRuntime sets the status, counts and durations shared by each kind of entity description. Durations not set are left as zero.
+func (d *EntityDetails) setRuntime(status *servicebus.EntityStatus, counts *servicebus.CountDetails, lock, ttl, window *string) error {
+	if status != nil {
+		d.Status = string(*status)
+	}
+	if counts != nil {
+		d.ActiveMessages = int64(valueOf(counts.ActiveMessageCount))
+		d.DeadLetterMessages = int64(valueOf(counts.DeadLetterMessageCount))
+		d.ScheduledMessages = int64(valueOf(counts.ScheduledMessageCount))
+		d.TransferMessages = int64(valueOf(counts.TransferMessageCount))
+		d.TransferDeadLetterMessages = int64(valueOf(counts.TransferDeadLetterMessageCount))
+	}
+	for _, f := range []struct {
+		s *string
+		d *Duration
+	}{{lock, &d.LockDuration}, {ttl, &d.DefaultMessageTTL}, {window, &d.DuplicateDetectionWindow}} {
+		if f.s == nil {
+			continue
+		}
+		v, err := parseISODuration(*f.s)
+		if err != nil {
+			return err
+		}
+		*f.d = v
+	}
+	return nil
+}
+
+// valueOf returns the value of an optional field of an entity description, or the zero value if it is not set.
+func valueOf[T any](p *T) T {
+	var v T
+	if p != nil {
+		v = *p
+	}
+	return v
+}
+
+// checkPattern returns an error if a glob pattern of entity paths, as used by Controller.ListEntities, is malformed.
+func checkPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid entity pattern '%s': %w", pattern, err)
+	}
+	return nil
+}
+
+// matchPattern reports whether an entity path matches a glob pattern. An empty pattern matches every entity.
+func matchPattern(pattern, entity string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, entity)
+	return ok
+}
+
+// listPages calls list for each page of a management listing, retrying transient errors, until a page is not full.
+func listPages[T any](ctx context.Context, r *retrier, list func(skip, top int) ([]T, error)) ([]T, error) {
+	var all []T
+	for skip := 0; ; skip += listPageSize {
+		var page []T
+		err := r.do(ctx, func() error {
+			var err error
+			page, err = list(skip, listPageSize)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < listPageSize {
+			return all, nil
+		}
+	}
+}
+
+// sortDetails sorts entity details by path.
+func sortDetails(details []EntityDetails) {
+	sort.Slice(details, func(i, j int) bool {
+		return details[i].Entity < details[j].Entity
+	})
+}
@@ -0,0 +1,102 @@
+package sbcontroller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_ParseISODuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"PT1M":                        time.Minute,
+		"PT30S":                       30 * time.Second,
+		"PT0.5S":                      500 * time.Millisecond,
+		"P14D":                        14 * 24 * time.Hour,
+		"P1DT2H3M4S":                  26*time.Hour + 3*time.Minute + 4*time.Second,
+		"P10675199DT2H48M5.4775807S":  math.MaxInt64,
+		"P9999999DT23H59M59.9999999S": math.MaxInt64,
+	}
+	for s, expected := range tests {
+		d, err := parseISODuration(s)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", s, err)
+			continue
+		}
+		if time.Duration(d) != expected {
+			t.Errorf("Unexpected duration for %s: %v", s, time.Duration(d))
+		}
+	}
+
+	for _, s := range []string{"", "P", "PT", "1M", "PT1X", "P1H"} {
+		if _, err := parseISODuration(s); err == nil {
+			t.Errorf("Expected error for '%s'", s)
+		}
+	}
+}
+
+func Test_EntityDetails_MarshalJSON(t *testing.T) {
+	d := EntityDetails{Entity: "orders", ActiveMessages: 3, LockDuration: Duration(time.Minute), DefaultMessageTTL: math.MaxInt64}
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["lockDuration"] != "1m0s" || out["defaultMessageTtl"] != "unlimited" || out["activeMessages"] != float64(3) {
+		t.Errorf("Unexpected JSON: %s", b)
+	}
+	if _, ok := out["duplicateDetectionWindow"]; ok {
+		t.Errorf("Unexpected duplicate detection window: %s", b)
+	}
+	if _, ok := out["lastAccessed"]; ok {
+		t.Errorf("Unexpected last accessed time: %s", b)
+	}
+}
+
+func Test_MatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, entity string
+		match           bool
+	}{
+		{"", "orders", true},
+		{"orders-*", "orders-eu", true},
+		{"orders-*", "payments", false},
+		{"events/subscriptions/*", "events/subscriptions/audit", true},
+		{"events*", "events/subscriptions/audit", false},
+	}
+	for _, tt := range tests {
+		if matchPattern(tt.pattern, tt.entity) != tt.match {
+			t.Errorf("Unexpected match of '%s' against '%s'", tt.pattern, tt.entity)
+		}
+	}
+	if err := checkPattern("orders-["); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
+
+func Test_ListPages(t *testing.T) {
+	names := make([]int, 250)
+	calls := 0
+	all, err := listPages(context.Background(), helper_newRetrier(3), func(skip, top int) ([]int, error) {
+		calls++
+		if calls == 2 {
+			return nil, errors.New("com.microsoft:server-busy")
+		}
+		end := skip + top
+		if end > len(names) {
+			end = len(names)
+		}
+		return names[skip:end], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 250 || calls != 4 {
+		t.Errorf("Unexpected listing: %d entities in %d calls", len(all), calls)
+	}
+}
@@ -0,0 +1,339 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+const (
+	ERR_SUBSCRIPTIONSEND string = "cannot send messages directly to a subscription, send to its topic"
+	ERR_TOPICRECEIVE     string = "cannot receive messages from a topic, provide a subscription"
+)
+
+// Entity identifies a Service Bus entity: a queue, a topic, or a subscription to a topic.
+// DeadLetter treats the dead letter queue of a queue or subscription as the entity.
+//
+// Messages are received from queues and subscriptions, and sent to queues and topics.
+type Entity struct {
+	Queue        string
+	Topic        string
+	Subscription string
+	DeadLetter   bool
+	// Session limits receiving from a session-enabled queue or subscription to a single session, and is stamped onto messages sent without a SessionID.
+	Session string
+}
+
+// QueueEntity returns the Entity for a queue, or its dead letter queue.
+func QueueEntity(name string, dlq bool) Entity {
+	return Entity{Queue: name, DeadLetter: dlq}
+}
+
+// Validate returns an error unless the entity is exactly one of a queue, a topic, or a subscription to a topic.
+func (e Entity) Validate() error {
+	switch {
+	case e.Queue != "" && (e.Topic != "" || e.Subscription != ""):
+		return errors.New("provide either a queue, or a topic and subscription, not both")
+	case e.Queue == "" && e.Topic == "" && e.Subscription != "":
+		return fmt.Errorf("subscription '%s' requires a topic", e.Subscription)
+	case e.Queue == "" && e.Topic == "":
+		return errors.New("a queue or topic is required")
+	case e.DeadLetter && e.Queue == "" && e.Subscription == "":
+		return fmt.Errorf("topic '%s' has no dead letter queue, provide a subscription", e.Topic)
+	case e.DeadLetter && e.Session != "":
+		return errors.New("dead letter queues do not have sessions")
+	}
+	return nil
+}
+
+// CanReceive reports whether messages can be received from the entity, i.e. it is a queue or a subscription.
+func (e Entity) CanReceive() bool {
+	return e.Queue != "" || e.Subscription != ""
+}
+
+// CanSend reports whether messages can be sent to the entity, i.e. it is a queue or a topic, and not a dead letter queue.
+func (e Entity) CanSend() bool {
+	return !e.DeadLetter && (e.Queue != "" || e.Subscription == "")
+}
+
+// String returns the entity's path within its namespace, e.g. 'orders', 'events/subscriptions/audit' or 'orders/$DeadLetterQueue'.
+func (e Entity) String() string {
+	if e.DeadLetter {
+		return fmt.Sprintf("%s/%s", e.path(), servicebus.DeadLetterQueueName)
+	}
+	return e.path()
+}
+
+// FileName returns a name for the entity suitable for file names: the queue or topic name, or '<topic>_<subscription>'.
+func (e Entity) FileName() string {
+	if e.Subscription != "" {
+		return fmt.Sprintf("%s_%s", e.Topic, e.Subscription)
+	}
+	if e.Queue != "" {
+		return e.Queue
+	}
+	return e.Topic
+}
+
+// path returns the entity's path, excluding its dead letter queue.
+func (e Entity) path() string {
+	switch {
+	case e.Queue != "":
+		return e.Queue
+	case e.Subscription != "":
+		return strings.Join([]string{e.Topic, "subscriptions", e.Subscription}, "/")
+	}
+	return e.Topic
+}
+
+// namespace connects to the entities of a namespace. It is implemented by serviceBusNamespace, and by Broker for an in-memory namespace,
+// so ServiceBusController runs the same operations against either.
+type namespace interface {
+	// connect returns a connection to an entity, receiving up to prefetch messages at a time, and peeking pageSize messages at a time.
+	connect(e Entity, prefetch uint32, pageSize int) (entityConn, error)
+	// list returns the details of every queue, topic and subscription in the namespace, retrying transient errors.
+	list(ctx context.Context, r *retrier) ([]EntityDetails, error)
+	// open returns another namespace, reached by a connection string.
+	open(conn string) (namespace, error)
+}
+
+// entityConn is a connection to a queue, topic or subscription, or a dead letter queue, as returned by namespace.connect.
+//
+// Messages received through an entityConn are settled through it, as settling an in-memory message cannot go through servicebus.Message.
+type entityConn interface {
+	entity() Entity
+	Receive(ctx context.Context, handler servicebus.Handler) error
+	ReceiveOne(ctx context.Context, handler servicebus.Handler) error
+	Peek(ctx context.Context, options ...servicebus.PeekOption) (servicebus.MessageIterator, error)
+	Send(ctx context.Context, m *servicebus.Message) error
+	sendBatch(ctx context.Context, b *messageBatch) error
+	complete(ctx context.Context, m *servicebus.Message) error
+	abandon(ctx context.Context, m *servicebus.Message) error
+	describe(ctx context.Context) (EntityDetails, error)
+	count(ctx context.Context) (int, error)
+	sessionState(ctx context.Context, id string) ([]byte, error)
+	setSessionState(ctx context.Context, id string, state []byte) error
+	close(ctx context.Context) error
+}
+
+// serviceBusNamespace is a namespace on Service Bus.
+type serviceBusNamespace struct {
+	*servicebus.Namespace
+}
+
+// newServiceBusNamespace connects to a Service Bus namespace using a connection string.
+func newServiceBusNamespace(conn string) (namespace, error) {
+	ns, err := servicebus.NewNamespace(servicebus.NamespaceWithConnectionString(conn))
+	if err != nil {
+		return nil, err
+	}
+	return serviceBusNamespace{ns}, nil
+}
+
+func (ns serviceBusNamespace) open(conn string) (namespace, error) {
+	return newServiceBusNamespace(conn)
+}
+
+// connect connects to a queue, topic or subscription. A subscription, or dead letter queue, is connected by its path, as a queue is.
+// A prefetch of 0 leaves the prefetch count at the library's default.
+func (ns serviceBusNamespace) connect(e Entity, prefetch uint32, pageSize int) (entityConn, error) {
+	entity := &serviceBusEntity{Entity: e, ns: ns.Namespace, pageSize: pageSize}
+
+	if e.Queue != "" {
+		opts := []servicebus.QueueOption{}
+		if prefetch > 0 {
+			opts = append(opts, servicebus.QueueWithPrefetchCount(prefetch))
+		}
+		q, err := ns.NewQueue(e.String(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		entity.receiver, entity.closer = q, q
+		if !e.DeadLetter {
+			entity.sender = q
+			entity.openSession = func(id *string) sessionReceiver { return q.NewSession(id) }
+		}
+		return entity, nil
+	}
+
+	t, err := ns.NewTopic(e.Topic)
+	if err != nil {
+		return nil, err
+	}
+	entity.topic = t
+	if e.Subscription == "" {
+		entity.sender, entity.closer = topicSender{t}, t
+		return entity, nil
+	}
+
+	name := e.Subscription
+	if e.DeadLetter {
+		name = fmt.Sprintf("%s/%s", name, servicebus.DeadLetterQueueName)
+	}
+	opts := []servicebus.SubscriptionOption{}
+	if prefetch > 0 {
+		opts = append(opts, servicebus.SubscriptionWithPrefetchCount(prefetch))
+	}
+	s, err := t.NewSubscription(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	entity.receiver, entity.closer = s, s
+	if !e.DeadLetter {
+		entity.openSession = func(id *string) sessionReceiver { return s.NewSession(id) }
+	}
+	return entity, nil
+}
+
+// entityReceiver is implemented by a servicebus.Queue and servicebus.Subscription.
+type entityReceiver interface {
+	Receive(ctx context.Context, handler servicebus.Handler) error
+	ReceiveOne(ctx context.Context, handler servicebus.Handler) error
+	Peek(ctx context.Context, options ...servicebus.PeekOption) (servicebus.MessageIterator, error)
+}
+
+// entitySender is implemented by a servicebus.Queue, and a servicebus.Topic through topicSender.
+type entitySender interface {
+	Send(ctx context.Context, m *servicebus.Message) error
+	SendBatch(ctx context.Context, iterator servicebus.BatchIterator) error
+}
+
+// entityCloser is implemented by a servicebus.Queue, servicebus.Topic and servicebus.Subscription.
+type entityCloser interface {
+	Close(ctx context.Context) error
+}
+
+// topicSender adapts Topic.Send, which accepts send options, to entitySender.
+type topicSender struct {
+	*servicebus.Topic
+}
+
+func (t topicSender) Send(ctx context.Context, m *servicebus.Message) error {
+	return t.Topic.Send(ctx, m)
+}
+
+// serviceBusEntity is a connection to a queue, topic or subscription.
+//
+// Receiving from a topic returns ErrTopicReceive. Sending to a subscription returns ErrSubscriptionSend, and to a dead letter queue, ErrDeadLetterSend.
+// Receiving from a session-enabled queue or subscription receives from each of its sessions in turn, as described in session.go.
+type serviceBusEntity struct {
+	Entity
+	ns       *servicebus.Namespace
+	topic    *servicebus.Topic
+	receiver entityReceiver
+	sender   entitySender
+	closer   entityCloser
+	// openSession is nil for topics and dead letter queues, which do not have sessions
+	openSession sessionOpener
+	pageSize    int
+
+	mu              sync.Mutex
+	requiresSession *bool
+	sessions        []sessionReceiver
+}
+
+func (e *serviceBusEntity) entity() Entity {
+	return e.Entity
+}
+
+func (e *serviceBusEntity) Receive(ctx context.Context, handler servicebus.Handler) error {
+	if e.receiver == nil {
+		return ErrTopicReceive
+	}
+	sessions, err := e.usesSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if sessions {
+		_, err := e.receiveSessions(ctx, handler, 0)
+		return err
+	}
+	return e.receiver.Receive(ctx, handler)
+}
+
+func (e *serviceBusEntity) ReceiveOne(ctx context.Context, handler servicebus.Handler) error {
+	if e.receiver == nil {
+		return ErrTopicReceive
+	}
+	sessions, err := e.usesSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if sessions {
+		n, err := e.receiveSessions(ctx, handler, 1)
+		if err == nil && n == 0 {
+			return ErrQueueEmpty
+		}
+		return err
+	}
+	return e.receiver.ReceiveOne(ctx, handler)
+}
+
+// Peek peeks every message on the entity, or only the messages of Entity.Session.
+func (e *serviceBusEntity) Peek(ctx context.Context, options ...servicebus.PeekOption) (servicebus.MessageIterator, error) {
+	if e.receiver == nil {
+		return nil, ErrTopicReceive
+	}
+	it, err := e.receiver.Peek(ctx, options...)
+	if err != nil || e.Session == "" {
+		return it, err
+	}
+	return &sessionIterator{MessageIterator: it, session: e.Session}, nil
+}
+
+func (e *serviceBusEntity) Send(ctx context.Context, m *servicebus.Message) error {
+	if err := e.canSend(); err != nil {
+		return err
+	}
+	return e.sender.Send(ctx, m)
+}
+
+func (e *serviceBusEntity) sendBatch(ctx context.Context, b *messageBatch) error {
+	if err := e.canSend(); err != nil {
+		return err
+	}
+	return e.sender.SendBatch(ctx, &batchIterator{batch: b.batch})
+}
+
+func (e *serviceBusEntity) canSend() error {
+	if e.sender != nil {
+		return nil
+	}
+	if e.DeadLetter {
+		return ErrDeadLetterSend
+	}
+	return ErrSubscriptionSend
+}
+
+func (e *serviceBusEntity) complete(ctx context.Context, m *servicebus.Message) error {
+	return m.Complete(ctx)
+}
+
+func (e *serviceBusEntity) abandon(ctx context.Context, m *servicebus.Message) error {
+	return m.Abandon(ctx)
+}
+
+// close closes the entity, and any sessions received from.
+func (e *serviceBusEntity) close(ctx context.Context) error {
+	return errors.Join(e.closeSessions(ctx), e.closer.Close(ctx))
+}
+
+// count returns the number of active messages on the entity, or on its dead letter queue. The messages of Entity.Session are counted by peeking them.
+func (e *serviceBusEntity) count(ctx context.Context) (int, error) {
+	if e.Session != "" && e.receiver != nil {
+		counts, _, err := e.sessionCounts(ctx)
+		return counts[e.Session], err
+	}
+	d, err := e.describe(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if e.DeadLetter {
+		return int(d.DeadLetterMessages), nil
+	}
+	return int(d.ActiveMessages), nil
+}
@@ -0,0 +1,55 @@
+package sbcontroller
+
+import "testing"
+
+func Test_Entity_Validate(t *testing.T) {
+	valid := []Entity{
+		QueueEntity("orders", false),
+		QueueEntity("orders", true),
+		{Topic: "events"},
+		{Topic: "events", Subscription: "audit"},
+		{Topic: "events", Subscription: "audit", DeadLetter: true},
+	}
+	for _, e := range valid {
+		if err := e.Validate(); err != nil {
+			t.Errorf("Unexpected error for %+v: %v", e, err)
+		}
+	}
+
+	invalid := []Entity{
+		{},
+		{DeadLetter: true},
+		{Queue: "orders", Topic: "events"},
+		{Queue: "orders", Subscription: "audit"},
+		{Subscription: "audit"},
+		{Topic: "events", DeadLetter: true},
+		{Queue: "orders", DeadLetter: true, Session: "a"},
+	}
+	for _, e := range invalid {
+		if err := e.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", e)
+		}
+	}
+}
+
+func Test_Entity_Capabilities(t *testing.T) {
+	tests := []struct {
+		e              Entity
+		receive, send  bool
+		path, fileName string
+	}{
+		{QueueEntity("orders", false), true, true, "orders", "orders"},
+		{QueueEntity("orders", true), true, false, "orders/$DeadLetterQueue", "orders"},
+		{Entity{Topic: "events"}, false, true, "events", "events"},
+		{Entity{Topic: "events", Subscription: "audit"}, true, false, "events/subscriptions/audit", "events_audit"},
+		{Entity{Topic: "events", Subscription: "audit", DeadLetter: true}, true, false, "events/subscriptions/audit/$DeadLetterQueue", "events_audit"},
+	}
+	for _, tt := range tests {
+		if tt.e.CanReceive() != tt.receive || tt.e.CanSend() != tt.send {
+			t.Errorf("Unexpected capabilities for %+v: receive %v, send %v", tt.e, tt.e.CanReceive(), tt.e.CanSend())
+		}
+		if tt.e.String() != tt.path || tt.e.FileName() != tt.fileName {
+			t.Errorf("Unexpected names for %+v: %s, %s", tt.e, tt.e.String(), tt.e.FileName())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+// Sentinel errors returned by Controller implementations. Compare using errors.Is.
+var (
+	ErrDeadLetterSend   = errors.New(ERR_DEADLETTERSEND)
+	ErrEnvelopeBody     = errors.New(ERR_ENVELOPEBODY)
+	ErrLockLost         = errors.New(ERR_LOCKLOST)
+	ErrMessageTooLarge  = errors.New(ERR_MESSAGETOOLARGE)
+	ErrNoMessagesToSend = errors.New(ERR_NOMESSAGESTOSEND)
+	ErrNoQueueObject    = errors.New(ERR_NOQUEUEOBJECT)
+	ErrNoSessions       = errors.New(ERR_NOSESSIONS)
+	ErrNotFound         = errors.New(ERR_NOTFOUND)
+	ErrQueueEmpty       = errors.New(ERR_QUEUEEMPTY)
+	ErrSessionRequired  = errors.New(ERR_SESSIONREQUIRED)
+	ErrSubscriptionSend = errors.New(ERR_SUBSCRIPTIONSEND)
+	ErrTopicReceive     = errors.New(ERR_TOPICRECEIVE)
+	ErrUnauthorised     = errors.New(ERR_UNAUTHORISED)
+)
+
+// MessageError reports a failure to act on a single message, e.g. to archive, transform or send it. Retrieve using errors.As.
+type MessageError struct {
+	// Op is the action that failed, e.g. "archive".
+	Op             string
+	MessageID      string
+	SequenceNumber int64
+	Err            error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("could not %s message %s: %v", e.Op, e.MessageID, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+func newMessageError(op string, m *Message, err error) *MessageError {
+	return &MessageError{Op: op, MessageID: m.ID, SequenceNumber: m.SequenceNumber, Err: err}
+}
+
+// entityError converts a Service Bus error reporting an inaccessible or missing entity into ErrUnauthorised or ErrNotFound.
+func entityError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "401") {
+		return ErrUnauthorised
+	}
+	if strings.Contains(err.Error(), "404") {
+		return ErrNotFound
+	}
+	return err
+}
+
+// checkMessageSize returns ErrMessageTooLarge, with the size of the message and the limit, if a message body is larger than max bytes.
+func checkMessageSize(m *servicebus.Message, max int) error {
+	if len(m.Data) > max {
+		return fmt.Errorf("%w of %d bytes: %d bytes", ErrMessageTooLarge, max, len(m.Data))
+	}
+	return nil
+}
+
+// isLockLost reports whether settling a message failed because its lock was lost, e.g. it expired or the message was received by another receiver.
+func isLockLost(err error) bool {
+	if errors.Is(err, ErrLockLost) {
+		return true
+	}
+	// Service Bus reports the com.microsoft:message-lock-lost condition, or MessageLockLostException
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "lock-lost") || strings.Contains(msg, "locklost")
+}
+
+// firstError records the first error reported by concurrently processed messages.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (f *firstError) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *firstError) get() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// operationError returns the error ending an operation on many messages.
+//
+// The context error is returned if the caller cancelled the operation, otherwise the first message error, if any.
+// Receiving stopped by reaching the operation's total is not an error.
+func operationError(ctx context.Context, failure, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failure != nil {
+		return failure
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return entityError(err)
+}
@@ -0,0 +1,52 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_MessageError_Unwrap(t *testing.T) {
+	cause := errors.New("disk full")
+	var err error = newMessageError("archive", &Message{ID: "abc", SequenceNumber: 7}, cause)
+
+	if err.Error() != "could not archive message abc: disk full" {
+		t.Errorf("Unexpected error message: %s", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Error("MessageError did not unwrap to its cause")
+	}
+	var msgErr *MessageError
+	if !errors.As(err, &msgErr) || msgErr.SequenceNumber != 7 {
+		t.Errorf("Unexpected MessageError: %+v", msgErr)
+	}
+}
+
+func Test_EntityError(t *testing.T) {
+	if err := entityError(errors.New("request failed: 401 Unauthorized")); !errors.Is(err, ErrUnauthorised) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := entityError(errors.New("request failed: 404 Not Found")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := entityError(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func Test_OperationError(t *testing.T) {
+	failure := errors.New("failed")
+
+	if err := operationError(context.Background(), nil, context.Canceled); err != nil {
+		t.Errorf("reaching the total was reported as an error: %v", err)
+	}
+	if err := operationError(context.Background(), failure, context.Canceled); err != failure {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := operationError(ctx, failure, context.Canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
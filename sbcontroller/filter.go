@@ -0,0 +1,59 @@
+package sbcontroller
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Filter selects messages for an operation. Every criteria provided must match for a message to be selected.
+//
+// Pattern is matched against the message body, DeadLetterReason and DeadLetterDescription against the dead-letter properties,
+// and each entry in Properties must equal the string form of the user property of the same key.
+//
+// EnqueuedBefore and EnqueuedAfter select messages by their enqueued time, when not zero.
+type Filter struct {
+	Pattern               *regexp.Regexp
+	DeadLetterReason      *regexp.Regexp
+	DeadLetterDescription *regexp.Regexp
+	Properties            map[string]string
+	EnqueuedBefore        time.Time
+	EnqueuedAfter         time.Time
+}
+
+// Match reports whether a message satisfies every criteria of the filter. A nil filter matches all messages.
+func (f *Filter) Match(m *Message) bool {
+	if f == nil {
+		return true
+	}
+	if f.Pattern != nil && !f.Pattern.Match(m.Data) {
+		return false
+	}
+	if f.DeadLetterReason != nil && !f.DeadLetterReason.MatchString(m.DeadLetterReason) {
+		return false
+	}
+	if f.DeadLetterDescription != nil && !f.DeadLetterDescription.MatchString(m.DeadLetterDescription) {
+		return false
+	}
+	if !f.EnqueuedBefore.IsZero() && !m.EnqueuedTime.Before(f.EnqueuedBefore) {
+		return false
+	}
+	if !f.EnqueuedAfter.IsZero() && !m.EnqueuedTime.After(f.EnqueuedAfter) {
+		return false
+	}
+	for k, v := range f.Properties {
+		p, ok := m.UserProperties[k]
+		if !ok || fmt.Sprint(p) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matcher returns Match, or nil for a nil filter, so that an operation without a filter acts on every message without selecting them first.
+func (f *Filter) matcher() func(m *Message) bool {
+	if f == nil {
+		return nil
+	}
+	return f.Match
+}
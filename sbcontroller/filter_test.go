@@ -0,0 +1,85 @@
+package sbcontroller
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_Filter_Match_Nil(t *testing.T) {
+	var f *Filter
+	if !f.Match(&Message{Data: []byte("hello, world")}) {
+		t.Error("nil filter did not match")
+	}
+}
+
+func Test_Filter_Match_Pattern(t *testing.T) {
+	f := &Filter{Pattern: regexp.MustCompile("ab+c")}
+
+	if !f.Match(&Message{Data: []byte("abbc")}) {
+		t.Error("matching body was not matched")
+	}
+
+	if f.Match(&Message{Data: []byte("ddef")}) {
+		t.Error("non-matching body was matched")
+	}
+}
+
+func Test_Filter_Match_DeadLetter(t *testing.T) {
+	f := &Filter{
+		DeadLetterReason:      regexp.MustCompile("^MaxDeliveryCountExceeded$"),
+		DeadLetterDescription: regexp.MustCompile("10 delivery attempts"),
+	}
+
+	m := &Message{
+		DeadLetterReason:      "MaxDeliveryCountExceeded",
+		DeadLetterDescription: "Message could not be consumed after 10 delivery attempts.",
+	}
+	if !f.Match(m) {
+		t.Error("matching dead letter properties were not matched")
+	}
+
+	m.DeadLetterReason = "TTLExpiredException"
+	if f.Match(m) {
+		t.Error("non-matching dead letter reason was matched")
+	}
+}
+
+func Test_Filter_Match_Properties(t *testing.T) {
+	f := &Filter{Properties: map[string]string{"type": "order", "retries": "2"}}
+
+	if !f.Match(&Message{UserProperties: map[string]interface{}{"type": "order", "retries": int64(2), "other": true}}) {
+		t.Error("matching properties were not matched")
+	}
+
+	if f.Match(&Message{UserProperties: map[string]interface{}{"type": "order"}}) {
+		t.Error("message missing a property was matched")
+	}
+
+	if f.Match(&Message{UserProperties: map[string]interface{}{"type": "orders", "retries": int64(2)}}) {
+		t.Error("non-matching property was matched")
+	}
+}
+
+func Test_Filter_Match_EnqueuedTime(t *testing.T) {
+	now := time.Now()
+	f := &Filter{EnqueuedBefore: now.Add(-72 * time.Hour)}
+
+	if !f.Match(&Message{EnqueuedTime: now.Add(-96 * time.Hour)}) {
+		t.Error("older message was not matched")
+	}
+
+	if f.Match(&Message{EnqueuedTime: now.Add(-time.Hour)}) {
+		t.Error("newer message was matched")
+	}
+
+	f = &Filter{EnqueuedAfter: now.Add(-72 * time.Hour)}
+
+	if f.Match(&Message{EnqueuedTime: now.Add(-96 * time.Hour)}) {
+		t.Error("older message was matched")
+	}
+
+	if !f.Match(&Message{EnqueuedTime: now.Add(-time.Hour)}) {
+		t.Error("newer message was not matched")
+	}
+}
@@ -0,0 +1,91 @@
+package sbcontroller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseRate parses a rate of messages, e.g. "200/s", "600/m" or "3600/h", into messages per second. A number without a unit is per second.
+func ParseRate(s string) (float64, error) {
+	n, unit, _ := strings.Cut(strings.TrimSpace(s), "/")
+	per := time.Second
+	switch unit {
+	case "", "s":
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid rate '%s', expected e.g. 200/s, 600/m or 3600/h", s)
+	}
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate '%s', expected e.g. 200/s, 600/m or 3600/h", s)
+	}
+	return v / per.Seconds(), nil
+}
+
+// limiter is a token bucket, shared by every goroutine of an operation, limiting the rate at which messages are sent or settled.
+//
+// The bucket holds up to burst tokens, refilled at rate tokens per second. A nil limiter does not limit.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter starting with a full bucket, or nil if rate is not positive.
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a token is available, then takes it. If the context is done first, the token is returned to the bucket and the context error is returned.
+func (l *limiter) wait(ctx context.Context) error {
+	return l.waitN(ctx, 1)
+}
+
+// waitN blocks until n tokens are available, e.g. for a batch of n messages, then takes them, as wait.
+func (l *limiter) waitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// taking a token in advance reserves it, so concurrent callers queue behind each other
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
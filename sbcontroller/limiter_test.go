@@ -0,0 +1,89 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_ParseRate(t *testing.T) {
+	tests := map[string]float64{"200/s": 200, "200": 200, "600/m": 10, "3600/h": 1, "0.5/s": 0.5}
+	for s, expected := range tests {
+		v, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+		if v != expected {
+			t.Errorf("%s: expected %v, got %v", s, expected, v)
+		}
+	}
+}
+
+func Test_ParseRate_Fail(t *testing.T) {
+	for _, s := range []string{"", "fast", "200/d", "-1/s"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("Invalid rate was accepted: %s", s)
+		}
+	}
+}
+
+func Test_Limiter_Nil(t *testing.T) {
+	if l := newLimiter(0, 10); l != nil {
+		t.Fatal("Expected no limiter without a rate")
+	}
+	var l *limiter
+	if err := l.wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Limiter_Burst(t *testing.T) {
+	l := newLimiter(1, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Burst was limited, took %v", elapsed)
+	}
+}
+
+func Test_Limiter_Rate(t *testing.T) {
+	l := newLimiter(100, 1)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first token is available immediately, and each of the next 10 after 10ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Rate was not limited, took %v", elapsed)
+	}
+}
+
+func Test_Limiter_Cancelled(t *testing.T) {
+	l := newLimiter(1, 1)
+	l.wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+}
+
+func Test_Limiter_WaitN_AboveBurst(t *testing.T) {
+	l := newLimiter(100, 1)
+	start := time.Now()
+	// a batch of 11 takes the burst token, and waits 10ms for each of the other 10
+	if err := l.waitN(context.Background(), 11); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Unexpected wait for a batch above the burst: %v", elapsed)
+	}
+}
@@ -0,0 +1,709 @@
+package sbcontroller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+const (
+	ERR_DEADLETTERSEND string = "cannot send messages directly to a dead letter queue"
+
+	defaultLockDuration     time.Duration = time.Minute
+	defaultMaxDeliveryCount uint32        = 10
+	maxDeliveryReason       string        = "MaxDeliveryCountExceeded"
+	maxDeliveryDescription  string        = "Message could not be consumed after %d delivery attempts."
+)
+
+// Broker is an in-memory Service Bus namespace, holding queues and their dead letter queues.
+//
+// Messages are given sequence numbers and enqueued times when sent, and are received with peek-lock semantics:
+// a received message is hidden from other receivers until it is completed, abandoned or its lock expires after LockDuration.
+// Each receive increments a message's delivery count, and a message abandoned MaxDeliveryCount times is moved to the dead letter queue, as in Service Bus.
+// An abandoned message is available again ahead of the messages behind it, so it is the next message received.
+// Settling a message after its lock has expired, or after it has been received again, returns ErrLockLost.
+// FailSends simulates transient errors, such as ServerBusy.
+//
+// Topics and their subscriptions are created with CreateTopic and CreateSubscription. A message sent to a topic is copied to every subscription,
+// which holds its messages, and dead letter queue, as a queue does, at the path 'topic/subscriptions/subscription'.
+//
+// A queue created with CreateSessionQueue requires a SessionID on every message sent to it, and is received from one session at a time,
+// in the order of each session's first message. Each session holds a state, as in Service Bus.
+//
+// Queues must be created with CreateQueue before they can be used.
+type Broker struct {
+	// LockDuration is the time a received message is locked for. A duration below 1 locks messages until they are settled.
+	LockDuration time.Duration
+	// MaxDeliveryCount is the number of deliveries after which an abandoned message is dead-lettered.
+	MaxDeliveryCount uint32
+
+	mu         sync.Mutex
+	queues     map[string]*memoryQueue
+	topics     map[string][]string
+	namespaces map[string]*Broker
+	sendFaults int
+	sendErr    error
+}
+
+type memoryQueue struct {
+	active, deadLetter []*memoryMessage
+	sequence           int64
+	requiresSession    bool
+	states             map[string][]byte
+}
+
+type memoryMessage struct {
+	msg         *servicebus.Message
+	locked      bool
+	lockedUntil time.Time
+}
+
+func (m *memoryMessage) isLocked(now time.Time) bool {
+	return m.locked && (m.lockedUntil.IsZero() || now.Before(m.lockedUntil))
+}
+
+// NewBroker returns an empty in-memory namespace, with the Service Bus defaults of a one minute lock duration and dead-lettering after 10 deliveries.
+func NewBroker() *Broker {
+	return &Broker{
+		LockDuration:     defaultLockDuration,
+		MaxDeliveryCount: defaultMaxDeliveryCount,
+		queues:           make(map[string]*memoryQueue),
+		topics:           make(map[string][]string),
+		namespaces:       make(map[string]*Broker),
+	}
+}
+
+// CreateQueue creates an empty queue, if a queue of the same name does not already exist.
+func (b *Broker) CreateQueue(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &memoryQueue{}
+	}
+}
+
+// CreateSessionQueue creates an empty session-enabled queue, if a queue of the same name does not already exist.
+func (b *Broker) CreateSessionQueue(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &memoryQueue{requiresSession: true, states: make(map[string][]byte)}
+	}
+}
+
+// CreateTopic creates a topic without subscriptions, if a topic of the same name does not already exist.
+func (b *Broker) CreateTopic(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = []string{}
+	}
+}
+
+// CreateSubscription creates an empty subscription to a topic, creating the topic if it does not already exist.
+// Only messages sent to the topic after the subscription is created are copied to it.
+func (b *Broker) CreateSubscription(topic, name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path := Entity{Topic: topic, Subscription: name}.String()
+	if _, ok := b.queues[path]; !ok {
+		b.queues[path] = &memoryQueue{}
+		b.topics[topic] = append(b.topics[topic], path)
+	}
+}
+
+// entities returns every queue, topic and subscription on the Broker.
+func (b *Broker) entities() []Entity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriptions := make(map[string]bool)
+	entities := []Entity{}
+	for topic, paths := range b.topics {
+		entities = append(entities, Entity{Topic: topic})
+		for _, p := range paths {
+			subscriptions[p] = true
+			entities = append(entities, Entity{Topic: topic, Subscription: strings.TrimPrefix(p, Entity{Topic: topic}.String()+"/subscriptions/")})
+		}
+	}
+	for name := range b.queues {
+		if !subscriptions[name] {
+			entities = append(entities, QueueEntity(name, false))
+		}
+	}
+	return entities
+}
+
+// Namespace returns the in-memory namespace reached by a connection string, as used by SetupTargetNamespace. It is created on first use.
+func (b *Broker) Namespace(conn string) *Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ns, ok := b.namespaces[conn]
+	if !ok {
+		ns = NewBroker()
+		b.namespaces[conn] = ns
+	}
+	return ns
+}
+
+// FailSends causes the next n calls to Send, or SendBatch, to return err, e.g. to test how a Controller handles a throttled namespace.
+func (b *Broker) FailSends(n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendFaults = n
+	b.sendErr = err
+}
+
+// Send places a copy of a message on a queue, or directly on its dead letter queue, assigning the next sequence number and the current enqueued time.
+// A message sent to a topic is placed on each of its subscriptions.
+func (b *Broker) Send(name string, dlq bool, m *servicebus.Message) error {
+	return b.SendBatch(name, dlq, []*servicebus.Message{m})
+}
+
+// SendBatch places a copy of every message on a queue, or its dead letter queue, in order, as Send. Either every message is sent, or none are.
+//
+// A batch counts as a single call to Send for FailSends.
+func (b *Broker) SendBatch(name string, dlq bool, msgs []*servicebus.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sendFaults > 0 {
+		b.sendFaults--
+		return b.sendErr
+	}
+	if subscriptions, ok := b.topics[name]; ok {
+		if dlq {
+			return ErrDeadLetterSend
+		}
+		for _, path := range subscriptions {
+			b.enqueue(b.queues[path], false, msgs)
+		}
+		return nil
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if q.requiresSession && !dlq {
+		for _, m := range msgs {
+			if m.SessionID == nil || *m.SessionID == "" {
+				return ErrSessionRequired
+			}
+		}
+	}
+	b.enqueue(q, dlq, msgs)
+	return nil
+}
+
+func (b *Broker) enqueue(q *memoryQueue, dlq bool, msgs []*servicebus.Message) {
+	enqueued := time.Now().UTC()
+	for _, m := range msgs {
+		q.sequence++
+		seq := q.sequence
+
+		msg := cloneMessage(m)
+		msg.DeliveryCount = 0
+		msg.SystemProperties = &servicebus.SystemProperties{SequenceNumber: &seq, EnqueuedTime: &enqueued}
+		if dlq {
+			q.deadLetter = append(q.deadLetter, &memoryMessage{msg: msg})
+		} else {
+			q.active = append(q.active, &memoryMessage{msg: msg})
+		}
+	}
+}
+
+// Messages peeks every message on a queue, or its dead letter queue, in sequence order. Locked messages are included.
+func (b *Broker) Messages(name string, dlq bool) ([]*Message, error) {
+	peeked, err := b.peek(name, dlq)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, len(peeked))
+	for i, m := range peeked {
+		msgs[i] = newMessage(m)
+	}
+	return msgs, nil
+}
+
+// peek returns a copy of every message on a queue, or its dead letter queue, in sequence order.
+func (b *Broker) peek(name string, dlq bool) ([]*servicebus.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, dlq)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*servicebus.Message, len(*entity))
+	for i, m := range *entity {
+		msgs[i] = cloneMessage(m.msg)
+	}
+	return msgs, nil
+}
+
+func (b *Broker) entity(name string, dlq bool) (*[]*memoryMessage, error) {
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if dlq {
+		return &q.deadLetter, nil
+	}
+	return &q.active, nil
+}
+
+// available returns the sequence numbers of up to max unlocked messages, in sequence order. A max below 1 returns all.
+func (b *Broker) available(name string, dlq bool, max int) ([]int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, dlq)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	seqs := []int64{}
+	for _, m := range *entity {
+		if max > 0 && len(seqs) == max {
+			break
+		}
+		if !m.isLocked(now) {
+			seqs = append(seqs, *m.msg.SystemProperties.SequenceNumber)
+		}
+	}
+	return seqs, nil
+}
+
+// sessionAvailable returns the sequence numbers of up to max unlocked messages on a session-enabled queue, as available,
+// grouped by session in the order of each session's first message. A session other than "" returns only the messages of that session.
+func (b *Broker) sessionAvailable(name, session string, max int) ([]int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ids := []string{}
+	bySession := make(map[string][]int64)
+	for _, m := range *entity {
+		if m.isLocked(now) || m.msg.SessionID == nil || (session != "" && *m.msg.SessionID != session) {
+			continue
+		}
+		id := *m.msg.SessionID
+		if _, ok := bySession[id]; !ok {
+			ids = append(ids, id)
+		}
+		bySession[id] = append(bySession[id], *m.msg.SystemProperties.SequenceNumber)
+	}
+	seqs := []int64{}
+	for _, id := range ids {
+		for _, seq := range bySession[id] {
+			if max > 0 && len(seqs) == max {
+				return seqs, nil
+			}
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs, nil
+}
+
+// sessionState returns the state of a session of a session-enabled queue.
+func (b *Broker) sessionState(name, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return q.states[id], nil
+}
+
+// setSessionState replaces the state of a session of a session-enabled queue. A nil state clears it.
+func (b *Broker) setSessionState(name, id string, state []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return ErrNotFound
+	}
+	if state == nil {
+		delete(q.states, id)
+		return nil
+	}
+	q.states[id] = append([]byte{}, state...)
+	return nil
+}
+
+// receive locks a message and increments its delivery count, returning a copy. nil is returned if the message is no longer available.
+//
+// The delivery count of the copy identifies the lock when the message is settled.
+func (b *Broker) receive(name string, dlq bool, seq int64) *servicebus.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, dlq)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	for _, m := range *entity {
+		if *m.msg.SystemProperties.SequenceNumber == seq && !m.isLocked(now) {
+			m.locked = true
+			m.lockedUntil = time.Time{}
+			if b.LockDuration > 0 {
+				m.lockedUntil = now.Add(b.LockDuration)
+			}
+			m.msg.DeliveryCount++
+			c := cloneMessage(m.msg)
+			if !m.lockedUntil.IsZero() {
+				lockedUntil := m.lockedUntil
+				c.SystemProperties.LockedUntil = &lockedUntil
+			}
+			return c
+		}
+	}
+	return nil
+}
+
+// locked returns the index of a message still locked by the receive that returned deliveryCount, or ErrLockLost.
+func (b *Broker) locked(entity []*memoryMessage, seq int64, deliveryCount uint32) (int, error) {
+	now := time.Now()
+	for i, m := range entity {
+		if *m.msg.SystemProperties.SequenceNumber == seq {
+			if !m.isLocked(now) || m.msg.DeliveryCount != deliveryCount {
+				return 0, ErrLockLost
+			}
+			return i, nil
+		}
+	}
+	return 0, ErrLockLost
+}
+
+// complete removes a locked message.
+func (b *Broker) complete(name string, dlq bool, seq int64, deliveryCount uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, dlq)
+	if err != nil {
+		return err
+	}
+	i, err := b.locked(*entity, seq, deliveryCount)
+	if err != nil {
+		return err
+	}
+	*entity = append((*entity)[:i], (*entity)[i+1:]...)
+	return nil
+}
+
+// abandon unlocks a message, dead-lettering it once it has been delivered MaxDeliveryCount times.
+func (b *Broker) abandon(name string, dlq bool, seq int64, deliveryCount uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entity, err := b.entity(name, dlq)
+	if err != nil {
+		return err
+	}
+	i, err := b.locked(*entity, seq, deliveryCount)
+	if err != nil {
+		return err
+	}
+	m := (*entity)[i]
+	m.locked = false
+	if !dlq && m.msg.DeliveryCount >= b.MaxDeliveryCount {
+		*entity = append((*entity)[:i], (*entity)[i+1:]...)
+		m.msg.UserProperties[PROP_DEADLETTERREASON] = maxDeliveryReason
+		m.msg.UserProperties[PROP_DEADLETTERDESCRIPTION] = fmt.Sprintf(maxDeliveryDescription, m.msg.DeliveryCount)
+		q := b.queues[name]
+		q.deadLetter = append(q.deadLetter, m)
+	}
+	return nil
+}
+
+func cloneMessage(m *servicebus.Message) *servicebus.Message {
+	c := *m
+	c.UserProperties = make(map[string]interface{}, len(m.UserProperties))
+	for k, v := range m.UserProperties {
+		c.UserProperties[k] = v
+	}
+	if m.SystemProperties != nil {
+		sp := *m.SystemProperties
+		c.SystemProperties = &sp
+	}
+	return &c
+}
+
+// NewMemoryController builds and returns a ServiceBusController connected to an in-memory Broker, allowing every command to run offline.
+// The target queue uses the same Broker, unless SetupTargetNamespace is called.
+func NewMemoryController(b *Broker) Controller {
+	return &ServiceBusController{
+		client:       b,
+		targetClient: b,
+		retrier:      newRetrier(DefaultMaxAttempts),
+		settings:     DefaultSettings()}
+}
+
+// connect connects to a queue, topic or subscription, or a dead letter queue, on the Broker. ErrNotFound is returned if the entity does not exist.
+func (b *Broker) connect(e Entity, prefetch uint32, pageSize int) (entityConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name := e.path()
+	var exists, sessions bool
+	if e.CanReceive() {
+		var q *memoryQueue
+		q, exists = b.queues[name]
+		sessions = exists && q.requiresSession && !e.DeadLetter
+	} else {
+		_, exists = b.topics[name]
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if prefetch == 0 {
+		prefetch = 1
+	}
+	return &memoryEntity{Entity: e, broker: b, name: name, sessions: sessions, prefetch: int(prefetch)}, nil
+}
+
+// list returns the details of every queue, topic and subscription on the Broker.
+func (b *Broker) list(ctx context.Context, r *retrier) ([]EntityDetails, error) {
+	details := []EntityDetails{}
+	for _, e := range b.entities() {
+		entity, err := b.connect(e, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		d, err := entity.describe(ctx)
+		if err != nil {
+			return nil, err
+		}
+		details = append(details, d)
+	}
+	return details, nil
+}
+
+// open returns the Broker returned by Namespace for the connection string.
+func (b *Broker) open(conn string) (namespace, error) {
+	return b.Namespace(conn), nil
+}
+
+// memoryEntity is a connection to a queue, topic or subscription, or a dead letter queue, on a Broker.
+//
+// Receive locks up to the prefetch count of messages at a time, and returns once no message is available, in place of waiting for one to arrive.
+type memoryEntity struct {
+	Entity
+	broker *Broker
+	name   string
+	// sessions is true for a session-enabled queue, excluding its dead letter queue
+	sessions bool
+	prefetch int
+}
+
+func (e *memoryEntity) entity() Entity {
+	return e.Entity
+}
+
+// Receive passes each available message to the handler in turn. Messages locked but not yet passed to the handler when ctx is cancelled,
+// or the handler returns an error, are abandoned.
+func (e *memoryEntity) Receive(ctx context.Context, handler servicebus.Handler) error {
+	for ctx.Err() == nil {
+		msgs, err := e.lock(e.prefetch)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		for i, m := range msgs {
+			if err := ctx.Err(); err != nil {
+				e.release(msgs[i:])
+				return err
+			}
+			if err := handler.Handle(ctx, m); err != nil {
+				e.release(msgs[i+1:])
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// ReceiveOne passes the next available message to the handler. ErrQueueEmpty is returned if no message is available.
+func (e *memoryEntity) ReceiveOne(ctx context.Context, handler servicebus.Handler) error {
+	msgs, err := e.lock(1)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return ErrQueueEmpty
+	}
+	return handler.Handle(ctx, msgs[0])
+}
+
+// lock receives up to max available messages, from Entity.Session, or a session at a time from a session-enabled queue.
+func (e *memoryEntity) lock(max int) ([]*servicebus.Message, error) {
+	if !e.CanReceive() {
+		return nil, ErrTopicReceive
+	}
+	var seqs []int64
+	var err error
+	switch {
+	case e.sessions:
+		seqs, err = e.broker.sessionAvailable(e.name, e.Session, max)
+	case e.Session != "":
+		err = ErrNoSessions
+	default:
+		seqs, err = e.broker.available(e.name, e.DeadLetter, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs := []*servicebus.Message{}
+	for _, seq := range seqs {
+		if m := e.broker.receive(e.name, e.DeadLetter, seq); m != nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// release abandons messages locked by Receive but not passed to the handler.
+func (e *memoryEntity) release(msgs []*servicebus.Message) {
+	for _, m := range msgs {
+		e.abandon(context.Background(), m)
+	}
+}
+
+// Peek peeks every message on the entity, including locked messages, or only the messages of Entity.Session.
+func (e *memoryEntity) Peek(ctx context.Context, options ...servicebus.PeekOption) (servicebus.MessageIterator, error) {
+	if !e.CanReceive() {
+		return nil, ErrTopicReceive
+	}
+	msgs, err := e.broker.peek(e.name, e.DeadLetter)
+	if err != nil {
+		return nil, err
+	}
+	it := &memoryIterator{msgs: msgs}
+	if e.Session != "" {
+		return &sessionIterator{MessageIterator: it, session: e.Session}, nil
+	}
+	return it, nil
+}
+
+func (e *memoryEntity) Send(ctx context.Context, m *servicebus.Message) error {
+	return e.send([]*servicebus.Message{m})
+}
+
+func (e *memoryEntity) sendBatch(ctx context.Context, b *messageBatch) error {
+	return e.send(b.msgs)
+}
+
+func (e *memoryEntity) send(msgs []*servicebus.Message) error {
+	if e.DeadLetter {
+		return ErrDeadLetterSend
+	}
+	if !e.CanSend() {
+		return ErrSubscriptionSend
+	}
+	return e.broker.SendBatch(e.name, false, msgs)
+}
+
+// complete removes a received message. The sequence number and delivery count of the message identify its lock.
+func (e *memoryEntity) complete(ctx context.Context, m *servicebus.Message) error {
+	return e.broker.complete(e.name, e.DeadLetter, *m.SystemProperties.SequenceNumber, m.DeliveryCount)
+}
+
+func (e *memoryEntity) abandon(ctx context.Context, m *servicebus.Message) error {
+	return e.broker.abandon(e.name, e.DeadLetter, *m.SystemProperties.SequenceNumber, m.DeliveryCount)
+}
+
+// describe reports the entity as Service Bus would, with its size as the total size of the bodies of its messages, and the broker's settings.
+// Topics hold no messages of their own, so always report 0 messages.
+func (e *memoryEntity) describe(ctx context.Context) (EntityDetails, error) {
+	d := EntityDetails{
+		Entity: Entity{Queue: e.Queue, Topic: e.Topic, Subscription: e.Subscription}.String(),
+		Type:   TypeQueue,
+		Status: string(servicebus.Active),
+	}
+	switch {
+	case e.Subscription != "":
+		d.Type = TypeSubscription
+	case e.Queue == "":
+		d.Type = TypeTopic
+		return d, nil
+	}
+	e.broker.mu.Lock()
+	defer e.broker.mu.Unlock()
+	q, ok := e.broker.queues[e.name]
+	if !ok {
+		return d, ErrNotFound
+	}
+	d.ActiveMessages = int64(len(q.active))
+	d.DeadLetterMessages = int64(len(q.deadLetter))
+	for _, m := range append(q.active, q.deadLetter...) {
+		d.SizeInBytes += int64(len(m.msg.Data))
+	}
+	d.LockDuration = Duration(e.broker.LockDuration)
+	d.MaxDeliveryCount = int32(e.broker.MaxDeliveryCount)
+	d.RequiresSession = q.requiresSession
+	return d, nil
+}
+
+// count returns the number of messages, including locked messages, on the entity, or on Entity.Session. Topics hold no messages of their own, so always count 0.
+func (e *memoryEntity) count(ctx context.Context) (int, error) {
+	if !e.CanReceive() {
+		return 0, nil
+	}
+	msgs, err := e.broker.peek(e.name, e.DeadLetter)
+	if err != nil || e.Session == "" {
+		return len(msgs), err
+	}
+	n := 0
+	for _, m := range msgs {
+		if m.SessionID != nil && *m.SessionID == e.Session {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (e *memoryEntity) sessionState(ctx context.Context, id string) ([]byte, error) {
+	if !e.sessions {
+		return nil, ErrNoSessions
+	}
+	return e.broker.sessionState(e.name, id)
+}
+
+func (e *memoryEntity) setSessionState(ctx context.Context, id string, state []byte) error {
+	if !e.sessions {
+		return ErrNoSessions
+	}
+	return e.broker.setSessionState(e.name, id, state)
+}
+
+// close does nothing, as an in-memory entity holds no connection.
+func (e *memoryEntity) close(ctx context.Context) error {
+	return nil
+}
+
+// memoryIterator peeks messages copied from a Broker. As with Service Bus, it is only done once Next has returned ErrNoMessages.
+type memoryIterator struct {
+	msgs []*servicebus.Message
+	done bool
+}
+
+func (it *memoryIterator) Done() bool {
+	return it.done
+}
+
+func (it *memoryIterator) Next(ctx context.Context) (*servicebus.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(it.msgs) == 0 {
+		it.done = true
+		return nil, servicebus.ErrNoMessages{}
+	}
+	m := it.msgs[0]
+	it.msgs = it.msgs[1:]
+	return m, nil
+}
@@ -0,0 +1,760 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func helper_newBroker(t *testing.T, bodies ...string) *Broker {
+	t.Helper()
+	b := NewBroker()
+	b.CreateQueue("testqueue")
+	for _, body := range bodies {
+		if err := b.Send("testqueue", false, &servicebus.Message{ID: body, Data: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func Test_Broker_Send_SequenceNumbers(t *testing.T) {
+	b := helper_newBroker(t, "one", "two", "three")
+
+	msgs, err := b.Messages("testqueue", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range msgs {
+		if m.SequenceNumber != int64(i+1) || m.EnqueuedTime.IsZero() || m.DeliveryCount != 0 {
+			t.Errorf("Unexpected system properties for message %d: %+v", i, m)
+		}
+	}
+}
+
+func Test_Broker_Abandon_DeadLetters(t *testing.T) {
+	b := helper_newBroker(t, "one")
+	b.MaxDeliveryCount = 3
+
+	for i := 1; i <= 3; i++ {
+		m := b.receive("testqueue", false, 1)
+		if m == nil {
+			t.Fatalf("Message not available for delivery %d", i)
+		}
+		if m.DeliveryCount != uint32(i) {
+			t.Errorf("Unexpected delivery count: %d", m.DeliveryCount)
+		}
+		if b.receive("testqueue", false, 1) != nil {
+			t.Error("Locked message was received twice")
+		}
+		if err := b.abandon("testqueue", false, 1, m.DeliveryCount); err != nil {
+			t.Error(err)
+		}
+	}
+
+	active, _ := b.Messages("testqueue", false)
+	dead, _ := b.Messages("testqueue", true)
+	if len(active) != 0 || len(dead) != 1 {
+		t.Fatalf("Unexpected queue lengths: %d active, %d dead-lettered", len(active), len(dead))
+	}
+
+	if dead[0].DeadLetterReason != "MaxDeliveryCountExceeded" || dead[0].SequenceNumber != 1 {
+		t.Errorf("Unexpected dead-lettered message: %+v", dead[0])
+	}
+}
+
+func Test_Broker_Complete_Fail_LockLost(t *testing.T) {
+	b := helper_newBroker(t, "one")
+	b.LockDuration = time.Millisecond
+
+	m := b.receive("testqueue", false, 1)
+	if m == nil || m.SystemProperties.LockedUntil == nil {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	redelivered := b.receive("testqueue", false, 1)
+	if redelivered == nil || redelivered.DeliveryCount != 2 {
+		t.Fatalf("Message with an expired lock was not redelivered: %+v", redelivered)
+	}
+	if err := b.complete("testqueue", false, 1, m.DeliveryCount); !errors.Is(err, ErrLockLost) {
+		t.Errorf("Unexpected error completing with a lost lock: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := b.complete("testqueue", false, 1, redelivered.DeliveryCount); !errors.Is(err, ErrLockLost) {
+		t.Errorf("Unexpected error completing after the lock expired: %v", err)
+	}
+}
+
+func Test_MemoryController_Setup_Fail_NotFound(t *testing.T) {
+	sb := NewMemoryController(NewBroker())
+	err := sb.SetupSourceQueue("missing", false, false)
+	if !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+}
+
+func Test_MemoryController_Send_Fail_DeadLetter(t *testing.T) {
+	sb := NewMemoryController(helper_newBroker(t))
+	if err := sb.SetupSourceQueue("testqueue", true, false); err != nil {
+		t.Fatal(err)
+	}
+	err := sb.SendJsonMessage(context.Background(), false, []byte("{}"))
+	if !errors.Is(err, ErrDeadLetterSend) {
+		t.Error(err)
+	}
+}
+
+func Test_MemoryController_TidyMessages_AbandonsUnmatched(t *testing.T) {
+	b := helper_newBroker(t, "abc", "xyz", "abbc")
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := make(chan Progress, 10)
+	p, err := sb.TidyMessages(context.Background(), progress, regexp.MustCompile("ab+c"), true, 3, nil)
+	close(progress)
+	if err != nil || p.Processed != 3 || p.Matched != 2 || p.Completed != 2 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+
+	// matches are settled concurrently, so are reported in any order
+	found := []string{}
+	for e := range progress {
+		found = append(found, string(e.Message.Data))
+	}
+	sort.Strings(found)
+	if len(found) != 2 || found[0] != "abbc" || found[1] != "abc" {
+		t.Errorf("Unexpected matches reported: %v", found)
+	}
+
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 1 || string(msgs[0].Data) != "xyz" || msgs[0].DeliveryCount != 1 {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+}
+
+func Test_MemoryController_DeleteManyMessages_Filter_NoMatch(t *testing.T) {
+	b := helper_newBroker(t, "abc", "xyz")
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := sb.DeleteManyMessages(context.Background(), nil, 2, &Filter{Pattern: regexp.MustCompile("nomatch")}, nil)
+	if err != nil || p.Processed != 0 || p.Abandoned != 0 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+
+	// nothing is selected, so nothing is received
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 2 || msgs[0].DeliveryCount != 0 || msgs[1].DeliveryCount != 0 {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+}
+
+func Test_MemoryController_DeleteManyMessages_Filter_Redelivered(t *testing.T) {
+	b := helper_newBroker(t, "xyz", "abc")
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{Prefetch: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the abandoned message is redelivered ahead of the match, which stops the operation rather than abandoning it again
+	p, err := sb.DeleteManyMessages(context.Background(), nil, 2, &Filter{Pattern: regexp.MustCompile("abc")}, nil)
+	if err != nil || p.Processed != 1 || p.Abandoned != 1 || p.Completed != 0 || p.Unreached != 1 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 2 || msgs[0].DeliveryCount != 2 || msgs[1].DeliveryCount != 0 {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+}
+
+func Test_MemoryController_RequeueManyMessages_TargetNamespace(t *testing.T) {
+	b := helper_newBroker(t)
+	for _, reason := range []string{"MaxDeliveryCountExceeded", "TTLExpiredException", "MaxDeliveryCountExceeded"} {
+		m := &servicebus.Message{ID: reason, Data: []byte("{}"), UserProperties: map[string]interface{}{PROP_DEADLETTERREASON: reason}}
+		if err := b.Send("testqueue", true, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Namespace("other").CreateQueue("quarantine")
+
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupTargetNamespace("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupTargetQueue("quarantine", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := sb.RequeueManyMessages(context.Background(), nil, 3, &Filter{DeadLetterReason: regexp.MustCompile("^MaxDelivery")}, nil, true, false)
+	if err != nil || p.Processed != 3 || p.Completed != 2 {
+		t.Fatalf("Unexpected requeue result: %+v, %v", p, err)
+	}
+
+	remaining, _ := b.Messages("testqueue", true)
+	if len(remaining) != 1 || remaining[0].ID != "TTLExpiredException" {
+		t.Errorf("Unexpected remaining messages: %+v", remaining)
+	}
+
+	requeued, _ := b.Namespace("other").Messages("quarantine", false)
+	if len(requeued) != 2 || requeued[0].UserProperties[PROP_REQUEUECOUNT] != int64(1) {
+		t.Errorf("Unexpected requeued messages: %+v", requeued)
+	}
+}
+
+func Test_MemoryController_DeleteManyMessages_Cancelled(t *testing.T) {
+	b := helper_newBroker(t, "one", "two")
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p, err := sb.DeleteManyMessages(ctx, nil, 2, nil, nil)
+	if !errors.Is(err, context.Canceled) || p.Completed != 0 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_DeleteManyMessages_Rate(t *testing.T) {
+	b := helper_newBroker(t, "one", "two", "three")
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{Rate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+	// the first message uses the burst, and the context ends while the others wait for the rate limit
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	p, err := sb.DeleteManyMessages(ctx, nil, 3, nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || p.Completed != 1 || p.Abandoned != 2 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Rate(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{Rate: 100, Burst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4"), []byte("5"), []byte("6")})
+	if err != nil || n != 6 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	// two messages are sent at once, then one every 10ms
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Sending was not rate limited, took %v", elapsed)
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Retried(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	sb.(*ServiceBusController).retrier = helper_newRetrier(DefaultMaxAttempts)
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+	b.FailSends(2, errors.New("com.microsoft:server-busy"))
+
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("2")})
+	if err != nil || n != 2 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if s := sb.RetryStats(); s.Retried != 2 || s.Throttled != 2 {
+		t.Errorf("Unexpected retry stats: %+v", s)
+	}
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Fail_MaxAttempts(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	sb.(*ServiceBusController).retrier = helper_newRetrier(DefaultMaxAttempts)
+	if err := sb.Configure(Settings{MaxAttempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+	b.FailSends(3, errors.New("amqp:link:detach-forced"))
+
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("2")})
+	if err == nil || n != 0 {
+		t.Errorf("Unexpected result: %d, %v", n, err)
+	}
+}
+
+func Test_MemoryController_SendJsonMessage_Fail_TooLarge(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{MaxMessageSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sb.SendJsonMessage(context.Background(), false, []byte("1234")); err != nil {
+		t.Error(err)
+	}
+	if err := sb.SendJsonMessage(context.Background(), false, []byte("12345")); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 1 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+type failingArchiver struct{}
+
+func (failingArchiver) Archive(m *Message) error {
+	return errors.New("disk full")
+}
+
+func Test_MemoryController_DeleteManyMessages_Fail_Archive(t *testing.T) {
+	b := helper_newBroker(t, "one", "two")
+	sb := NewMemoryController(b)
+	// a single worker archives the first message first, though the second may still be taken before the operation stops
+	if err := sb.Configure(Settings{Concurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := sb.DeleteManyMessages(context.Background(), nil, 2, nil, failingArchiver{})
+	var msgErr *MessageError
+	if !errors.As(err, &msgErr) || msgErr.Op != "archive" || msgErr.SequenceNumber != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p.Matched < 1 || p.Failed != p.Matched || p.Completed != 0 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 2 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_DeleteManyMessages_LockLost(t *testing.T) {
+	b := helper_newBroker(t, "one", "two", "three")
+	b.LockDuration = time.Nanosecond
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := sb.DeleteManyMessages(context.Background(), nil, 3, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Processed != 3 || p.Completed != 0 || p.LockLost != 3 || p.Unsettled() != 3 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 3 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Batched(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	sb.(*ServiceBusController).retrier = helper_newRetrier(DefaultMaxAttempts)
+	if err := sb.Configure(Settings{BatchSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+	// batches of two messages, so a single transient failure is retried for one batch
+	b.FailSends(1, errors.New("com.microsoft:server-busy"))
+
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	if err != nil || n != 3 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if s := sb.RetryStats(); s.Retried != 1 {
+		t.Errorf("Unexpected retry stats: %+v", s)
+	}
+	msgs, _ := b.Messages("testqueue", false)
+	if len(msgs) != 3 {
+		t.Fatalf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+	for i, m := range msgs {
+		if string(m.Data) != string(rune('1'+i)) {
+			t.Errorf("Unexpected message %d: %s", i, m.Data)
+		}
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Batch_Isolated(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+	// a batch rejected by the broker is sent again one message at a time
+	b.FailSends(1, errors.New("rejected"))
+
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	if err != nil || n != 3 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 3 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_SendManyJsonMessages_Fail_TooLarge(t *testing.T) {
+	b := helper_newBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{MaxMessageSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("1"), []byte("12345"), []byte("3")})
+	if !errors.Is(err, ErrMessageTooLarge) || n != 1 {
+		t.Errorf("Unexpected result: %d, %v", n, err)
+	}
+	if msgs, _ := b.Messages("testqueue", false); len(msgs) != 1 {
+		t.Errorf("Queue had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_RequeueManyMessages_Batch_Isolated(t *testing.T) {
+	b := helper_newBroker(t, "1", "12345", "3")
+	b.CreateQueue("target")
+	sb := NewMemoryController(b)
+	if err := sb.Configure(Settings{MaxMessageSize: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupTargetQueue("target", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message too large to send is abandoned, without losing the rest of its batch
+	p, err := sb.RequeueManyMessages(context.Background(), nil, 3, nil, nil, false, false)
+	var me *MessageError
+	if !errors.As(err, &me) || me.MessageID != "12345" || !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if p.Processed != 3 || p.Completed != 2 || p.Failed != 1 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	if remaining, _ := b.Messages("testqueue", false); len(remaining) != 1 || remaining[0].ID != "12345" {
+		t.Errorf("Unexpected remaining messages: %+v", remaining)
+	}
+	if requeued, _ := b.Messages("target", false); len(requeued) != 2 {
+		t.Errorf("Unexpected requeued messages: %+v", requeued)
+	}
+}
+
+func Test_MemoryController_RequeueManyMessages_Cancelled(t *testing.T) {
+	b := helper_newBroker(t, "one", "two")
+	b.CreateQueue("target")
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SetupTargetQueue("target", false, true); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p, err := sb.RequeueManyMessages(ctx, nil, 2, nil, nil, false, false)
+	if !errors.Is(err, context.Canceled) || p.Completed != 0 {
+		t.Errorf("Unexpected result: %+v, %v", p, err)
+	}
+	if msgs, _ := b.Messages("target", false); len(msgs) != 0 {
+		t.Errorf("Target had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func Test_MemoryController_Topic_FanOut(t *testing.T) {
+	b := NewBroker()
+	b.CreateSubscription("events", "audit")
+	b.CreateSubscription("events", "billing")
+	sb := NewMemoryController(b)
+	if err := sb.SetupTarget(Entity{Topic: "events"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := sb.SendManyJsonMessages(context.Background(), true, [][]byte{[]byte("one"), []byte("two")}); err != nil || n != 2 {
+		t.Fatalf("Unexpected send result: %d, %v", n, err)
+	}
+	for _, sub := range []string{"audit", "billing"} {
+		if msgs, _ := b.Messages(Entity{Topic: "events", Subscription: sub}.String(), false); len(msgs) != 2 {
+			t.Errorf("Subscription %s had unexpected number of messages: %d", sub, len(msgs))
+		}
+	}
+
+	if n, err := sb.GetTargetQueueCount(context.Background()); err != nil || n != 0 {
+		t.Errorf("Unexpected topic count: %d, %v", n, err)
+	}
+	if err := sb.SetupSource(Entity{Topic: "events"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.DeleteOneMessage(context.Background()); !errors.Is(err, ErrTopicReceive) {
+		t.Errorf("Unexpected error receiving from a topic: %v", err)
+	}
+}
+
+func Test_MemoryController_Subscription_Send_Fail(t *testing.T) {
+	b := NewBroker()
+	b.CreateSubscription("events", "audit")
+	sb := NewMemoryController(b)
+	if err := sb.SetupSource(Entity{Topic: "events", Subscription: "audit"}, false); err != nil {
+		t.Fatal(err)
+	}
+	err := sb.SendJsonMessage(context.Background(), false, []byte("{}"))
+	if !errors.Is(err, ErrSubscriptionSend) {
+		t.Error(err)
+	}
+}
+
+func Test_MemoryController_RequeueManyMessages_Subscription(t *testing.T) {
+	b := NewBroker()
+	b.CreateSubscription("events", "audit")
+	b.CreateQueue("target")
+	sub := Entity{Topic: "events", Subscription: "audit", DeadLetter: true}
+	for _, body := range []string{"one", "two"} {
+		if err := b.Send(sub.path(), true, &servicebus.Message{ID: body, Data: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sb := NewMemoryController(b)
+	if err := sb.SetupSource(sub, true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sb.GetSourceQueueCount(context.Background()); err != nil || n != 2 {
+		t.Fatalf("Unexpected subscription count: %d, %v", n, err)
+	}
+	if err := sb.SetupTargetQueue("target", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := sb.RequeueManyMessages(context.Background(), nil, 2, nil, nil, false, false)
+	if err != nil || p.Completed != 2 {
+		t.Fatalf("Unexpected requeue result: %+v, %v", p, err)
+	}
+	if msgs, _ := b.Messages(sub.path(), true); len(msgs) != 0 {
+		t.Errorf("Subscription dead letter queue had unexpected number of messages: %d", len(msgs))
+	}
+	if msgs, _ := b.Messages("target", false); len(msgs) != 2 {
+		t.Errorf("Target had unexpected number of messages: %d", len(msgs))
+	}
+}
+
+func helper_newSessionBroker(t *testing.T) *Broker {
+	t.Helper()
+	b := NewBroker()
+	b.CreateSessionQueue("sessions")
+	for i, session := range []string{"a", "b", "a", "c"} {
+		if err := b.Send("sessions", false, helper_sessionMessage(fmt.Sprint(i), session)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func Test_MemoryController_Session_Send(t *testing.T) {
+	b := helper_newSessionBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("sessions", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.SendJsonMessage(context.Background(), false, []byte("{}")); !errors.Is(err, ErrSessionRequired) {
+		t.Errorf("Unexpected error sending without a session: %v", err)
+	}
+
+	if err := sb.SetupSource(Entity{Queue: "sessions", Session: "d"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sb.SendManyJsonMessages(context.Background(), false, [][]byte{[]byte("{}"), []byte("{}")}); err != nil || n != 2 {
+		t.Fatalf("Unexpected send result: %d, %v", n, err)
+	}
+	if n, err := sb.GetSourceQueueCount(context.Background()); err != nil || n != 2 {
+		t.Errorf("Unexpected session count: %d, %v", n, err)
+	}
+}
+
+func Test_MemoryController_Session_DeleteManyMessages(t *testing.T) {
+	b := helper_newSessionBroker(t)
+	sb := NewMemoryController(b)
+	if err := sb.SetupSource(Entity{Queue: "sessions", Session: "a"}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := make(chan Progress, 10)
+	p, err := sb.DeleteManyMessages(context.Background(), progress, 2, nil, nil)
+	close(progress)
+	if err != nil || p.Completed != 2 {
+		t.Fatalf("Unexpected delete result: %+v, %v", p, err)
+	}
+
+	msgs, _ := b.Messages("sessions", false)
+	if len(msgs) != 2 || msgs[0].SessionID != "b" || msgs[1].SessionID != "c" {
+		t.Errorf("Unexpected remaining messages: %+v", msgs)
+	}
+}
+
+func Test_MemoryController_Session_ReceiveOrder(t *testing.T) {
+	b := helper_newSessionBroker(t)
+	sb := NewMemoryController(b).(*ServiceBusController)
+	if err := sb.SetupSourceQueue("sessions", false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	seqs := []int64{}
+	err := sb.source.Receive(context.Background(), servicebus.HandlerFunc(func(ctx context.Context, m *servicebus.Message) error {
+		seqs = append(seqs, *m.SystemProperties.SequenceNumber)
+		return sb.source.complete(ctx, m)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// grouped by session, in the order of each session's first message
+	if len(seqs) != 4 || seqs[0] != 1 || seqs[1] != 3 || seqs[2] != 2 || seqs[3] != 4 {
+		t.Errorf("Unexpected receive order: %v", seqs)
+	}
+}
+
+func Test_MemoryController_SessionState(t *testing.T) {
+	sb := NewMemoryController(helper_newSessionBroker(t))
+	if err := sb.SetupSourceQueue("sessions", false, false); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := sb.SetSessionState(ctx, "a", []byte("step-2")); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := sb.GetSessionState(ctx, "a"); err != nil || string(state) != "step-2" {
+		t.Errorf("Unexpected state: %s, %v", state, err)
+	}
+	if err := sb.SetSessionState(ctx, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := sb.GetSessionState(ctx, "a"); err != nil || state != nil {
+		t.Errorf("State not cleared: %s, %v", state, err)
+	}
+
+	if err := sb.SetupSourceQueue("sessions", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sb.GetSessionState(ctx, "a"); !errors.Is(err, ErrNoSessions) {
+		t.Errorf("Unexpected error for a dead letter queue: %v", err)
+	}
+}
+
+func Test_MemoryController_GetSourceDetails(t *testing.T) {
+	b := NewBroker()
+	b.CreateQueue("testqueue")
+	b.CreateTopic("events")
+	b.Send("testqueue", false, &servicebus.Message{Data: []byte("hello")})
+	b.Send("testqueue", true, &servicebus.Message{Data: []byte("world!")})
+	sb := NewMemoryController(b)
+	if err := sb.SetupSourceQueue("testqueue", true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := sb.GetSourceDetails(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Entity != "testqueue" || d.ActiveMessages != 1 || d.DeadLetterMessages != 1 || d.SizeInBytes != 11 {
+		t.Errorf("Unexpected details: %+v", d)
+	}
+	if time.Duration(d.LockDuration) != time.Minute || d.MaxDeliveryCount != 10 || d.RequiresSession {
+		t.Errorf("Unexpected settings: %+v", d)
+	}
+
+	if err := sb.SetupSource(Entity{Topic: "events"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := sb.GetSourceDetails(context.Background()); err != nil || d.Entity != "events" || d.ActiveMessages != 0 {
+		t.Errorf("Unexpected topic details: %+v, %v", d, err)
+	}
+}
+
+func Test_MemoryController_ListEntities(t *testing.T) {
+	b := NewBroker()
+	b.CreateQueue("orders-eu")
+	b.CreateQueue("orders-us")
+	b.CreateQueue("payments")
+	b.CreateSubscription("events", "audit")
+	b.Send("orders-us", true, &servicebus.Message{Data: []byte("hello")})
+	sb := NewMemoryController(b)
+
+	all, err := sb.ListEntities(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, d := range all {
+		paths = append(paths, d.Entity)
+	}
+	if fmt.Sprint(paths) != "[events events/subscriptions/audit orders-eu orders-us payments]" {
+		t.Errorf("Unexpected entities: %v", paths)
+	}
+
+	orders, err := sb.ListEntities(context.Background(), "orders-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[1].Entity != "orders-us" || orders[1].DeadLetterMessages != 1 {
+		t.Errorf("Unexpected entities: %+v", orders)
+	}
+
+	if _, err := sb.ListEntities(context.Background(), "orders-["); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
@@ -0,0 +1,314 @@
+package sbcontroller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+const (
+	ERR_ENVELOPEBODY           string = "envelope cannot contain both body and bodyBase64"
+	PROP_DEADLETTERREASON      string = "DeadLetterReason"
+	PROP_DEADLETTERDESCRIPTION string = "DeadLetterErrorDescription"
+	PROP_ORIGINALMESSAGEID     string = "sb-shovel-original-message-id"
+	PROP_REQUEUEDREASON        string = "sb-shovel-deadletter-reason"
+	PROP_REQUEUEDAT            string = "sb-shovel-requeued-at"
+	PROP_REQUEUECOUNT          string = "sb-shovel-requeue-count"
+
+	contentTypeJson string = "application/json"
+)
+
+// Message is a read-only copy of a Service Bus message, exposing the properties useful when writing messages out for triage.
+//
+// Templates passed to sb-shovel are executed against this type, e.g. '{{.SequenceNumber}} - {{.ID}} - {{.Data | printf "%s"}}'.
+type Message struct {
+	ID                    string
+	CorrelationID         string
+	SessionID             string
+	SequenceNumber        int64
+	EnqueuedTime          time.Time
+	DeliveryCount         uint32
+	TTL                   time.Duration
+	ContentType           string
+	Label                 string
+	DeadLetterReason      string
+	DeadLetterDescription string
+	UserProperties        map[string]interface{}
+	Data                  []byte
+}
+
+// Archiver retains a copy of a message before it is deleted. Archive must only return once the copy is durable.
+type Archiver interface {
+	Archive(m *Message) error
+}
+
+// Envelope is the JSON representation of a Message, holding every system and user property alongside the body.
+//
+// Body is populated when the message data is valid JSON, otherwise the data is held as base64 in BodyBase64. An embedded body is written compacted,
+// without escaping characters such as '<' for HTML, so BodyCompacted marks a body that was not already compact, e.g. indented JSON, and is restored compacted.
+type Envelope struct {
+	MessageID             string                 `json:"messageId"`
+	CorrelationID         string                 `json:"correlationId,omitempty"`
+	SessionID             string                 `json:"sessionId,omitempty"`
+	SequenceNumber        int64                  `json:"sequenceNumber"`
+	EnqueuedTime          time.Time              `json:"enqueuedTime"`
+	DeliveryCount         uint32                 `json:"deliveryCount"`
+	TTL                   string                 `json:"ttl,omitempty"`
+	ContentType           string                 `json:"contentType,omitempty"`
+	Label                 string                 `json:"label,omitempty"`
+	UserProperties        map[string]interface{} `json:"userProperties,omitempty"`
+	DeadLetterReason      string                 `json:"deadLetterReason,omitempty"`
+	DeadLetterDescription string                 `json:"deadLetterDescription,omitempty"`
+	Body                  json.RawMessage        `json:"body,omitempty"`
+	BodyBase64            []byte                 `json:"bodyBase64,omitempty"`
+	BodyCompacted         bool                   `json:"bodyCompacted,omitempty"`
+}
+
+// Envelope converts the Message to its full JSON representation.
+func (m *Message) Envelope() *Envelope {
+	e := &Envelope{
+		MessageID:             m.ID,
+		CorrelationID:         m.CorrelationID,
+		SessionID:             m.SessionID,
+		SequenceNumber:        m.SequenceNumber,
+		EnqueuedTime:          m.EnqueuedTime,
+		DeliveryCount:         m.DeliveryCount,
+		ContentType:           m.ContentType,
+		Label:                 m.Label,
+		UserProperties:        m.UserProperties,
+		DeadLetterReason:      m.DeadLetterReason,
+		DeadLetterDescription: m.DeadLetterDescription,
+	}
+
+	if m.TTL > 0 {
+		e.TTL = m.TTL.String()
+	}
+
+	if json.Valid(m.Data) {
+		e.Body = json.RawMessage(m.Data)
+		e.BodyCompacted = !isCompactJson(m.Data)
+	} else {
+		e.BodyBase64 = m.Data
+	}
+
+	return e
+}
+
+// Marshal encodes the Envelope as a single line of JSON, without escaping characters such as '<' and '&' for HTML, so an embedded body is only compacted.
+func (e *Envelope) Marshal() ([]byte, error) {
+	return encodeJson(e)
+}
+
+// isCompactJson reports whether valid JSON data is written back unchanged when embedded as a json.RawMessage, i.e. it holds no insignificant whitespace.
+func isCompactJson(data []byte) bool {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return false
+	}
+	return bytes.Equal(compact.Bytes(), data)
+}
+
+// ParseEnvelope reads a single line of JSON, as written by the envelope output format, into an Envelope.
+//
+// Numeric user properties are restored as int64 where possible, otherwise float64.
+func ParseEnvelope(b []byte) (*Envelope, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	e := &Envelope{}
+	if err := d.Decode(e); err != nil {
+		return nil, err
+	}
+
+	if e.Body != nil && e.BodyBase64 != nil {
+		return nil, ErrEnvelopeBody
+	}
+
+	for k, v := range e.UserProperties {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				e.UserProperties[k] = i
+				continue
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			e.UserProperties[k] = f
+		}
+	}
+
+	return e, nil
+}
+
+func (e *Envelope) toServiceBusMessage() (*servicebus.Message, error) {
+	m := &servicebus.Message{
+		ID:             e.MessageID,
+		CorrelationID:  e.CorrelationID,
+		ContentType:    e.ContentType,
+		Label:          e.Label,
+		UserProperties: e.UserProperties,
+		Data:           e.BodyBase64,
+	}
+
+	if e.Body != nil {
+		m.Data = []byte(e.Body)
+	}
+
+	if e.SessionID != "" {
+		m.SessionID = &e.SessionID
+	}
+
+	if e.TTL != "" {
+		ttl, err := time.ParseDuration(e.TTL)
+		if err != nil {
+			return nil, err
+		}
+		m.TTL = &ttl
+	}
+
+	return m, nil
+}
+
+// newRequeueMessage copies a received message into a new message to be sent, preserving the body, MessageID and all user-settable properties.
+// The DeadLetterReason and DeadLetterErrorDescription user properties are removed, as the copy has not been dead-lettered.
+//
+// When newID is true, the copy is given a new MessageID, e.g. so that a target with duplicate detection does not drop it as a repeat of the original,
+// and the MessageID of the first message requeued is stamped onto the user properties.
+//
+// When audit is true, the dead-letter reason, the time of requeue and an incremented requeue count are stamped onto the user properties.
+func newRequeueMessage(m *servicebus.Message, audit, newID bool) *servicebus.Message {
+	msg := &servicebus.Message{
+		ID:             m.ID,
+		ContentType:    m.ContentType,
+		CorrelationID:  m.CorrelationID,
+		Data:           m.Data,
+		Label:          m.Label,
+		ReplyTo:        m.ReplyTo,
+		ReplyToGroupID: m.ReplyToGroupID,
+		To:             m.To,
+		TTL:            m.TTL,
+		UserProperties: make(map[string]interface{}, len(m.UserProperties)),
+	}
+
+	if m.SessionID != nil {
+		id := *m.SessionID
+		msg.SessionID = &id
+	}
+
+	for k, v := range m.UserProperties {
+		if k == PROP_DEADLETTERREASON || k == PROP_DEADLETTERDESCRIPTION {
+			continue
+		}
+		msg.UserProperties[k] = v
+	}
+
+	if newID {
+		msg.ID = newMessageID()
+		// a message requeued again keeps the MessageID it was first sent with
+		if _, ok := msg.UserProperties[PROP_ORIGINALMESSAGEID]; !ok && m.ID != "" {
+			msg.UserProperties[PROP_ORIGINALMESSAGEID] = m.ID
+		}
+	}
+
+	if audit {
+		if reason, ok := m.UserProperties[PROP_DEADLETTERREASON].(string); ok {
+			msg.UserProperties[PROP_REQUEUEDREASON] = reason
+		}
+		msg.UserProperties[PROP_REQUEUEDAT] = time.Now().UTC().Format(time.RFC3339)
+		msg.UserProperties[PROP_REQUEUECOUNT] = requeueCount(m.UserProperties[PROP_REQUEUECOUNT]) + 1
+	}
+
+	return msg
+}
+
+// newMessageID returns a random MessageID, as 32 hex characters.
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newTransformedMessage copies a received message as in newRequeueMessage, then rewrites the body using the transform, if provided.
+func newTransformedMessage(m *servicebus.Message, transform Transform, audit, newID bool) (*servicebus.Message, error) {
+	msg := newRequeueMessage(m, audit, newID)
+	if transform == nil {
+		return msg, nil
+	}
+	original := newMessage(m)
+	data, err := transform.Apply(original)
+	if err != nil {
+		return nil, newMessageError("transform", original, err)
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+func requeueCount(v interface{}) int64 {
+	switch c := v.(type) {
+	case int64:
+		return c
+	case int32:
+		return int64(c)
+	case int:
+		return int64(c)
+	case float64:
+		return int64(c)
+	}
+	return 0
+}
+
+// NewJsonEnvelope returns an Envelope for a JSON message body with a MessageID, sent as SendJsonMessage would send the body alone.
+func NewJsonEnvelope(id string, data []byte) *Envelope {
+	return &Envelope{MessageID: id, ContentType: contentTypeJson, BodyBase64: data}
+}
+
+func newJsonMessage(data []byte) *servicebus.Message {
+	return &servicebus.Message{
+		Data:        data,
+		ContentType: contentTypeJson,
+	}
+}
+
+func newMessage(m *servicebus.Message) *Message {
+	msg := &Message{
+		ID:             m.ID,
+		CorrelationID:  m.CorrelationID,
+		DeliveryCount:  m.DeliveryCount,
+		ContentType:    m.ContentType,
+		Label:          m.Label,
+		UserProperties: m.UserProperties,
+		Data:           m.Data,
+	}
+
+	if m.SessionID != nil {
+		msg.SessionID = *m.SessionID
+	}
+
+	if m.TTL != nil {
+		msg.TTL = *m.TTL
+	}
+
+	if m.SystemProperties != nil {
+		if m.SystemProperties.SequenceNumber != nil {
+			msg.SequenceNumber = *m.SystemProperties.SequenceNumber
+		}
+		if m.SystemProperties.EnqueuedTime != nil {
+			msg.EnqueuedTime = *m.SystemProperties.EnqueuedTime
+		}
+	}
+
+	if reason, ok := m.UserProperties[PROP_DEADLETTERREASON].(string); ok {
+		msg.DeadLetterReason = reason
+	}
+
+	if description, ok := m.UserProperties[PROP_DEADLETTERDESCRIPTION].(string); ok {
+		msg.DeadLetterDescription = description
+	}
+
+	return msg
+}
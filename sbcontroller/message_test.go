@@ -0,0 +1,287 @@
+package sbcontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func Test_Message_NewMessage_Properties(t *testing.T) {
+	seq := int64(42)
+	enqueued := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	session := "session-1"
+	ttl := time.Hour
+
+	m := newMessage(&servicebus.Message{
+		ID:            "id-1",
+		CorrelationID: "correlation-1",
+		SessionID:     &session,
+		DeliveryCount: 3,
+		TTL:           &ttl,
+		ContentType:   "application/json",
+		Label:         "order",
+		UserProperties: map[string]interface{}{
+			PROP_DEADLETTERREASON:      "MaxDeliveryCountExceeded",
+			PROP_DEADLETTERDESCRIPTION: "Message could not be consumed after 10 delivery attempts.",
+		},
+		SystemProperties: &servicebus.SystemProperties{SequenceNumber: &seq, EnqueuedTime: &enqueued},
+		Data:             []byte(`{"message":"hello, world"}`),
+	})
+
+	if m.SequenceNumber != seq || !m.EnqueuedTime.Equal(enqueued) {
+		t.Errorf("Unexpected system properties: %d %v", m.SequenceNumber, m.EnqueuedTime)
+	}
+
+	if m.SessionID != session || m.TTL != ttl || m.DeliveryCount != 3 {
+		t.Errorf("Unexpected message properties: %s %v %d", m.SessionID, m.TTL, m.DeliveryCount)
+	}
+
+	if m.DeadLetterReason != "MaxDeliveryCountExceeded" || m.DeadLetterDescription == "" {
+		t.Errorf("Unexpected dead letter properties: %s %s", m.DeadLetterReason, m.DeadLetterDescription)
+	}
+}
+
+func Test_Message_Envelope_JsonBody(t *testing.T) {
+	m := &Message{ID: "id-1", TTL: 90 * time.Second, Data: []byte(`{"message":"hello, world"}`)}
+
+	b, err := json.Marshal(m.Envelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := map[string]interface{}{}
+	if err = json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	body, ok := e["body"].(map[string]interface{})
+	if !ok || body["message"] != "hello, world" {
+		t.Errorf("Body was not embedded as JSON: %s", b)
+	}
+
+	if _, ok := e["bodyBase64"]; ok {
+		t.Errorf("Unexpected base64 body: %s", b)
+	}
+
+	if e["ttl"] != "1m30s" {
+		t.Errorf("Unexpected ttl: %v", e["ttl"])
+	}
+}
+
+func Test_Message_Envelope_Base64Body(t *testing.T) {
+	m := &Message{ID: "id-1", Data: []byte("hello, world")}
+
+	b, err := json.Marshal(m.Envelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := Envelope{}
+	if err = json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Body != nil {
+		t.Errorf("Unexpected JSON body: %s", e.Body)
+	}
+
+	if string(e.BodyBase64) != "hello, world" {
+		t.Errorf("Unexpected base64 body: %s", e.BodyBase64)
+	}
+}
+
+func Test_Message_Envelope_JsonBody_Embedded(t *testing.T) {
+	for _, c := range []struct {
+		body, written string
+		compacted     bool
+	}{
+		{`{"html":"<b>&</b>"}`, `{"html":"<b>&</b>"}`, false},
+		{"{\n  \"message\": \"hello\"\n}", `{"message":"hello"}`, true},
+		{`{"a":1} `, `{"a":1}`, true},
+	} {
+		m := &Message{ID: "id-1", Data: []byte(c.body)}
+		b, err := m.Envelope().Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"body":`+c.written) || strings.Contains(string(b), "\n") {
+			t.Errorf("Body %q was not embedded as JSON: %s", c.body, b)
+		}
+		e, err := ParseEnvelope(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.BodyBase64 != nil || string(e.Body) != c.written || e.BodyCompacted != c.compacted {
+			t.Errorf("Unexpected body for %q: %s, base64 %q, compacted %v", c.body, e.Body, e.BodyBase64, e.BodyCompacted)
+		}
+	}
+}
+
+func Test_Message_ParseEnvelope_RoundTrip(t *testing.T) {
+	session := "session-1"
+	original := &Message{
+		ID:             "id-1",
+		CorrelationID:  "correlation-1",
+		SessionID:      session,
+		TTL:            time.Hour,
+		ContentType:    "application/json",
+		Label:          "order",
+		UserProperties: map[string]interface{}{"retries": int64(2), "ratio": 0.5, "type": "order"},
+		Data:           []byte(`{"message":"hello, world"}`),
+	}
+
+	b, err := json.Marshal(original.Envelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := ParseEnvelope(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := e.toServiceBusMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ID != original.ID || m.CorrelationID != original.CorrelationID || m.Label != original.Label || m.ContentType != original.ContentType {
+		t.Errorf("Unexpected message properties: %+v", m)
+	}
+
+	if m.SessionID == nil || *m.SessionID != session {
+		t.Errorf("Unexpected session: %v", m.SessionID)
+	}
+
+	if m.TTL == nil || *m.TTL != time.Hour {
+		t.Errorf("Unexpected ttl: %v", m.TTL)
+	}
+
+	if m.UserProperties["retries"] != int64(2) || m.UserProperties["ratio"] != 0.5 || m.UserProperties["type"] != "order" {
+		t.Errorf("Unexpected user properties: %v", m.UserProperties)
+	}
+
+	if string(m.Data) != string(original.Data) {
+		t.Errorf("Unexpected body: %s", m.Data)
+	}
+}
+
+func Test_Message_ParseEnvelope_Base64Body(t *testing.T) {
+	e, err := ParseEnvelope([]byte(`{"messageId":"id-1","bodyBase64":"aGVsbG8gd29ybGQ="}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := e.toServiceBusMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.Data) != "hello world" {
+		t.Errorf("Unexpected body: %s", m.Data)
+	}
+
+	if m.SessionID != nil || m.TTL != nil {
+		t.Errorf("Unexpected optional properties: %v %v", m.SessionID, m.TTL)
+	}
+}
+
+func Test_Message_ParseEnvelope_Fail_BothBodies(t *testing.T) {
+	_, err := ParseEnvelope([]byte(`{"messageId":"id-1","body":{},"bodyBase64":"aGVsbG8gd29ybGQ="}`))
+	if !errors.Is(err, ErrEnvelopeBody) {
+		t.Error(err)
+	}
+}
+
+func Test_Message_NewRequeueMessage_PreservesProperties(t *testing.T) {
+	session := "session-1"
+	ttl := time.Hour
+	original := &servicebus.Message{
+		ID:             "id-1",
+		CorrelationID:  "correlation-1",
+		SessionID:      &session,
+		TTL:            &ttl,
+		ContentType:    "text/plain",
+		Label:          "order",
+		UserProperties: map[string]interface{}{"type": "order", PROP_DEADLETTERREASON: "MaxDeliveryCountExceeded"},
+		DeliveryCount:  10,
+		Data:           []byte("hello, world"),
+	}
+
+	m := newRequeueMessage(original, false, false)
+
+	if m.CorrelationID != original.CorrelationID || m.ContentType != original.ContentType || m.Label != original.Label {
+		t.Errorf("Unexpected message properties: %+v", m)
+	}
+
+	if m.ID != original.ID {
+		t.Errorf("MessageID was not copied: %s", m.ID)
+	}
+
+	if m.SessionID == nil || *m.SessionID != session || m.TTL == nil || *m.TTL != ttl {
+		t.Errorf("Unexpected session or ttl: %v %v", m.SessionID, m.TTL)
+	}
+
+	if m.DeliveryCount != 0 {
+		t.Errorf("Delivery count was copied: %d", m.DeliveryCount)
+	}
+
+	// the copy has not been dead-lettered
+	if len(m.UserProperties) != 1 || m.UserProperties["type"] != "order" {
+		t.Errorf("Unexpected user properties: %v", m.UserProperties)
+	}
+
+	m.UserProperties["type"] = "changed"
+	if original.UserProperties["type"] != "order" {
+		t.Error("User properties were not copied")
+	}
+}
+
+func Test_Message_NewRequeueMessage_Audit(t *testing.T) {
+	original := &servicebus.Message{
+		ID:             "id-1",
+		UserProperties: map[string]interface{}{PROP_DEADLETTERREASON: "MaxDeliveryCountExceeded", PROP_REQUEUECOUNT: int64(2)},
+		Data:           []byte("hello, world"),
+	}
+
+	m := newRequeueMessage(original, true, false)
+
+	if m.UserProperties[PROP_REQUEUEDREASON] != "MaxDeliveryCountExceeded" || m.UserProperties[PROP_DEADLETTERREASON] != nil {
+		t.Errorf("Unexpected requeue reason: %v", m.UserProperties)
+	}
+
+	if _, ok := m.UserProperties[PROP_ORIGINALMESSAGEID]; ok || m.ID != "id-1" {
+		t.Errorf("Unexpected MessageID: %s %v", m.ID, m.UserProperties[PROP_ORIGINALMESSAGEID])
+	}
+
+	if m.UserProperties[PROP_REQUEUECOUNT] != int64(3) {
+		t.Errorf("Unexpected requeue count: %v", m.UserProperties[PROP_REQUEUECOUNT])
+	}
+
+	if _, err := time.Parse(time.RFC3339, m.UserProperties[PROP_REQUEUEDAT].(string)); err != nil {
+		t.Errorf("Unexpected requeue time: %v", err)
+	}
+}
+
+func Test_Message_NewRequeueMessage_NewID(t *testing.T) {
+	original := &servicebus.Message{ID: "id-1", Data: []byte("hello, world")}
+
+	m := newRequeueMessage(original, false, true)
+
+	if m.ID == "" || m.ID == original.ID || newRequeueMessage(original, false, true).ID == m.ID {
+		t.Errorf("Copy was not given a new MessageID: %s", m.ID)
+	}
+
+	if m.UserProperties[PROP_ORIGINALMESSAGEID] != "id-1" {
+		t.Errorf("Unexpected original MessageID: %v", m.UserProperties[PROP_ORIGINALMESSAGEID])
+	}
+
+	// requeued again, the first MessageID is kept
+	if again := newRequeueMessage(m, false, true); again.UserProperties[PROP_ORIGINALMESSAGEID] != "id-1" {
+		t.Errorf("Unexpected original MessageID: %v", again.UserProperties[PROP_ORIGINALMESSAGEID])
+	}
+}
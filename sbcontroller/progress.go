@@ -0,0 +1,112 @@
+package sbcontroller
+
+import (
+	"sync"
+	"time"
+)
+
+// progressInterval is the number of messages processed between each progress event.
+const progressInterval = 50
+
+// Progress is a snapshot of an operation on many messages. Events are sent while the operation runs, and the final state is returned once it completes.
+//
+// Processed counts messages received, or peeked, by the operation. Matched counts messages selected by the operation's filter or pattern
+// (every message, when there is none). Each received message is then settled with one outcome:
+//   - Completed: the message was acted on, e.g. deleted or requeued, and removed from the queue.
+//   - Abandoned: the message was not matched, and returned to the queue.
+//   - Failed: the message could not be acted on or settled, e.g. it could not be archived, or every attempt to complete it failed.
+//   - LockLost: the message's lock expired before it was settled. The message remains on the queue, and will be redelivered.
+//
+// Retried counts attempts to settle a message that failed and were retried. Unreached counts messages selected by peeking, as matching the
+// operation's filter or pattern, that were not received before the operation stopped, e.g. as they were behind a message redelivered.
+//
+// Message is set when the event reports a single matched message, e.g. each match identified by TidyMessages.
+type Progress struct {
+	Total     int
+	Processed int
+	Matched   int
+	Completed int
+	Abandoned int
+	Failed    int
+	LockLost  int
+	Retried   int
+	Unreached int
+	Elapsed   time.Duration
+	Message   *Message
+}
+
+// Unsettled returns the number of messages whose outcome is not what the operation intended, i.e. Failed and LockLost.
+func (p Progress) Unsettled() int {
+	return p.Failed + p.LockLost
+}
+
+// Rate returns the number of messages processed per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Processed) / p.Elapsed.Seconds()
+}
+
+// progressTracker counts the messages processed by an operation, safely across goroutines, sending events to an optional channel.
+type progressTracker struct {
+	mu    sync.Mutex
+	p     Progress
+	start time.Time
+	out   chan<- Progress
+}
+
+func newProgressTracker(out chan<- Progress, total int) *progressTracker {
+	return &progressTracker{p: Progress{Total: total}, start: time.Now(), out: out}
+}
+
+// processed counts a received or peeked message, sending an event every progressInterval messages.
+func (t *progressTracker) processed() {
+	t.mu.Lock()
+	t.p.Processed++
+	notify := t.p.Processed%progressInterval == 0
+	t.mu.Unlock()
+	if notify {
+		t.send(nil)
+	}
+}
+
+// matched counts a message selected by the operation. When notify is true, an event reporting the message is sent.
+func (t *progressTracker) matched(m *Message, notify bool) {
+	t.count(func(p *Progress) { p.Matched++ })
+	if notify {
+		t.send(m)
+	}
+}
+
+func (t *progressTracker) completed() { t.count(func(p *Progress) { p.Completed++ }) }
+func (t *progressTracker) abandoned() { t.count(func(p *Progress) { p.Abandoned++ }) }
+func (t *progressTracker) failed()    { t.count(func(p *Progress) { p.Failed++ }) }
+func (t *progressTracker) lockLost()  { t.count(func(p *Progress) { p.LockLost++ }) }
+func (t *progressTracker) retried()   { t.count(func(p *Progress) { p.Retried++ }) }
+
+// unreached counts n selected messages that were not received.
+func (t *progressTracker) unreached(n int) { t.count(func(p *Progress) { p.Unreached += n }) }
+
+func (t *progressTracker) count(f func(p *Progress)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.p)
+}
+
+func (t *progressTracker) snapshot() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.p
+	p.Elapsed = time.Since(t.start)
+	return p
+}
+
+func (t *progressTracker) send(m *Message) {
+	if t.out == nil {
+		return
+	}
+	p := t.snapshot()
+	p.Message = m
+	t.out <- p
+}
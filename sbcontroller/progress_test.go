@@ -0,0 +1,45 @@
+package sbcontroller
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Progress_Rate(t *testing.T) {
+	p := Progress{Processed: 100, Elapsed: 2 * time.Second}
+	if p.Rate() != 50 {
+		t.Errorf("Unexpected rate: %f", p.Rate())
+	}
+	if (Progress{Processed: 100}).Rate() != 0 {
+		t.Error("rate was not zero without elapsed time")
+	}
+}
+
+func Test_ProgressTracker_Events(t *testing.T) {
+	out := make(chan Progress, 10)
+	tracker := newProgressTracker(out, 120)
+
+	for i := 0; i < 120; i++ {
+		tracker.processed()
+	}
+	tracker.matched(&Message{ID: "abc"}, true)
+	tracker.matched(&Message{ID: "def"}, false)
+	tracker.failed()
+	close(out)
+
+	events := []Progress{}
+	for p := range out {
+		events = append(events, p)
+	}
+	if len(events) != 3 || events[0].Processed != 50 || events[1].Processed != 100 {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+	if events[2].Message == nil || events[2].Message.ID != "abc" || events[2].Matched != 1 {
+		t.Errorf("Unexpected match event: %+v", events[2])
+	}
+
+	p := tracker.snapshot()
+	if p.Total != 120 || p.Processed != 120 || p.Matched != 2 || p.Failed != 1 || p.Unsettled() != 1 || p.Message != nil {
+		t.Errorf("Unexpected final progress: %+v", p)
+	}
+}
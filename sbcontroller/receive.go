@@ -0,0 +1,125 @@
+package sbcontroller
+
+import (
+	"context"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+// receiveIdleTimeout is the time the source queue is waited on for its next message, before an operation on many messages stops.
+const receiveIdleTimeout time.Duration = 5 * time.Second
+
+// An abandoned message is made available again ahead of the messages behind it, so the broker redelivers it, incrementing its DeliveryCount,
+// rather than moving on. Abandoning a message each time it is redelivered would dead-letter it once it reaches the entity's MaxDeliveryCount,
+// without reaching the rest of the queue.
+//
+// So operations acting only on messages matching a filter first peek the source, selecting the matched messages by sequence number, and receive
+// nothing when none match. Receiving stops once every selected message, or the total, is received, a message is redelivered, or no message arrives
+// within receiveIdleTimeout. A message not selected is delivered at most twice by an operation: when it is first received, and when its redelivery
+// stops the operation. Selected messages behind it, beyond those already prefetched, are counted as Progress.Unreached, for a later operation.
+
+// selection is the set of messages an operation acts on, by sequence number. A nil selection holds every message.
+type selection map[int64]bool
+
+// take reports whether a received message is selected, removing it from the selection, so that only selected messages not yet received remain.
+func (s selection) take(m *servicebus.Message) bool {
+	if s == nil {
+		return true
+	}
+	seq, ok := sequenceNumber(m)
+	if !ok || !s[seq] {
+		return false
+	}
+	delete(s, seq)
+	return true
+}
+
+// done reports whether every selected message has been received.
+func (s selection) done() bool {
+	return s != nil && len(s) == 0
+}
+
+// sequenceNumber returns the sequence number of a received or peeked message, reporting false if it is not set.
+func sequenceNumber(m *servicebus.Message) (int64, bool) {
+	if m.SystemProperties == nil || m.SystemProperties.SequenceNumber == nil {
+		return 0, false
+	}
+	return *m.SystemProperties.SequenceNumber, true
+}
+
+// selectMessages peeks up to max messages on the source queue, returning those matched. A nil match selects every message without peeking.
+func (sb *ServiceBusController) selectMessages(ctx context.Context, max int, match func(m *Message) bool) (selection, error) {
+	if match == nil {
+		return nil, nil
+	}
+	it, err := sb.peek(ctx)
+	if err != nil {
+		return nil, entityError(err)
+	}
+	s := selection{}
+	for peeked := 0; peeked < max && !it.Done(); peeked++ {
+		m, err := sb.next(ctx, it)
+		if err != nil {
+			if _, ok := err.(servicebus.ErrNoMessages); ok && ctx.Err() == nil {
+				break
+			}
+			return nil, operationError(ctx, nil, entityError(err))
+		}
+		if seq, ok := sequenceNumber(m); ok && match(newMessage(m)) {
+			s[seq] = true
+		}
+	}
+	return s, nil
+}
+
+// receiveMany receives up to total messages from the source queue, passing each selected message to process, and abandoning the rest.
+// process returns false if it did not take the message, e.g. as the operation stopped while it waited for a worker, and the message is abandoned.
+//
+// Receiving stops as described above, or once ctx is cancelled. Messages received after then are abandoned without an outcome.
+func (sb *ServiceBusController) receiveMany(ctx context.Context, tracker *progressTracker, total int, selected selection, process func(m *servicebus.Message) bool) error {
+	if selected.done() {
+		return nil
+	}
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	received := 0
+	seen := make(map[int64]bool)
+	idle := time.AfterFunc(receiveIdleTimeout, cancel)
+	defer idle.Stop()
+
+	handler := servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
+		// the idle timeout does not run while a message is processed, e.g. while it waits for the rate limit
+		idle.Stop()
+		if innerCtx.Err() != nil {
+			sb.abandonMessage(m)
+			return nil
+		}
+		if seq, ok := sequenceNumber(m); ok {
+			if seen[seq] {
+				cancel()
+				sb.abandonMessage(m)
+				return nil
+			}
+			seen[seq] = true
+		}
+		received++
+		tracker.processed()
+		switch {
+		case !selected.take(m):
+			sb.settleMessage(tracker, m, false)
+		case !process(m):
+			sb.abandonMessage(m)
+		}
+		if received == total || selected.done() {
+			cancel()
+			return nil
+		}
+		idle.Reset(receiveIdleTimeout)
+		return nil
+	})
+	// a lost link ends Receive, so receiving is restarted
+	err := sb.retrier.do(innerCtx, func() error { return sb.source.Receive(innerCtx, handler) })
+	tracker.unreached(len(selected))
+	return err
+}
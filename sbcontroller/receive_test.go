@@ -0,0 +1,32 @@
+package sbcontroller
+
+import (
+	"testing"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func helper_sequenced(seq int64) *servicebus.Message {
+	return &servicebus.Message{SystemProperties: &servicebus.SystemProperties{SequenceNumber: &seq}}
+}
+
+func Test_Selection_Take(t *testing.T) {
+	s := selection{1: true, 3: true}
+
+	if !s.take(helper_sequenced(1)) || s.take(helper_sequenced(2)) || s.take(&servicebus.Message{}) {
+		t.Error("Unexpected selection of received messages")
+	}
+	if s.take(helper_sequenced(1)) {
+		t.Error("Message was taken twice")
+	}
+	if s.done() || !s.take(helper_sequenced(3)) || !s.done() {
+		t.Errorf("Unexpected remaining selection: %v", s)
+	}
+}
+
+func Test_Selection_Nil(t *testing.T) {
+	var s selection
+	if !s.take(helper_sequenced(1)) || !s.take(&servicebus.Message{}) || s.done() {
+		t.Error("A nil selection did not hold every message")
+	}
+}
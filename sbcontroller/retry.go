@@ -0,0 +1,201 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// retryBackoff is the delay before the first retry of a failed call, doubling with each retry up to maxRetryBackoff.
+	retryBackoff time.Duration = 250 * time.Millisecond
+	// maxRetryBackoff is the longest delay between retries, and the longest pause after throttling.
+	maxRetryBackoff time.Duration = 30 * time.Second
+	// throttlePause is the time every call waits after the broker signals throttling, doubling while throttling continues.
+	throttlePause time.Duration = 2 * time.Second
+
+	// errorServerBusy is the AMQP error condition with which Service Bus signals ServerBusy.
+	errorServerBusy amqp.ErrorCondition = "com.microsoft:server-busy"
+)
+
+// RetryStats counts the calls to Service Bus retried after transient errors, over the lifetime of a Controller.
+type RetryStats struct {
+	// Retried is the number of failed calls that were retried, including attempts to settle a message.
+	Retried int
+	// Throttled is the number of failed calls where the broker signalled throttling, e.g. ServerBusy or a quota being exceeded.
+	Throttled int
+}
+
+// isThrottled reports whether an error signals that the broker is throttling requests, by the AMQP error condition of ServerBusy,
+// or of a quota being exceeded. A status code, or other text, in an error's message is not a signal.
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ae *amqp.Error
+	if errors.As(err, &ae) {
+		return isThrottledCondition(ae.Condition)
+	}
+	var de *amqp.DetachError
+	if errors.As(err, &de) {
+		return de.RemoteError != nil && isThrottledCondition(de.RemoteError.Condition)
+	}
+	// azure-service-bus-go does not wrap every error it returns, so the condition is also matched in the error's message
+	msg := err.Error()
+	for _, c := range throttledConditions {
+		if strings.Contains(msg, string(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// throttledConditions are the AMQP error conditions of ServerBusy, and of a quota being exceeded.
+var throttledConditions = []amqp.ErrorCondition{errorServerBusy, amqp.ErrorResourceLimitExceeded}
+
+func isThrottledCondition(c amqp.ErrorCondition) bool {
+	for _, t := range throttledConditions {
+		if c == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient reports whether a failed call may succeed if retried, i.e. the broker is throttling, or an AMQP connection, session or link was lost.
+//
+// Errors for a single message, such as a MessageError or a lost lock, and cancellation, are not transient.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || isLockLost(err) {
+		return false
+	}
+	var me *MessageError
+	if errors.As(err, &me) {
+		return false
+	}
+	if isThrottled(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"detach-forced", "connection:forced", "link closed", "link detached", "session closed", "connection closed",
+		"server-timeout", "com.microsoft:timeout", "connection reset", "broken pipe", "i/o timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrier retries calls failing with transient errors, with an exponential backoff and jitter, up to a maximum number of attempts.
+//
+// When the broker signals throttling, every call made through the retrier pauses, so concurrent workers slow down together.
+// The pause doubles while throttling continues, and is reset by a successful call.
+type retrier struct {
+	attempts                   int
+	backoff, maxBackoff, pause time.Duration
+
+	mu          sync.Mutex
+	stats       RetryStats
+	pausedUntil time.Time
+	nextPause   time.Duration
+}
+
+func newRetrier(attempts int) *retrier {
+	return &retrier{attempts: attempts, backoff: retryBackoff, maxBackoff: maxRetryBackoff, pause: throttlePause}
+}
+
+// do calls f until it succeeds, returns an error that is not transient, or the maximum number of attempts is reached. The last error is returned.
+func (r *retrier) do(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+		err := f()
+		if err == nil {
+			r.succeeded()
+			return nil
+		}
+		if !isTransient(err) || attempt >= r.attempts || ctx.Err() != nil {
+			return err
+		}
+		r.retried(err)
+		if sleep(ctx, r.delay(attempt)) != nil {
+			return err
+		}
+	}
+}
+
+// delay returns the backoff before a retry, after attempt failed attempts, with jitter so concurrent workers do not retry together.
+func (r *retrier) delay(attempt int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retried counts a retry, pausing every call if the error signals throttling.
+func (r *retrier) retried(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Retried++
+	if !isThrottled(err) {
+		return
+	}
+	r.stats.Throttled++
+	if r.nextPause == 0 {
+		r.nextPause = r.pause
+	}
+	if until := time.Now().Add(r.nextPause); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+	r.nextPause *= 2
+	if r.nextPause > r.maxBackoff {
+		r.nextPause = r.maxBackoff
+	}
+}
+
+// succeeded resets the throttling pause.
+func (r *retrier) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextPause = 0
+}
+
+// wait blocks while calls are paused by throttling.
+func (r *retrier) wait(ctx context.Context) error {
+	r.mu.Lock()
+	d := time.Until(r.pausedUntil)
+	r.mu.Unlock()
+	if d <= 0 {
+		return ctx.Err()
+	}
+	return sleep(ctx, d)
+}
+
+func (r *retrier) snapshot() RetryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// sleep waits for a duration, returning early with the context error if the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,154 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func helper_newRetrier(attempts int) *retrier {
+	r := newRetrier(attempts)
+	r.backoff = time.Millisecond
+	r.pause = time.Millisecond
+	return r
+}
+
+func Test_IsTransient(t *testing.T) {
+	transient := []error{
+		errors.New("com.microsoft:server-busy: The request was terminated because the entity is being throttled"),
+		errors.New("amqp:link:detach-forced"),
+		fmt.Errorf("receive: %w", io.EOF),
+		fmt.Errorf("send: %w", &amqp.Error{Condition: amqp.ErrorResourceLimitExceeded, Description: "quota exceeded"}),
+		&amqp.DetachError{RemoteError: &amqp.Error{Condition: errorServerBusy}},
+	}
+	for _, err := range transient {
+		if !isTransient(err) {
+			t.Errorf("Error was not transient: %v", err)
+		}
+	}
+
+	permanent := []error{
+		errors.New("unauthorised"),
+		ErrLockLost,
+		context.Canceled,
+		&MessageError{Op: "send", Err: errors.New("com.microsoft:server-busy")},
+		nil,
+	}
+	for _, err := range permanent {
+		if isTransient(err) {
+			t.Errorf("Error was transient: %v", err)
+		}
+	}
+}
+
+func Test_IsThrottled(t *testing.T) {
+	throttled := []error{
+		&amqp.Error{Condition: errorServerBusy},
+		errors.New("com.microsoft:server-busy: The request was terminated because the entity is being throttled"),
+		errors.New("*Error{Condition: amqp:resource-limit-exceeded, Description: quota exceeded}"),
+	}
+	for _, err := range throttled {
+		if !isThrottled(err) {
+			t.Errorf("Error was not throttled: %v", err)
+		}
+	}
+
+	// status codes, or words, in a message are not a signal, e.g. in a body or an entity name
+	other := []error{
+		errors.New("error code: 503, server busy"),
+		errors.New("message 429 could not be archived: quota"),
+		&amqp.Error{Condition: amqp.ErrorNotFound, Description: "com.microsoft:server-busy"},
+		&amqp.DetachError{},
+	}
+	for _, err := range other {
+		if isThrottled(err) {
+			t.Errorf("Error was throttled: %v", err)
+		}
+	}
+}
+
+func Test_Retrier_Do_Transient(t *testing.T) {
+	r := helper_newRetrier(3)
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("amqp:link:detach-forced")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Unexpected result after %d calls: %v", calls, err)
+	}
+	if s := r.snapshot(); s.Retried != 2 || s.Throttled != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func Test_Retrier_Do_Fail_Attempts(t *testing.T) {
+	r := helper_newRetrier(3)
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		return &amqp.Error{Condition: errorServerBusy}
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Unexpected result after %d calls: %v", calls, err)
+	}
+	if s := r.snapshot(); s.Retried != 2 || s.Throttled != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func Test_Retrier_Do_Fail_Permanent(t *testing.T) {
+	r := helper_newRetrier(3)
+	calls := 0
+	err := r.do(context.Background(), func() error {
+		calls++
+		return ErrNotFound
+	})
+	if !errors.Is(err, ErrNotFound) || calls != 1 {
+		t.Errorf("Unexpected result after %d calls: %v", calls, err)
+	}
+}
+
+func Test_Retrier_Throttled_Pauses(t *testing.T) {
+	r := newRetrier(3)
+	r.pause = 50 * time.Millisecond
+	r.retried(&amqp.Error{Condition: errorServerBusy})
+
+	start := time.Now()
+	if err := r.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Calls were not paused after throttling, waited %v", elapsed)
+	}
+
+	// throttling again doubles the pause, until a call succeeds
+	if r.nextPause != 100*time.Millisecond {
+		t.Errorf("Unexpected next pause: %v", r.nextPause)
+	}
+	r.succeeded()
+	if r.nextPause != 0 {
+		t.Errorf("Pause was not reset: %v", r.nextPause)
+	}
+}
+
+func Test_Retrier_Delay(t *testing.T) {
+	r := newRetrier(10)
+	for attempt := 1; attempt < 10; attempt++ {
+		d := r.delay(attempt)
+		if d < retryBackoff/2 || d > maxRetryBackoff {
+			t.Errorf("Delay out of bounds for attempt %d: %v", attempt, d)
+		}
+	}
+	if d := r.delay(20); d < maxRetryBackoff/2 {
+		t.Errorf("Delay was not capped: %v", d)
+	}
+}
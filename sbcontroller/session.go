@@ -0,0 +1,271 @@
+package sbcontroller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+const (
+	ERR_NOSESSIONS      string = "entity does not require sessions"
+	ERR_SESSIONREQUIRED string = "messages sent to a session-enabled entity require a SessionID, provide -session"
+
+	// sessionIdleTimeout is the time a session is waited on for its next message, before moving to the next session.
+	sessionIdleTimeout time.Duration = 5 * time.Second
+)
+
+// Receiving from a session-enabled queue or subscription requires a lock on one session at a time, so a session-enabled serviceBusEntity
+// peeks the entity for the sessions holding messages, then receives from each session in turn, or only from Entity.Session.
+//
+// A session is finished once the number of messages peeked on it are received, no message arrives within sessionIdleTimeout,
+// or a message is redelivered. An abandoned message is redelivered ahead of the rest of its session, so messages after a message abandoned,
+// e.g. by a filter, are only received by a later operation.
+//
+// Sessions stay locked until the entity is closed, so messages received from them can still be settled.
+
+// sessionReceiver is implemented by a servicebus.QueueSession and servicebus.SubscriptionSession.
+type sessionReceiver interface {
+	ReceiveOne(ctx context.Context, handler servicebus.SessionHandler) error
+	Close(ctx context.Context) error
+}
+
+// sessionOpener returns a receiver for a session of a queue or subscription.
+type sessionOpener func(id *string) sessionReceiver
+
+// sessionIterator peeks only the messages of a single session.
+type sessionIterator struct {
+	servicebus.MessageIterator
+	session string
+}
+
+func (it *sessionIterator) Next(ctx context.Context) (*servicebus.Message, error) {
+	for {
+		m, err := it.MessageIterator.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m.SessionID != nil && *m.SessionID == it.session {
+			return m, nil
+		}
+	}
+}
+
+// usesSessions reports whether the entity is received from by session, either as Entity.Session is set, or the entity requires sessions.
+func (e *serviceBusEntity) usesSessions(ctx context.Context) (bool, error) {
+	if e.openSession == nil {
+		return false, nil
+	}
+	if e.Session != "" {
+		return true, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.requiresSession == nil {
+		d, err := e.describe(ctx)
+		if err != nil {
+			return false, err
+		}
+		e.requiresSession = &d.RequiresSession
+	}
+	return *e.requiresSession, nil
+}
+
+// sessionCounts peeks every message on the entity, returning the number of messages on each session, and the sessions in the order of their first message.
+func (e *serviceBusEntity) sessionCounts(ctx context.Context) (map[string]int, []string, error) {
+	counts := make(map[string]int)
+	ids := []string{}
+	it, err := e.receiver.Peek(ctx, servicebus.PeekWithPageSize(e.pageSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	for !it.Done() {
+		m, err := it.Next(ctx)
+		if err != nil {
+			if _, ok := err.(servicebus.ErrNoMessages); ok {
+				break
+			}
+			return nil, nil, err
+		}
+		if m.SessionID == nil {
+			continue
+		}
+		if _, ok := counts[*m.SessionID]; !ok {
+			ids = append(ids, *m.SessionID)
+		}
+		counts[*m.SessionID]++
+	}
+	return counts, ids, nil
+}
+
+// receiveSessions receives from each session with messages, or only Entity.Session, until max messages are received. A max below 1 receives every message.
+// The number of messages received is returned.
+func (e *serviceBusEntity) receiveSessions(ctx context.Context, handler servicebus.Handler, max int) (int, error) {
+	counts, ids, err := e.sessionCounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	received := 0
+	for _, id := range ids {
+		if e.Session != "" && id != e.Session {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return received, err
+		}
+		expected := counts[id]
+		if max > 0 && max-received < expected {
+			expected = max - received
+		}
+		n, err := e.receiveSession(ctx, id, expected, handler)
+		received += n
+		if err != nil {
+			return received, err
+		}
+		if max > 0 && received >= max {
+			break
+		}
+	}
+	return received, nil
+}
+
+// receiveSession locks a session and passes each of its messages to the handler, until expected messages are received, or the session is finished.
+// The number of messages passed to the handler is returned.
+func (e *serviceBusEntity) receiveSession(ctx context.Context, id string, expected int, handler servicebus.Handler) (int, error) {
+	s := e.openSession(&id)
+	e.mu.Lock()
+	e.sessions = append(e.sessions, s)
+	e.mu.Unlock()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		received int
+		seen     = make(map[int64]bool)
+		once     sync.Once
+		finished = make(chan struct{})
+		session  *servicebus.MessageSession
+		idle     *time.Timer
+	)
+	finish := func() {
+		once.Do(func() {
+			close(finished)
+			session.Close()
+		})
+	}
+
+	h := servicebus.NewSessionHandler(servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
+		select {
+		case <-finished:
+			// messages delivered after the session is finished are left for a later receive
+			return m.Abandon(c)
+		default:
+		}
+		idle.Reset(sessionIdleTimeout)
+
+		mu.Lock()
+		redelivered := m.SystemProperties != nil && m.SystemProperties.SequenceNumber != nil && seen[*m.SystemProperties.SequenceNumber]
+		if !redelivered {
+			if m.SystemProperties != nil && m.SystemProperties.SequenceNumber != nil {
+				seen[*m.SystemProperties.SequenceNumber] = true
+			}
+			received++
+		}
+		done := received >= expected
+		mu.Unlock()
+
+		if redelivered {
+			finish()
+			return m.Abandon(c)
+		}
+		err := handler.Handle(c, m)
+		if done {
+			finish()
+		}
+		return err
+	}), func(ms *servicebus.MessageSession) error {
+		session = ms
+		idle = time.AfterFunc(sessionIdleTimeout, finish)
+		return nil
+	}, nil)
+
+	err := s.ReceiveOne(sessionCtx, h)
+	if idle != nil {
+		idle.Stop()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return received, err
+}
+
+// withSession locks a session, without receiving its messages, to call fn, e.g. to get or set the session's state.
+// ErrNoSessions is returned if the entity does not require sessions.
+func (e *serviceBusEntity) withSession(ctx context.Context, id string, fn func(ms *servicebus.MessageSession) error) error {
+	sessions, err := e.usesSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if !sessions {
+		return ErrNoSessions
+	}
+	s := e.openSession(&id)
+	defer s.Close(context.Background())
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	h := servicebus.NewSessionHandler(servicebus.HandlerFunc(func(c context.Context, m *servicebus.Message) error {
+		return m.Abandon(c)
+	}), func(ms *servicebus.MessageSession) error {
+		if err := fn(ms); err != nil {
+			return err
+		}
+		ms.Close()
+		return nil
+	}, nil)
+	return s.ReceiveOne(sessionCtx, h)
+}
+
+// sessionState returns the state of a session. ErrNoSessions is returned if the entity does not require sessions.
+func (e *serviceBusEntity) sessionState(ctx context.Context, id string) ([]byte, error) {
+	var state []byte
+	err := e.withSession(ctx, id, func(ms *servicebus.MessageSession) error {
+		var err error
+		state, err = ms.State(ctx)
+		return err
+	})
+	return state, err
+}
+
+// setSessionState replaces the state of a session. A nil state clears it.
+func (e *serviceBusEntity) setSessionState(ctx context.Context, id string, state []byte) error {
+	return e.withSession(ctx, id, func(ms *servicebus.MessageSession) error { return ms.SetState(ctx, state) })
+}
+
+// closeSessions releases the lock on every session received from.
+func (e *serviceBusEntity) closeSessions(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errs []error
+	for _, s := range e.sessions {
+		errs = append(errs, s.Close(ctx))
+	}
+	e.sessions = nil
+	return errors.Join(errs...)
+}
+
+// withSessionID stamps a SessionID onto each message sent without one. An empty session leaves messages unchanged.
+func withSessionID(msgs []*servicebus.Message, session string) {
+	if session == "" {
+		return
+	}
+	for _, m := range msgs {
+		if m.SessionID == nil {
+			id := session
+			m.SessionID = &id
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package sbcontroller
+
+import (
+	"context"
+	"testing"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func helper_sessionMessage(id, session string) *servicebus.Message {
+	m := &servicebus.Message{ID: id, Data: []byte(id)}
+	if session != "" {
+		m.SessionID = &session
+	}
+	return m
+}
+
+func Test_SessionIterator(t *testing.T) {
+	it := &sessionIterator{
+		MessageIterator: servicebus.AsMessageSliceIterator([]*servicebus.Message{
+			helper_sessionMessage("one", "a"),
+			helper_sessionMessage("two", "b"),
+			helper_sessionMessage("three", ""),
+			helper_sessionMessage("four", "a"),
+		}),
+		session: "a",
+	}
+
+	found := []string{}
+	for !it.Done() {
+		m, err := it.Next(context.Background())
+		if err != nil {
+			break
+		}
+		found = append(found, m.ID)
+	}
+	if len(found) != 2 || found[0] != "one" || found[1] != "four" {
+		t.Errorf("Unexpected messages peeked: %v", found)
+	}
+}
+
+func Test_WithSessionID(t *testing.T) {
+	msgs := []*servicebus.Message{helper_sessionMessage("one", ""), helper_sessionMessage("two", "b")}
+	withSessionID(msgs, "a")
+	if *msgs[0].SessionID != "a" || *msgs[1].SessionID != "b" {
+		t.Errorf("Unexpected session ids: %s, %s", *msgs[0].SessionID, *msgs[1].SessionID)
+	}
+
+	m := helper_sessionMessage("three", "")
+	withSessionID([]*servicebus.Message{m}, "")
+	if m.SessionID != nil {
+		t.Errorf("Unexpected session id: %s", *m.SessionID)
+	}
+}
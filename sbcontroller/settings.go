@@ -0,0 +1,178 @@
+package sbcontroller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchSize is the number of messages sent together in each batch, where they fit within the broker's maximum batch size.
+	DefaultBatchSize   int = 100
+	DefaultConcurrency int = 32
+	DefaultMaxAttempts int = 5
+	// DefaultMaxMessageSize is the largest message accepted by a standard tier namespace, 256KB.
+	DefaultMaxMessageSize int = 256 * 1024
+	// PremiumMaxMessageSize is the largest message that can be configured on a premium tier namespace, 100MB.
+	PremiumMaxMessageSize int           = 100 * 1024 * 1024
+	DefaultPageSize       int           = 100
+	DefaultPrefetch       uint32        = 250
+	DefaultSettleTimeout  time.Duration = 5 * time.Second
+)
+
+// Settings tunes how a Controller interacts with Service Bus. A zero value uses the default for that setting.
+//
+// Large premium namespaces can process more messages at once, with a larger prefetch, while throttled standard namespaces need fewer,
+// so that messages are not held in a prefetch buffer, or waiting for a worker, until their locks expire.
+type Settings struct {
+	// Concurrency is the maximum number of messages settled at once by DeleteManyMessages and TidyMessages.
+	Concurrency int
+	// PageSize is the number of messages fetched by each peek, in ReadSourceQueue and TidyMessages without execute.
+	PageSize int
+	// Prefetch is the number of messages buffered by a queue set up to purge (i.e. to receive many messages).
+	Prefetch uint32
+	// SettleTimeout bounds each attempt to complete or abandon a message.
+	SettleTimeout time.Duration
+	// Rate is the maximum number of messages per second sent, deleted or requeued by every operation that changes a queue. Zero is unlimited.
+	Rate float64
+	// Burst is the number of messages that can be sent, deleted or requeued at once, before Rate applies. Defaults to 1 when Rate is set.
+	Burst int
+	// MaxAttempts is the number of times a call to Service Bus is attempted, when it fails with a transient error, before the error is returned.
+	// It also bounds the attempts to complete or abandon each message.
+	MaxAttempts int
+	// MaxMessageSize is the largest message body, in bytes, that is sent. Larger messages are rejected with ErrMessageTooLarge before they reach the broker.
+	MaxMessageSize int
+	// BatchSize is the maximum number of messages sent in each batch, by SendManyEnvelopes, SendManyJsonMessages and RequeueManyMessages.
+	// Batches are also bounded by the broker's maximum batch size, 256KB, or 1MB when MaxMessageSize is above the standard tier's limit.
+	// With Rate, batches are no larger than Burst, so no more than Burst messages reach the target at once.
+	BatchSize int
+}
+
+// batchSize returns the maximum number of messages in a batch, BatchSize, or Burst if smaller when rate limited,
+// as a batch takes a token from the limiter for each of its messages, and is sent at once.
+func (s Settings) batchSize() int {
+	if s.Rate > 0 && s.Burst > 0 && s.Burst < s.BatchSize {
+		return s.Burst
+	}
+	return s.BatchSize
+}
+
+// DefaultSettings returns the settings used when a Controller is not configured.
+func DefaultSettings() Settings {
+	return Settings{
+		Concurrency:    DefaultConcurrency,
+		PageSize:       DefaultPageSize,
+		Prefetch:       DefaultPrefetch,
+		SettleTimeout:  DefaultSettleTimeout,
+		MaxAttempts:    DefaultMaxAttempts,
+		MaxMessageSize: DefaultMaxMessageSize,
+		BatchSize:      DefaultBatchSize,
+	}
+}
+
+// WithDefaults validates settings, replacing zero values with their defaults.
+func (s Settings) WithDefaults() (Settings, error) {
+	if s.Concurrency < 0 {
+		return s, fmt.Errorf("concurrency must be at least 1, got %d", s.Concurrency)
+	}
+	if s.PageSize < 0 {
+		return s, fmt.Errorf("page size must be at least 1, got %d", s.PageSize)
+	}
+	if s.SettleTimeout < 0 {
+		return s, fmt.Errorf("settle timeout must be positive, got %v", s.SettleTimeout)
+	}
+	if s.Rate < 0 {
+		return s, fmt.Errorf("rate must be positive, got %v", s.Rate)
+	}
+	if s.Burst < 0 {
+		return s, fmt.Errorf("burst must be at least 1, got %d", s.Burst)
+	}
+	if s.MaxAttempts < 0 {
+		return s, fmt.Errorf("max attempts must be at least 1, got %d", s.MaxAttempts)
+	}
+	if s.MaxMessageSize < 0 || s.MaxMessageSize > PremiumMaxMessageSize {
+		return s, fmt.Errorf("max message size must be between 1 and %d bytes, got %d", PremiumMaxMessageSize, s.MaxMessageSize)
+	}
+	if s.BatchSize < 0 {
+		return s, fmt.Errorf("batch size must be at least 1, got %d", s.BatchSize)
+	}
+
+	d := DefaultSettings()
+	if s.Concurrency == 0 {
+		s.Concurrency = d.Concurrency
+	}
+	if s.PageSize == 0 {
+		s.PageSize = d.PageSize
+	}
+	if s.Prefetch == 0 {
+		s.Prefetch = d.Prefetch
+	}
+	if s.SettleTimeout == 0 {
+		s.SettleTimeout = d.SettleTimeout
+	}
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = d.MaxAttempts
+	}
+	if s.MaxMessageSize == 0 {
+		s.MaxMessageSize = d.MaxMessageSize
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = d.BatchSize
+	}
+	if s.Rate > 0 && s.Burst == 0 {
+		s.Burst = 1
+	}
+	return s, nil
+}
+
+// ParseSize parses a size in bytes, e.g. "262144", "256KB" or "100MB". Units are powers of 1024.
+func ParseSize(s string) (int, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	unit := 1
+	for suffix, size := range map[string]int{"KB": 1024, "MB": 1024 * 1024} {
+		if strings.HasSuffix(v, suffix) {
+			v, unit = strings.TrimSuffix(v, suffix), size
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(v, "B")))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s', expected e.g. 256KB or 100MB", s)
+	}
+	return n * unit, nil
+}
+
+// workerPool runs functions on a bounded number of goroutines.
+type workerPool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{sem: make(chan struct{}, size)}
+}
+
+// run waits for a free worker, then calls f on it. If the context is done first, f is not called and false is returned.
+func (p *workerPool) run(ctx context.Context, f func()) bool {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		f()
+	}()
+	return true
+}
+
+// wait blocks until every function passed to run has returned.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
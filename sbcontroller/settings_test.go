@@ -0,0 +1,84 @@
+package sbcontroller
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Settings_WithDefaults(t *testing.T) {
+	s, err := Settings{Concurrency: 4}.WithDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Concurrency != 4 || s.PageSize != DefaultPageSize || s.Prefetch != DefaultPrefetch || s.SettleTimeout != DefaultSettleTimeout || s.BatchSize != DefaultBatchSize {
+		t.Errorf("Unexpected settings: %+v", s)
+	}
+}
+
+func Test_Settings_WithDefaults_Fail_Negative(t *testing.T) {
+	for _, s := range []Settings{{Concurrency: -1}, {PageSize: -1}, {SettleTimeout: -time.Second}, {Rate: -1}, {Burst: -1}, {MaxMessageSize: PremiumMaxMessageSize + 1}, {BatchSize: -1}} {
+		if _, err := s.WithDefaults(); err == nil {
+			t.Errorf("Invalid settings were accepted: %+v", s)
+		}
+	}
+}
+
+func Test_WorkerPool_Bounded(t *testing.T) {
+	pool := newWorkerPool(2)
+	var running, max int32
+	var mu sync.Mutex
+
+	for i := 0; i < 10; i++ {
+		pool.run(context.Background(), func() {
+			n := atomic.AddInt32(&running, 1)
+			mu.Lock()
+			if n > max {
+				max = n
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	pool.wait()
+
+	if max > 2 {
+		t.Errorf("Pool ran %d functions at once", max)
+	}
+}
+
+func Test_WorkerPool_Cancelled(t *testing.T) {
+	pool := newWorkerPool(1)
+	release := make(chan struct{})
+	pool.run(context.Background(), func() { <-release })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if pool.run(ctx, func() { t.Error("function ran after cancellation") }) {
+		t.Error("run did not report cancellation")
+	}
+	close(release)
+	pool.wait()
+}
+
+func Test_ParseSize(t *testing.T) {
+	tests := map[string]int{"262144": 262144, "256KB": 256 * 1024, "100MB": 100 * 1024 * 1024, "1mb": 1024 * 1024, "512B": 512}
+	for s, expected := range tests {
+		v, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+		if v != expected {
+			t.Errorf("%s: expected %d, got %d", s, expected, v)
+		}
+	}
+
+	for _, s := range []string{"", "large", "-1KB", "1GB"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Invalid size was accepted: %s", s)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package sbcontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"text/template"
+)
+
+// Transform rewrites the body of a message before it is sent to a target queue.
+type Transform interface {
+	Apply(m *Message) ([]byte, error)
+}
+
+// TemplateTransform replaces the body with the output of a template, executed against the Message.
+type TemplateTransform struct {
+	Template *template.Template
+}
+
+// Apply executes the template against the message.
+func (t *TemplateTransform) Apply(m *Message) ([]byte, error) {
+	var b bytes.Buffer
+	if err := t.Template.Execute(&b, m); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// MergePatchTransform applies a JSON merge patch (RFC 7386) to a JSON body.
+type MergePatchTransform struct {
+	Patch []byte
+}
+
+// Apply merges the patch into the message body. An error is returned if either the body or patch is not valid JSON.
+func (t *MergePatchTransform) Apply(m *Message) ([]byte, error) {
+	var target, patch interface{}
+	if err := decodeJson(m.Data, &target); err != nil {
+		return nil, fmt.Errorf("message body is not valid JSON: %v", err)
+	}
+	if err := decodeJson(t.Patch, &patch); err != nil {
+		return nil, fmt.Errorf("merge patch is not valid JSON: %v", err)
+	}
+	return encodeJson(mergePatch(target, patch))
+}
+
+// RegexTransform replaces every match of Pattern in the body with Replacement. Replacement supports expansion, e.g. '$1'.
+type RegexTransform struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Apply performs the find and replace on the message body.
+func (t *RegexTransform) Apply(m *Message) ([]byte, error) {
+	return t.Pattern.ReplaceAll(m.Data, []byte(t.Replacement)), nil
+}
+
+// decodeJson decodes a single JSON value, keeping numbers as json.Number so they are written back unchanged. Data after the value is rejected.
+func decodeJson(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// encodeJson encodes a value as compact JSON, without escaping characters such as '<' and '&' for HTML, which a body is not written into.
+func encodeJson(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
@@ -0,0 +1,103 @@
+package sbcontroller
+
+import (
+	"regexp"
+	"testing"
+	"text/template"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+)
+
+func Test_Transform_Template(t *testing.T) {
+	tr := &TemplateTransform{Template: template.Must(template.New("test").Parse(`{"id":"{{.ID}}","body":{{.Data | printf "%s"}}}`))}
+
+	b, err := tr.Apply(&Message{ID: "id-1", Data: []byte(`{"message":"hello"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"id":"id-1","body":{"message":"hello"}}` {
+		t.Errorf("Unexpected body: %s", b)
+	}
+}
+
+func Test_Transform_MergePatch(t *testing.T) {
+	tr := &MergePatchTransform{Patch: []byte(`{"version":2,"legacy":null,"customer":{"region":"eu"}}`)}
+
+	b, err := tr.Apply(&Message{Data: []byte(`{"version":1,"legacy":"x","customer":{"id":12345678901234567890,"region":"us"}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"customer":{"id":12345678901234567890,"region":"eu"},"version":2}` {
+		t.Errorf("Unexpected body: %s", b)
+	}
+}
+
+func Test_Transform_MergePatch_Fail_NotJson(t *testing.T) {
+	tr := &MergePatchTransform{Patch: []byte(`{"version":2}`)}
+
+	_, err := tr.Apply(&Message{Data: []byte("hello, world")})
+	if err == nil {
+		t.Error("non-JSON body was patched")
+	}
+
+	// only the first of several values would be patched, losing the rest
+	for _, body := range []string{`{"version":1}{"version":1}`, `{"version":1} trailing`, `{"version":1}}`} {
+		if _, err := tr.Apply(&Message{Data: []byte(body)}); err == nil {
+			t.Errorf("Body with trailing data was patched: %s", body)
+		}
+	}
+}
+
+func Test_Transform_MergePatch_NoHTMLEscape(t *testing.T) {
+	tr := &MergePatchTransform{Patch: []byte(`{"link":"<a href=\"?a=1&b=2\">"}`)}
+
+	b, err := tr.Apply(&Message{Data: []byte(`{"version":1}  `)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"link":"<a href=\"?a=1&b=2\">","version":1}` {
+		t.Errorf("Unexpected body: %s", b)
+	}
+}
+
+func Test_Transform_Regex(t *testing.T) {
+	tr := &RegexTransform{Pattern: regexp.MustCompile(`/v1/(\w+)`), Replacement: "/v2/$1"}
+
+	b, err := tr.Apply(&Message{Data: []byte(`{"href":"/v1/orders"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"href":"/v2/orders"}` {
+		t.Errorf("Unexpected body: %s", b)
+	}
+}
+
+func Test_Transform_NewTransformedMessage_KeepsProperties(t *testing.T) {
+	original := &servicebus.Message{
+		ID:             "id-1",
+		Label:          "order",
+		UserProperties: map[string]interface{}{"type": "order"},
+		Data:           []byte(`{"version":1}`),
+	}
+
+	m, err := newTransformedMessage(original, &MergePatchTransform{Patch: []byte(`{"version":2}`)}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(m.Data) != `{"version":2}` {
+		t.Errorf("Unexpected body: %s", m.Data)
+	}
+
+	if m.ID != "id-1" || m.Label != "order" || m.UserProperties["type"] != "order" {
+		t.Errorf("Unexpected message properties: %+v", m)
+	}
+
+	if string(original.Data) != `{"version":1}` {
+		t.Errorf("Original body was modified: %s", original.Data)
+	}
+}